@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// countSuffix is appended to an output's path to name the sidecar file that
+// records how many inputs the output averages, for --accumulate.
+const countSuffix = ".count"
+
+// meanSuffix is appended to an output's path to name the sidecar file that
+// holds its running average at full precision, for --accumulate.
+const meanSuffix = ".mean"
+
+// accumulatePrior is the earlier average loaded from --accumulate as
+// premultiplied 16-bit R, G, B and A values per pixel in row-major order, or
+// nil.
+var accumulatePrior []float64
+
+// accumulateCount is the number of inputs accumulatePrior averages.
+var accumulateCount int
+
+// accumulateMeans is the running average finish folded for this run, in the
+// layout of accumulatePrior, to be written to the output's sidecar.
+var accumulateMeans []float64
+
+// loadAccumulate reads the earlier average at path and the count in its
+// sidecar, and checks that it is the same size as the input at first. The
+// average comes from the full-precision sidecar when there is one, and is
+// otherwise decoded from the 8-bit image itself.
+func loadAccumulate(path, first string) ([]float64, int, error) {
+	n, err := readCount(path + countSuffix)
+	if err != nil {
+		return nil, 0, err
+	}
+	b, err := os.ReadFile(path + meanSuffix)
+	if os.IsNotExist(err) {
+		prior, err := loadBackground(path, first)
+		if err != nil {
+			return nil, 0, err
+		}
+		return imageMeans(prior), n, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	h, err := readHeader(first)
+	if err != nil {
+		return nil, 0, err
+	}
+	if want := 32 * h.width * h.height; len(b) != want {
+		return nil, 0, fmt.Errorf("%v holds %v bytes, but the inputs are %vx%v, which needs %v", path+meanSuffix, len(b), h.width, h.height, want)
+	}
+	means := make([]float64, len(b)/8)
+	for i := range means {
+		means[i] = math.Float64frombits(binary.LittleEndian.Uint64(b[8*i:]))
+	}
+	return means, n, nil
+}
+
+// writeMeans writes means as the full-precision sidecar of the output at
+// path.
+func writeMeans(path string, means []float64) error {
+	b := make([]byte, 8*len(means))
+	for i, v := range means {
+		binary.LittleEndian.PutUint64(b[8*i:], math.Float64bits(v))
+	}
+	return os.WriteFile(path+meanSuffix, b, 0644)
+}
+
+// imageMeans returns the premultiplied 16-bit channels of every pixel of img
+// in the layout of accumulatePrior.
+func imageMeans(img image.Image) []float64 {
+	b := img.Bounds()
+	means := make([]float64, 0, 4*b.Dx()*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := img.At(x, y).RGBA()
+			means = append(means, float64(r), float64(g), float64(bl), float64(a))
+		}
+	}
+	return means
+}
+
+// readCount reads the sidecar at path: a single positive decimal integer,
+// optionally followed by a newline.
+func readCount(path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%v does not hold a positive count of inputs: %q", path, strings.TrimSpace(string(b)))
+	}
+	return n, nil
+}
+
+// writeCount writes n as the sidecar of the output at path.
+func writeCount(path string, n int) error {
+	return os.WriteFile(path+countSuffix, []byte(strconv.Itoa(n)+"\n"), 0644)
+}
+
+// accumulate folds out, the average of total new inputs, into prior, the
+// average of count earlier ones, weighting each by its number of inputs, and
+// returns the result both as an image and at full precision. A nil prior
+// starts a new running average. A pixel where every new sample was rejected
+// keeps the prior's value. Colors are premultiplied, so averaging them also
+// averages alpha correctly.
+//
+// The running average is kept unrounded: once count is in the hundreds, one
+// new input moves a pixel by less than half an 8-bit level, so an average
+// rounded on every run would never move again.
+func accumulate(out *image.RGBA, kept []int, total int, prior []float64, count int) (*image.RGBA, []float64) {
+	if prior == nil {
+		prior = imageMeans(out)
+	}
+	b := out.Bounds()
+	dst := image.NewRGBA(b)
+	means := make([]float64, len(prior))
+	w := float64(total) / float64(total+count)
+	to8 := func(v float64) uint8 {
+		return uint8(v/0x101 + 0.5)
+	}
+	for k, n := range kept {
+		x, y := b.Min.X+k%b.Dx(), b.Min.Y+k/b.Dx()
+		m := means[4*k : 4*k+4]
+		copy(m, prior[4*k:4*k+4])
+		if n > 0 {
+			r, g, bl, a := out.RGBAAt(x, y).RGBA()
+			for ch, v := range [4]uint32{r, g, bl, a} {
+				m[ch] += w * (float64(v) - m[ch])
+			}
+		}
+		dst.SetRGBA(x, y, color.RGBA{to8(m[0]), to8(m[1]), to8(m[2]), to8(m[3])})
+	}
+	return dst, means
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"path/filepath"
+	"testing"
+)
+
+// TestAccumulate checks that folding new inputs into an earlier average
+// weights each side by its number of inputs, keeps the earlier value where
+// every new sample was rejected, and that the count round-trips through its
+// sidecar.
+func TestAccumulate(t *testing.T) {
+	prior := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	prior.SetRGBA(0, 0, color.RGBA{100, 0, 0, 255})
+	prior.SetRGBA(1, 0, color.RGBA{40, 40, 40, 255})
+	out := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	out.SetRGBA(0, 0, color.RGBA{200, 0, 0, 255})
+
+	got, _ := accumulate(out, []int{1, 0}, 1, imageMeans(prior), 3)
+	if c := got.RGBAAt(0, 0); c != (color.RGBA{125, 0, 0, 255}) {
+		t.Errorf("3 earlier inputs at 100 and 1 new at 200 gave %v, want red 125", c)
+	}
+	if c := got.RGBAAt(1, 0); c != prior.RGBAAt(1, 0) {
+		t.Errorf("pixel with no new samples is %v, want the earlier %v", c, prior.RGBAAt(1, 0))
+	}
+
+	path := filepath.Join(t.TempDir(), "avg.png")
+	if err := writeCount(path, 4); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := readCount(path + countSuffix); err != nil || n != 4 {
+		t.Errorf("readCount = %v, %v; want 4", n, err)
+	}
+}
+
+// TestAccumulateManyRuns folds one input at a time into an average of 300,
+// where each fold moves the pixel by about a third of an 8-bit level, and
+// checks that the average still reaches the exact mean, including through
+// the sidecars and an 8-bit PNG written between runs.
+func TestAccumulateManyRuns(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "avg.png")
+	prior := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	prior.SetRGBA(0, 0, color.RGBA{100, 100, 100, 255})
+	if _, err := writeImage(path, prior); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeCount(path, 300); err != nil {
+		t.Fatal(err)
+	}
+	out := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	out.SetRGBA(0, 0, color.RGBA{200, 200, 200, 255})
+
+	for run := 0; run < 100; run++ {
+		means, count, err := loadAccumulate(path, path)
+		if err != nil {
+			t.Fatalf("run %v: %v", run, err)
+		}
+		got, means := accumulate(out, []int{1}, 1, means, count)
+		if _, err := writeImage(path, got); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeCount(path, count+1); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeMeans(path, means); err != nil {
+			t.Fatal(err)
+		}
+	}
+	img, err := decodeFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 300 inputs at 100 and 100 at 200 average 125.
+	if r, _, _, _ := img.At(0, 0).RGBA(); r>>8 != 125 {
+		t.Errorf("after 100 runs the average is %v, want red 125", img.At(0, 0))
+	}
+}
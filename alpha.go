@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"strings"
+)
+
+// checkAlphaConsistency implements --validate-alpha-consistency. It decodes
+// every input in paths and fails if some are fully opaque while others have
+// transparent or translucent pixels, logging which inputs fall on each side.
+// Averaging such a mix makes every output pixel partly transparent where only
+// the opaque inputs should have counted.
+func checkAlphaConsistency(paths []string) error {
+	var opaque, transparent []string
+	for _, p := range paths {
+		i, err := decodeFile(p)
+		if err != nil {
+			return err
+		}
+		if isOpaque(i) {
+			opaque = append(opaque, p)
+		} else {
+			transparent = append(transparent, p)
+		}
+	}
+	if len(opaque) == 0 || len(transparent) == 0 {
+		return nil
+	}
+	log.Printf("fully opaque inputs: %v", strings.Join(opaque, ", "))
+	log.Printf("inputs with transparency: %v", strings.Join(transparent, ", "))
+	return fmt.Errorf("%v of %v inputs have transparency while the other %v are fully opaque, so their alpha would be averaged together; flatten the transparent inputs onto a background, or drop them, before merging", len(transparent), len(paths), len(opaque))
+}
+
+// isOpaque reports whether every pixel of i is fully opaque. Formats without
+// alpha, such as JPEG, answer without looking at the pixels.
+func isOpaque(i image.Image) bool {
+	if o, ok := i.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	b := i.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := i.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
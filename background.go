@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// backgroundImage is the image loaded from --background-image, or nil.
+var backgroundImage image.Image
+
+// loadBackground decodes the background at path and checks that it is the same
+// size as the input at first.
+func loadBackground(path, first string) (image.Image, error) {
+	bg, err := decodeFile(path)
+	if err != nil {
+		return nil, err
+	}
+	h, err := readHeader(first)
+	if err != nil {
+		return nil, err
+	}
+	if bg.Bounds().Dx() != h.width || bg.Bounds().Dy() != h.height {
+		return nil, fmt.Errorf("%v is %vx%v but the inputs are %vx%v", path, bg.Bounds().Dx(), bg.Bounds().Dy(), h.width, h.height)
+	}
+	return bg, nil
+}
+
+// composite places out over bg using source-over blending, so bg shows through
+// wherever out is partially or fully transparent.
+func composite(out *image.RGBA, bg image.Image) *image.RGBA {
+	b := out.Bounds()
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, bg, bg.Bounds().Min, draw.Src)
+	draw.Draw(dst, b, out, b.Min, draw.Over)
+	return dst
+}
+
+// confidenceAlpha returns a copy of out where every pixel's alpha is scaled by
+// the fraction of its samples that were kept, so pixels averaged from many
+// agreeing samples stay opaque while poorly supported ones fade out. kept and
+// total are as passed to finish. Colors are premultiplied, so they scale too
+// and the straight color is unchanged.
+func confidenceAlpha(out *image.RGBA, kept []int, total int) *image.RGBA {
+	b := out.Bounds()
+	dst := image.NewRGBA(b)
+	for k, n := range kept {
+		x, y := b.Min.X+k%b.Dx(), b.Min.Y+k/b.Dx()
+		f := float64(n) / float64(total)
+		c := out.RGBAAt(x, y)
+		dst.SetRGBA(x, y, color.RGBA{
+			uint8(float64(c.R)*f + 0.5),
+			uint8(float64(c.G)*f + 0.5),
+			uint8(float64(c.B)*f + 0.5),
+			uint8(float64(c.A)*f + 0.5),
+		})
+	}
+	return dst
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ssimRadius is the half-width of the square window SSIM is computed over,
+// giving a 7x7 window.
+const ssimRadius = 3
+
+// baselineMetrics describes how an output differs from --baseline.
+type baselineMetrics struct {
+	// PSNR over the 8-bit R, G and B channels, in dB. It is +Inf when the
+	// images are identical.
+	PSNR float64
+	// SSIM is the mean structural similarity of the two images' brightness.
+	SSIM float64
+	// MaxDelta is the largest difference of any 8-bit channel, alpha included.
+	MaxDelta int
+}
+
+// tolerance holds the limits given by --tolerance. A limit that wasn't given
+// is NaN, or -1 for MaxDelta.
+type tolerance struct {
+	PSNR, SSIM float64
+	MaxDelta   int
+}
+
+// parseTolerance reads --tolerance, a comma separated list of 'psnr=<min dB>',
+// 'ssim=<min>' and 'max-delta=<max>' limits.
+func parseTolerance(s string) (tolerance, error) {
+	t := tolerance{PSNR: math.NaN(), SSIM: math.NaN(), MaxDelta: -1}
+	if s == "" {
+		return t, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return t, fmt.Errorf("%q must look like name=value", part)
+		}
+		var err error
+		switch strings.TrimSpace(kv[0]) {
+		case "psnr":
+			t.PSNR, err = strconv.ParseFloat(kv[1], 64)
+		case "ssim":
+			t.SSIM, err = strconv.ParseFloat(kv[1], 64)
+		case "max-delta":
+			t.MaxDelta, err = strconv.Atoi(kv[1])
+		default:
+			return t, fmt.Errorf("unknown limit %q; must be 'psnr', 'ssim' or 'max-delta'", kv[0])
+		}
+		if err != nil {
+			return t, fmt.Errorf("failed to parse %q: %v", part, err)
+		}
+	}
+	return t, nil
+}
+
+// violations lists every limit of t that m falls outside.
+func (t tolerance) violations(m baselineMetrics) []string {
+	var out []string
+	if !math.IsNaN(t.PSNR) && m.PSNR < t.PSNR {
+		out = append(out, fmt.Sprintf("PSNR %.2f dB is below %v", m.PSNR, t.PSNR))
+	}
+	if !math.IsNaN(t.SSIM) && m.SSIM < t.SSIM {
+		out = append(out, fmt.Sprintf("SSIM %.5f is below %v", m.SSIM, t.SSIM))
+	}
+	if t.MaxDelta >= 0 && m.MaxDelta > t.MaxDelta {
+		out = append(out, fmt.Sprintf("max channel delta %v is above %v", m.MaxDelta, t.MaxDelta))
+	}
+	return out
+}
+
+// checkBaseline compares img, as it is encoded for path, with the image at
+// --baseline. It writes the metrics to w and returns an error if they fall
+// outside --tolerance. Comparing the encoded output rather than img keeps
+// lossy JPEG output comparable with a baseline saved by an earlier run.
+func checkBaseline(w io.Writer, path string, img image.Image) error {
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, path, img); err != nil {
+		return err
+	}
+	got, _, err := image.Decode(&buf)
+	if err != nil {
+		return err
+	}
+	want, err := decodeFile(*baselineFlag)
+	if err != nil {
+		return err
+	}
+	if got.Bounds().Size() != want.Bounds().Size() {
+		return fmt.Errorf("output is %v but %v is %v", got.Bounds().Size(), *baselineFlag, want.Bounds().Size())
+	}
+
+	m := compareImages(got, want)
+	fmt.Fprintf(w, "compared with %v: PSNR %.2f dB, SSIM %.5f, max channel delta %v\n", *baselineFlag, m.PSNR, m.SSIM, m.MaxDelta)
+	t, err := parseTolerance(*toleranceFlag)
+	if err != nil {
+		return err
+	}
+	if v := t.violations(m); len(v) > 0 {
+		return fmt.Errorf("output is outside --tolerance: %v", strings.Join(v, "; "))
+	}
+	return nil
+}
+
+// compareImages computes the baselineMetrics of a against b, which must be the
+// same size.
+func compareImages(a, b image.Image) baselineMetrics {
+	ab, bb := a.Bounds(), b.Bounds()
+	w, h := ab.Dx(), ab.Dy()
+	m := baselineMetrics{}
+	sqErr := 0.0
+	va, vb := make([]float64, w*h), make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r1, g1, b1, a1 := a.At(ab.Min.X+x, ab.Min.Y+y).RGBA()
+			r2, g2, b2, a2 := b.At(bb.Min.X+x, bb.Min.Y+y).RGBA()
+			c1 := [4]int{int(r1 >> 8), int(g1 >> 8), int(b1 >> 8), int(a1 >> 8)}
+			c2 := [4]int{int(r2 >> 8), int(g2 >> 8), int(b2 >> 8), int(a2 >> 8)}
+			for ch := range c1 {
+				d := c1[ch] - c2[ch]
+				if d < 0 {
+					d = -d
+				}
+				if d > m.MaxDelta {
+					m.MaxDelta = d
+				}
+				if ch < 3 {
+					sqErr += float64(d * d)
+				}
+			}
+			va[y*w+x] = float64(c1[0]+c1[1]+c1[2]) / 3
+			vb[y*w+x] = float64(c2[0]+c2[1]+c2[2]) / 3
+		}
+	}
+	mse := sqErr / float64(3*w*h)
+	m.PSNR = 10 * math.Log10(255*255/mse)
+	m.SSIM = ssim(va, vb, w, h)
+	return m
+}
+
+// ssim is the mean structural similarity of two w by h brightness grids on the
+// 0-255 scale, using uniform windows of ssimRadius.
+func ssim(a, b []float64, w, h int) float64 {
+	const (
+		c1 = (0.01 * 255) * (0.01 * 255)
+		c2 = (0.03 * 255) * (0.03 * 255)
+	)
+	aSq, bSq, ab := make([]float64, len(a)), make([]float64, len(a)), make([]float64, len(a))
+	for k := range a {
+		aSq[k], bSq[k], ab[k] = a[k]*a[k], b[k]*b[k], a[k]*b[k]
+	}
+	mA, mB := boxMean(a, w, h, ssimRadius), boxMean(b, w, h, ssimRadius)
+	mASq, mBSq, mAB := boxMean(aSq, w, h, ssimRadius), boxMean(bSq, w, h, ssimRadius), boxMean(ab, w, h, ssimRadius)
+	sum := 0.0
+	for k := range a {
+		varA, varB := mASq[k]-mA[k]*mA[k], mBSq[k]-mB[k]*mB[k]
+		cov := mAB[k] - mA[k]*mB[k]
+		sum += (2*mA[k]*mB[k] + c1) * (2*cov + c2) / ((mA[k]*mA[k] + mB[k]*mB[k] + c1) * (varA + varB + c2))
+	}
+	return sum / float64(len(a))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"image"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestCheckBaseline compares an image with itself, with a slightly brighter
+// copy and with a smaller one, and checks which --tolerance limits pass.
+func TestCheckBaseline(t *testing.T) {
+	defer func(b, tol string) { *baselineFlag, *toleranceFlag = b, tol }(*baselineFlag, *toleranceFlag)
+	dir := t.TempDir()
+	img := noisyFrames(1, 32, 32)[0].(*image.RGBA)
+	brighter := image.NewRGBA(img.Bounds())
+	for k, v := range img.Pix {
+		if k%4 != 3 && v < 250 {
+			v += 5
+		}
+		brighter.Pix[k] = v
+	}
+	same := filepath.Join(dir, "same.png")
+	bright := filepath.Join(dir, "bright.png")
+	small := filepath.Join(dir, "small.png")
+	for path, i := range map[string]image.Image{same: img, bright: brighter, small: image.NewRGBA(image.Rect(0, 0, 8, 8))} {
+		if err := writeImageAtomic(path, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		baseline, tolerance string
+		wantErr             string
+	}{
+		{same, "psnr=60,ssim=1,max-delta=0", ""},
+		{bright, "max-delta=5", ""},
+		{bright, "max-delta=4", "max channel delta 5 is above 4"},
+		{bright, "psnr=60", "PSNR"},
+		{bright, "", ""},
+		{small, "", "output is (32,32) but"},
+	}
+	for _, tc := range tests {
+		*baselineFlag, *toleranceFlag = tc.baseline, tc.tolerance
+		err := checkBaseline(io.Discard, "out.png", img)
+		switch {
+		case tc.wantErr == "" && err != nil:
+			t.Errorf("%v --tolerance=%q: %v", filepath.Base(tc.baseline), tc.tolerance, err)
+		case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+			t.Errorf("%v --tolerance=%q returned %v; want an error containing %q", filepath.Base(tc.baseline), tc.tolerance, err, tc.wantErr)
+		}
+	}
+
+	if m := compareImages(img, img); !math.IsInf(m.PSNR, 1) || m.SSIM != 1 || m.MaxDelta != 0 {
+		t.Errorf("an image compared with itself gave %+v; want infinite PSNR, SSIM 1 and no delta", m)
+	}
+}
+
+// TestBaselineExitStatus runs the tool in a child process and checks that it
+// exits with status 0 when the output is within --tolerance of --baseline,
+// and with a failure when it is not.
+func TestBaselineExitStatus(t *testing.T) {
+	if os.Getenv("AVERAGE_IMAGE_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	dir := t.TempDir()
+	writeFrames(t, dir, 3, 16, 16)
+	baseline := filepath.Join(dir, "baseline.png")
+	if err := writeImageAtomic(baseline, noisyFrames(1, 16, 16)[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(tolerance string) error {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestBaselineExitStatus$",
+			"-path="+filepath.Join(dir, "0*.png"), "-output="+filepath.Join(dir, "out.png"), "-force",
+			"-baseline="+baseline, "-tolerance="+tolerance)
+		cmd.Env = append(os.Environ(), "AVERAGE_IMAGE_MAIN=1")
+		return cmd.Run()
+	}
+	if err := run("max-delta=255"); err != nil {
+		t.Errorf("within --tolerance: %v; want exit status 0", err)
+	}
+	if err, ok := run("psnr=99").(*exec.ExitError); !ok || err.ExitCode() == 0 {
+		t.Errorf("outside --tolerance: %v; want a failing exit status", err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"container/list"
+	"image"
+	"sync"
+)
+
+// inputCache keeps recently decoded files for decodeFile when
+// --input-cache-memory is set, or is nil.
+var inputCache *decodeCache
+
+// decodeCache is a least-recently-used cache of decoded images, keyed by path,
+// whose estimated decoded size stays within budget bytes. It is safe for
+// concurrent use by the decoders.
+type decodeCache struct {
+	mu           sync.Mutex
+	budget, used int64
+	order        *list.List // of *cacheEntry, most recent first
+	entries      map[string]*list.Element
+	hits, misses int
+}
+
+type cacheEntry struct {
+	path string
+	img  image.Image
+	size int64
+}
+
+func newDecodeCache(budget int64) *decodeCache {
+	return &decodeCache{budget: budget, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+// get returns the cached image for path, marking it most recently used.
+func (c *decodeCache) get(path string) (image.Image, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[path]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(e)
+	return e.Value.(*cacheEntry).img, true
+}
+
+// put caches img for path, evicting the least recently used images until it
+// fits. Images larger than the whole budget are not cached.
+func (c *decodeCache) put(path string, img image.Image) {
+	b := img.Bounds()
+	size := int64(b.Dx()) * int64(b.Dy()) * bytesPerPixel(img.ColorModel())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if size > c.budget {
+		return
+	}
+	if _, ok := c.entries[path]; ok {
+		return
+	}
+	for c.used+size > c.budget {
+		last := c.order.Back()
+		e := last.Value.(*cacheEntry)
+		c.order.Remove(last)
+		delete(c.entries, e.path)
+		c.used -= e.size
+	}
+	c.entries[path] = c.order.PushFront(&cacheEntry{path, img, size})
+	c.used += size
+}
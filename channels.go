@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"strings"
+
+	"github.com/montanaflynn/stats"
+)
+
+// channelFilters holds the --filter-per-channel strategy for the R, G, B and A
+// channels, or is nil when every channel is filtered together.
+var channelFilters []string
+
+// parseChannelFilters parses a --filter-per-channel list such as
+// 'R:stddev,G:stddev,B:median,A:none'. Channels the list leaves out use
+// stddev.
+func parseChannelFilters(list string) ([]string, error) {
+	filters := []string{"stddev", "stddev", "stddev", "stddev"}
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(list, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q is not of the form 'channel:filter'", entry)
+		}
+		ch := strings.Index("RGBA", strings.ToUpper(parts[0]))
+		if len(parts[0]) != 1 || ch < 0 {
+			return nil, fmt.Errorf("unknown channel %q; must be R, G, B or A", parts[0])
+		}
+		if seen[strings.ToUpper(parts[0])] {
+			return nil, fmt.Errorf("channel %v is listed twice", parts[0])
+		}
+		seen[strings.ToUpper(parts[0])] = true
+		switch parts[1] {
+		case "stddev", "median", "none":
+			filters[ch] = parts[1]
+		default:
+			return nil, fmt.Errorf("unknown filter %q for channel %v; must be 'stddev', 'median' or 'none'", parts[1], parts[0])
+		}
+	}
+	return filters, nil
+}
+
+// perChannelColor combines each channel of colors on its own, with the
+// strategy channelFilters gives it. 'stddev' averages the values of that
+// channel within N standard deviations of its mean, so a sample can be
+// rejected in one channel and still count in another. 'median' takes the
+// median and 'none' the mean of every value. weights weighs the averages as
+// for meanColor. The count returned is the fewest values any channel kept.
+//
+// Channels chosen independently from translucent samples can put a
+// premultiplied color channel above the alpha chosen, such as the mean red of
+// mostly opaque samples over the median alpha of mostly transparent ones.
+// toRGBA64 clamps such a channel to alpha, the most that color can hold at
+// that opacity, and counts it as clamped.
+func perChannelColor(t *tally, colors []color.Color, weights []float64, N float64) (color.Color, int, error) {
+	channels := make([][]float64, 4)
+	for _, c := range colors {
+		r, g, b, a := c.RGBA()
+		for ch, v := range [4]uint32{r, g, b, a} {
+			channels[ch] = append(channels[ch], float64(v))
+		}
+	}
+
+	var out [4]float64
+	kept := len(colors)
+	for ch, xs := range channels {
+		var err error
+		switch channelFilters[ch] {
+		case "stddev":
+			var n int
+			out[ch], n, err = channelMean(xs, weights, N)
+			kept = minInt(kept, n)
+		case "median":
+			out[ch], err = stats.Median(xs)
+		case "none":
+			out[ch], err = filteredMean(xs, weights)
+		}
+		if err == errAllRejected {
+			return nil, 0, err
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to reduce channel %v: %v", "RGBA"[ch:ch+1], err)
+		}
+	}
+	return toRGBA64(t, out[0], out[1], out[2], out[3]), kept, nil
+}
+
+// channelMean averages the values of xs within N standard deviations of their
+// mean, returning the average and how many values it kept.
+func channelMean(xs, weights []float64, N float64) (float64, int, error) {
+	m, err := sampleMean(xs)
+	if err != nil {
+		return 0, 0, err
+	}
+	s, err := sampleStddev(xs)
+	if err != nil {
+		return 0, 0, err
+	}
+	var kept, ws []float64
+	for i, v := range xs {
+		if outlier(v, m, s, N) {
+			continue
+		}
+		kept = append(kept, v)
+		if weights != nil {
+			ws = append(ws, weights[i])
+		}
+	}
+	if len(kept) == 0 {
+		return 0, 0, errAllRejected
+	}
+	if *rejectIsolatedFlag && len(kept) == 1 {
+		return 0, 0, errAllRejected
+	}
+	mean, err := filteredMean(kept, ws)
+	return mean, len(kept), err
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"image/color"
+	"testing"
+)
+
+// TestPerChannelTranslucent combines translucent samples with the mean of
+// every red and the median alpha, which picks a mostly transparent sample
+// while the red mean is pulled up by an opaque one. The result must still be
+// a valid premultiplied color, with red clamped to alpha and counted.
+func TestPerChannelTranslucent(t *testing.T) {
+	defer func(cf []string) { channelFilters = cf }(channelFilters)
+	var err error
+	channelFilters, err = parseChannelFilters("R:none,G:none,B:none,A:median")
+	if err != nil {
+		t.Fatal(err)
+	}
+	colors := []color.Color{
+		color.RGBA64{0xf000, 0, 0, 0xf000},
+		color.RGBA64{0x1000, 0, 0, 0x1000},
+		color.RGBA64{0x2000, 0, 0, 0x2000},
+	}
+	clippedPixels, clippedChannels = 0, [4]int64{}
+	c, _, err := perChannelColor(nil, colors, nil, 1.3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := color.RGBA64Model.Convert(c); got != (color.RGBA64{0x2000, 0, 0, 0x2000}) {
+		t.Errorf("perChannelColor = %v; want red clamped to the median alpha 0x2000", got)
+	}
+	if clippedChannels[0] != 1 {
+		t.Errorf("clamped red %v times; want 1", clippedChannels[0])
+	}
+}
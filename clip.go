@@ -0,0 +1,64 @@
+package main
+
+import (
+	"image/color"
+	"log"
+	"math"
+)
+
+// clippedPixels counts the output pixels of the current merge that toRGBA64
+// had to clamp, for --color-clip-warning. Each merge resets it.
+var clippedPixels int64
+
+// clippedChannels counts, like clippedPixels, the output pixels of the current
+// merge whose R, G, B or A channel toRGBA64 had to clamp.
+var clippedChannels [4]int64
+
+// toRGBA64 converts per-channel results back into a premultiplied color,
+// clamping alpha to [0, 0xffff] and each color channel to [0, alpha], since a
+// premultiplied channel above alpha is not a valid color. A pixel with any
+// clamped channel is counted in clippedPixels, and each clamped channel in
+// clippedChannels.
+func toRGBA64(t *tally, r, g, b, a float64) color.RGBA64 {
+	var out [4]uint16
+	clipped := false
+	alpha, ok := clampChannel(a)
+	out[3] = alpha
+	if !ok {
+		t.count(&clippedChannels[3])
+		clipped = true
+	}
+	for i, v := range [3]float64{r, g, b} {
+		c, ok := clampChannel(v)
+		if c > alpha {
+			c, ok = alpha, false
+		}
+		out[i] = c
+		if !ok {
+			t.count(&clippedChannels[i])
+			clipped = true
+		}
+	}
+	if clipped {
+		t.count(&clippedPixels)
+	}
+	return color.RGBA64{out[0], out[1], out[2], out[3]}
+}
+
+// logClipping logs the clamping counts for --color-clip-warning, out of
+// pixels output pixels, under label.
+func logClipping(label string, pixels int) {
+	log.Printf("%v: %v of %v output pixels had at least one channel clamped to the displayable range (R %v, G %v, B %v, A %v)", label, clippedPixels, pixels, clippedChannels[0], clippedChannels[1], clippedChannels[2], clippedChannels[3])
+}
+
+// clampChannel converts v to a 16-bit channel value, reporting false if v lay
+// outside [0, 0xffff] and had to be clamped.
+func clampChannel(v float64) (uint16, bool) {
+	switch {
+	case v < 0:
+		return 0, false
+	case v > math.MaxUint16:
+		return math.MaxUint16, false
+	}
+	return uint16(v), true
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"sort"
+)
+
+// clusterColor implements --filter=largest-cluster. For each channel on its
+// own, it sorts the sample values and splits them into clusters wherever two
+// neighboring values are more than --cluster-gap of the full range apart. The
+// channel's output is the mean of the cluster with the most samples, weighted
+// by weights unless it is nil. Ties go to the cluster with the smaller range,
+// then to the darker one. The count returned is the fewest samples any
+// channel's cluster held. Channels can pick clusters of different samples,
+// so a color channel can come out above alpha; toRGBA64 clamps it to alpha so
+// the result is still a valid premultiplied color.
+func clusterColor(t *tally, colors []color.Color, weights []float64) (color.Color, int, error) {
+	if *identicalFastPathFlag && len(colors) > 1 {
+		if c, ok := identicalColor(colors); ok {
+			t.count(&identicalPixels)
+			return c, len(colors), nil
+		}
+	}
+
+	channels := make([][]float64, 4)
+	for _, c := range colors {
+		r, g, b, a := c.RGBA()
+		for ch, v := range [4]uint32{r, g, b, a} {
+			channels[ch] = append(channels[ch], float64(v))
+		}
+	}
+
+	var out [4]float64
+	kept := len(colors)
+	for ch, xs := range channels {
+		members := largestCluster(xs, *clusterGapFlag*0xffff)
+		vs := make([]float64, len(members))
+		var ws []float64
+		for k, i := range members {
+			vs[k] = xs[i]
+			if weights != nil {
+				ws = append(ws, weights[i])
+			}
+		}
+		m, err := filteredMean(vs, ws)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to reduce channel %v: %v", "RGBA"[ch:ch+1], err)
+		}
+		out[ch] = m
+		kept = minInt(kept, len(members))
+	}
+	if *rejectIsolatedFlag && kept == 1 {
+		return nil, 0, errAllRejected
+	}
+	return toRGBA64(t, out[0], out[1], out[2], out[3]), kept, nil
+}
+
+// largestCluster returns the indices into xs of the values in its largest
+// cluster, as described for clusterColor.
+func largestCluster(xs []float64, gap float64) []int {
+	order := make([]int, len(xs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return xs[order[i]] < xs[order[j]] })
+
+	bestStart, bestEnd := 0, 0
+	start := 0
+	for k := 1; k <= len(order); k++ {
+		if k < len(order) && xs[order[k]]-xs[order[k-1]] <= gap {
+			continue
+		}
+		// order[start:k] is one cluster.
+		if bestEnd == 0 || better(xs, order[start:k], order[bestStart:bestEnd]) {
+			bestStart, bestEnd = start, k
+		}
+		start = k
+	}
+	return order[bestStart:bestEnd]
+}
+
+// better reports whether cluster a, as sorted indices into xs, beats b: by
+// holding more values, or as many within a smaller range.
+func better(xs []float64, a, b []int) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return xs[a[len(a)-1]]-xs[a[0]] < xs[b[len(b)-1]]-xs[b[0]]
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"image/color"
+	"testing"
+)
+
+// TestClusterTranslucent checks that --filter=largest-cluster picks the
+// larger group of translucent samples, and that a result whose channels come
+// from different groups still has no color channel above its alpha.
+func TestClusterTranslucent(t *testing.T) {
+	defer func(fast bool) { *identicalFastPathFlag = fast }(*identicalFastPathFlag)
+	*identicalFastPathFlag = false
+
+	colors := []color.Color{
+		color.NRGBA{200, 100, 50, 128},
+		color.NRGBA{200, 100, 50, 128},
+		color.NRGBA{200, 100, 50, 128},
+		color.NRGBA{10, 250, 10, 255},
+		color.NRGBA{10, 250, 10, 255},
+	}
+	c, kept, err := clusterColor(nil, colors, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := color.NRGBAModel.Convert(c).(color.NRGBA), (color.NRGBA{200, 100, 50, 128}); kept != 3 || got != want {
+		t.Errorf("largest cluster is %v from %v samples; want %v from 3", got, kept, want)
+	}
+
+	// Red clusters with the four bright samples, but their alpha splits in
+	// two, so alpha clusters with the three faint ones. Only the clamp then
+	// keeps red within alpha.
+	colors = []color.Color{
+		color.RGBA64{0xf000, 0, 0, 0xf000},
+		color.RGBA64{0xf000, 0, 0, 0xf000},
+		color.RGBA64{0xf000, 0, 0, 0xffff},
+		color.RGBA64{0xf000, 0, 0, 0xffff},
+		color.RGBA64{0, 0, 0, 0x1000},
+		color.RGBA64{0, 0, 0, 0x1000},
+		color.RGBA64{0, 0, 0, 0x1000},
+	}
+	c, _, err = clusterColor(nil, colors, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, b, a := c.RGBA(); r > a || g > a || b > a {
+		t.Errorf("largest cluster is %v, with a color channel above alpha", c)
+	}
+	if _, _, _, a := c.RGBA(); a != 0x1000 {
+		t.Errorf("largest cluster has alpha %#x; want the faint samples' 0x1000", a)
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// decodeImages decodes every file in paths and returns the images in the same
+// order as paths.
+//
+// A budget of zero decodes the files one at a time. A positive budget, in
+// bytes, decodes files concurrently while keeping the estimated size of the
+// images currently being decoded at or below the budget; see decodedSize for
+// how that size is estimated.
+func decodeImages(paths []string, budget int64) ([]image.Image, error) {
+	if budget <= 0 {
+		images := make([]image.Image, len(paths))
+		for idx, p := range paths {
+			i, err := decodeFile(p)
+			if err != nil {
+				return nil, err
+			}
+			images[idx] = i
+		}
+		return images, nil
+	}
+	return decodeScheduled(paths, newDecodeScheduler(budget), runtime.GOMAXPROCS(0))
+}
+
+// decodeScheduled decodes paths on a pool of workers, admitting each decode
+// through s. Headers are read one at a time and decodes handed out in path
+// order, so at most workers+1 files are open at once. --tar members are read
+// out of the archive before they are handed out, so the archive is read in
+// path order rather than in whatever order the workers get to them.
+// Dispatch stops at the first failure.
+func decodeScheduled(paths []string, s *decodeScheduler, workers int) ([]image.Image, error) {
+	type job struct {
+		idx  int
+		size int64
+		r    io.ReadCloser // the --tar member's contents, or nil for a file
+	}
+	images := make([]image.Image, len(paths))
+	errs := make([]error, len(paths))
+	jobs := make(chan job)
+	var failed int32
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if j.r != nil {
+					images[j.idx], errs[j.idx] = decodeOpened(paths[j.idx], j.r)
+				} else {
+					images[j.idx], errs[j.idx] = decodeFile(paths[j.idx])
+				}
+				if errs[j.idx] != nil {
+					atomic.StoreInt32(&failed, 1)
+				}
+				s.release(j.size)
+			}
+		}()
+	}
+	for idx, p := range paths {
+		if atomic.LoadInt32(&failed) != 0 {
+			break
+		}
+		size, err := decodedSize(p)
+		if err != nil {
+			errs[idx] = err
+			break
+		}
+		s.acquire(size)
+		var r io.ReadCloser
+		if tarInput != nil {
+			if r, err = openInput(p); err != nil {
+				s.release(size)
+				errs[idx] = err
+				break
+			}
+		}
+		jobs <- job{idx, size, r}
+	}
+	close(jobs)
+	wg.Wait()
+
+	// Report the first failure in path order so the error is deterministic.
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return images, nil
+}
+
+// decodeFile decodes the image at path, reusing it from inputCache when the
+// same file was decoded before and is still cached. Tiled TIFFs are opened
+// with openTiledTIFF instead and never cached.
+func decodeFile(path string) (image.Image, error) {
+	if isTIFF(path) {
+		t, err := openTiledTIFF(path)
+		if err != nil {
+			return nil, err
+		}
+		if size := t.cacheBytes(); size > maxDecodeBytes && !*noDecodeLimitFlag {
+			t.close()
+			return nil, fmt.Errorf("failed decoding image %v: its tiles are %vx%v, so the tile cache would take about %v MiB, over the limit of %v MiB; pass --no-decode-limit if the size is genuine", path, t.tileW, t.tileH, size>>20, maxDecodeBytes>>20)
+		}
+		return t, nil
+	}
+	if inputCache != nil {
+		if i, ok := inputCache.get(path); ok {
+			return i, nil
+		}
+	}
+	f, err := openInput(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeOpened(path, f)
+}
+
+// decodeOpened decodes the input at path from f, which it closes, and adds
+// the image to inputCache.
+func decodeOpened(path string, f io.ReadCloser) (image.Image, error) {
+	defer f.Close()
+	i, _, err := decodeLimited(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed decoding image %v: %v", path, err)
+	}
+	if inputCache != nil {
+		inputCache.put(path, i)
+	}
+	return i, nil
+}
+
+// maxDecodeBytes is the largest estimated decoded size of a single image
+// that is decoded without --no-decode-limit. A few bytes of a corrupt or
+// malicious file can claim dimensions that would exhaust memory, so such
+// headers are refused before any pixels are allocated.
+const maxDecodeBytes = 2 << 30
+
+// checkDecodeLimit fails if an image with header cfg would take more than
+// maxDecodeBytes decoded, unless --no-decode-limit is set.
+func checkDecodeLimit(cfg image.Config) error {
+	if *noDecodeLimitFlag {
+		return nil
+	}
+	size := int64(cfg.Width) * int64(cfg.Height) * bytesPerPixel(cfg.ColorModel)
+	if size > maxDecodeBytes {
+		return fmt.Errorf("it is %vx%v, which would take about %v MiB decoded, over the limit of %v MiB; pass --no-decode-limit if the size is genuine", cfg.Width, cfg.Height, size>>20, maxDecodeBytes>>20)
+	}
+	return nil
+}
+
+// decodeLimited decodes an image from r like decodeInput, after checking its
+// header with checkDecodeLimit. The header is kept as it is read, so r is
+// decoded from its start again without being reopened.
+func decodeLimited(r io.Reader) (image.Image, string, error) {
+	var header bytes.Buffer
+	cfg, _, err := decodeInputConfig(io.TeeReader(r, &header))
+	if err != nil {
+		return nil, "", err
+	}
+	if err := checkDecodeLimit(cfg); err != nil {
+		return nil, "", err
+	}
+	return decodeInput(io.MultiReader(&header, r))
+}
+
+// isTIFF reports whether the file at path starts with a TIFF header. It is
+// false for --tar members, which can't be mapped and so are decoded whole,
+// and under --decode-format-override, which names the only decoder to use.
+func isTIFF(path string) bool {
+	if *decodeFormatFlag != "" {
+		return false
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false
+	}
+	return string(magic) == "II*\x00" || string(magic) == "MM\x00*"
+}
+
+// failingImage is an image that reads its pixels lazily and so can fail after
+// it was opened. At returns a placeholder color once reading has failed, and
+// Err reports why.
+type failingImage interface {
+	image.Image
+	Err() error
+}
+
+// imagesErr returns the first read error among images, if any.
+func imagesErr(images ...image.Image) error {
+	for _, i := range images {
+		if f, ok := i.(failingImage); ok {
+			if err := f.Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// decodeInput decodes an image from r, with the decoder named by
+// --decode-format-override if set and otherwise with whichever registered
+// decoder recognizes the data. It also returns the format name.
+func decodeInput(r io.Reader) (image.Image, string, error) {
+	switch *decodeFormatFlag {
+	case "png":
+		i, err := png.Decode(r)
+		return i, "png", err
+	case "jpeg":
+		i, err := jpeg.Decode(r)
+		return i, "jpeg", err
+	case "gif":
+		i, err := gif.Decode(r)
+		return i, "gif", err
+	}
+	return image.Decode(r)
+}
+
+// decodeInputConfig is decodeInput for the image header alone.
+func decodeInputConfig(r io.Reader) (image.Config, string, error) {
+	switch *decodeFormatFlag {
+	case "png":
+		cfg, err := png.DecodeConfig(r)
+		return cfg, "png", err
+	case "jpeg":
+		cfg, err := jpeg.DecodeConfig(r)
+		return cfg, "jpeg", err
+	case "gif":
+		cfg, err := gif.DecodeConfig(r)
+		return cfg, "gif", err
+	}
+	return image.DecodeConfig(r)
+}
+
+// decodedSize estimates how many bytes the decoded form of the image at path
+// will occupy. Only the image header is read: the estimate is the pixel count
+// multiplied by the bytes per pixel of the image's color model. The headers
+// of --tar members were read when the archive was listed. A tiled TIFF
+// is counted as the size of its tile cache, since that is all it decodes.
+func decodedSize(path string) (int64, error) {
+	if tarInput != nil {
+		if name, ok := tarInput.member(path); ok {
+			return tarInput.sizes[name], nil
+		}
+	}
+	if isTIFF(path) {
+		t, err := openTiledTIFF(path)
+		if err != nil {
+			return 0, err
+		}
+		defer t.close()
+		return t.cacheBytes(), nil
+	}
+	f, err := openInput(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	cfg, _, err := decodeInputConfig(f)
+	if err != nil {
+		return 0, fmt.Errorf("failed reading image header %v: %v", path, err)
+	}
+	return int64(cfg.Width) * int64(cfg.Height) * bytesPerPixel(cfg.ColorModel), nil
+}
+
+func bytesPerPixel(m color.Model) int64 {
+	switch m {
+	case color.GrayModel, color.AlphaModel:
+		return 1
+	case color.Gray16Model, color.Alpha16Model:
+		return 2
+	case color.YCbCrModel:
+		// JPEG chroma is usually subsampled, so this overestimates; being
+		// conservative keeps the budget honest for 4:4:4 images.
+		return 3
+	case color.RGBAModel, color.NRGBAModel, color.CMYKModel:
+		return 4
+	}
+	if _, ok := m.(color.Palette); ok {
+		return 1
+	}
+	return 8
+}
+
+// decodeScheduler admits decodes while the sum of their estimated sizes stays
+// within a budget, blocking new decodes until earlier ones release memory.
+type decodeScheduler struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	budget int64
+	inUse  int64
+	peak   int64 // largest inUse reached, for tests
+}
+
+func newDecodeScheduler(budget int64) *decodeScheduler {
+	s := &decodeScheduler{budget: budget}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *decodeScheduler) acquire(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// An image larger than the whole budget is admitted once nothing else is
+	// in flight, otherwise it could never be decoded.
+	for s.inUse > 0 && s.inUse+size > s.budget {
+		s.cond.Wait()
+	}
+	s.inUse += size
+	if s.inUse > s.peak {
+		s.peak = s.inUse
+	}
+}
+
+func (s *decodeScheduler) release(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inUse -= size
+	s.cond.Broadcast()
+}
+
+// imageHeader describes an image as read from its header, without decoding
+// its pixels.
+type imageHeader struct {
+	format        string
+	width, height int
+	model         string
+}
+
+// readHeader reads the header of the image at path. A tiled TIFF on disk is
+// opened with openTiledTIFF, which maps the file and reads only its image
+// file directory.
+func readHeader(path string) (imageHeader, error) {
+	if isTIFF(path) {
+		t, err := openTiledTIFF(path)
+		if err != nil {
+			return imageHeader{}, err
+		}
+		defer t.close()
+		return imageHeader{"tiff", t.width, t.height, modelName(t.ColorModel())}, nil
+	}
+	f, err := openInput(path)
+	if err != nil {
+		return imageHeader{}, err
+	}
+	defer f.Close()
+
+	cfg, format, err := decodeInputConfig(f)
+	if err != nil {
+		return imageHeader{}, fmt.Errorf("failed reading image header %v: %v", path, err)
+	}
+	return imageHeader{format, cfg.Width, cfg.Height, modelName(cfg.ColorModel)}, nil
+}
+
+// modelName names the standard color models. Models can't be compared
+// directly since a color.Palette is a slice.
+func modelName(m color.Model) string {
+	switch m {
+	case color.RGBAModel:
+		return "RGBA"
+	case color.RGBA64Model:
+		return "RGBA64"
+	case color.NRGBAModel:
+		return "NRGBA"
+	case color.NRGBA64Model:
+		return "NRGBA64"
+	case color.AlphaModel:
+		return "Alpha"
+	case color.Alpha16Model:
+		return "Alpha16"
+	case color.GrayModel:
+		return "Gray"
+	case color.Gray16Model:
+		return "Gray16"
+	case color.YCbCrModel:
+		return "YCbCr"
+	case color.NYCbCrAModel:
+		return "NYCbCrA"
+	case color.CMYKModel:
+		return "CMYK"
+	}
+	if _, ok := m.(color.Palette); ok {
+		return "Paletted"
+	}
+	return fmt.Sprintf("%T", m)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestDecodeLimit writes a PNG whose header claims 100000×100000 pixels and
+// checks decodeFile and probe refuse it before decoding, unless
+// --no-decode-limit.
+func TestDecodeLimit(t *testing.T) {
+	defer func(n bool) { *noDecodeLimitFlag = n }(*noDecodeLimitFlag)
+
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr, 100000)
+	binary.BigEndian.PutUint32(ihdr[4:], 100000)
+	ihdr[8], ihdr[9] = 8, pngRGBA
+	chunk := append([]byte{0, 0, 0, 13}, "IHDR"...)
+	chunk = append(chunk, ihdr...)
+	chunk = appendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	path := filepath.Join(t.TempDir(), "bomb.png")
+	if err := os.WriteFile(path, append([]byte(pngSignature), chunk...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	*noDecodeLimitFlag = false
+	if _, err := decodeFile(path); err == nil || !strings.Contains(err.Error(), "--no-decode-limit") {
+		t.Errorf("decodeFile returned %v; want the decode limit error", err)
+	}
+	if err := probe(io.Discard, []string{path}); err == nil || !strings.Contains(err.Error(), "--no-decode-limit") {
+		t.Errorf("probe returned %v; want the decode limit error", err)
+	}
+	// Without the limit the decoder runs, and fails on the missing pixels.
+	*noDecodeLimitFlag = true
+	if _, err := decodeFile(path); err == nil || strings.Contains(err.Error(), "--no-decode-limit") {
+		t.Errorf("with --no-decode-limit decodeFile returned %v; want a decoding error", err)
+	}
+}
+
+// TestDecodeBudget decodes frames through a scheduler with room for two of
+// them at a time and checks that the budget was never exceeded and that the
+// images come back in path order.
+func TestDecodeBudget(t *testing.T) {
+	paths := writeFrames(t, t.TempDir(), 12, 16, 16)
+	size, err := decodedSize(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newDecodeScheduler(2 * size)
+	images, err := decodeScheduled(paths, s, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.peak > s.budget {
+		t.Errorf("%v bytes were decoding at once; the budget is %v", s.peak, s.budget)
+	}
+	if s.inUse != 0 {
+		t.Errorf("%v bytes still held after decoding", s.inUse)
+	}
+	for i, img := range images {
+		want, err := decodeFile(paths[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(img, want) {
+			t.Errorf("image %v does not match %v", i, paths[i])
+		}
+	}
+}
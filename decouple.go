@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+)
+
+// decoupledMeanColor is meanColor for --decouple-alpha. Color and alpha have
+// separate survivor sets instead of one set that every channel must agree on:
+//
+//   - A sample keeps its color unless its straight, unpremultiplied R, G or B
+//     is an outlier among the straight colors of the samples that are not
+//     fully transparent. Fully transparent samples have no color to give.
+//   - A sample keeps its alpha unless its alpha is an outlier among all alphas.
+//
+// The output's straight color is the mean of the surviving colors, weighted by
+// each sample's alpha as premultiplied averaging would, and its alpha is the
+// mean of the surviving alphas. The returned count is the size of the color
+// set, or of the alpha set when every sample is fully transparent.
+func decoupledMeanColor(t *tally, colors []color.Color, weights []float64, N float64) (color.Color, int, error) {
+	var straight [3][]float64
+	var alphas, opaque []float64
+	var visible []int
+	for idx, c := range colors {
+		r, g, b, a := c.RGBA()
+		alphas = append(alphas, float64(a))
+		if a == 0 {
+			continue
+		}
+		// Scale the premultiplied channels back up to what they would be at
+		// full opacity. A straight channel is at most 0xffff, so the mean of
+		// the surviving colors premultiplied by any output alpha never
+		// exceeds that alpha, even though the color and alpha survivors
+		// differ.
+		k := 0xffff / float64(a)
+		straight[0] = append(straight[0], math.Min(float64(r)*k, 0xffff))
+		straight[1] = append(straight[1], math.Min(float64(g)*k, 0xffff))
+		straight[2] = append(straight[2], math.Min(float64(b)*k, 0xffff))
+		opaque = append(opaque, float64(a))
+		visible = append(visible, idx)
+	}
+
+	aMean, aKept, err := survivingMean(alphas, weights, N)
+	if err == errAllRejected {
+		return nil, 0, err
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to compute alpha output: %v", err)
+	}
+	if len(visible) == 0 {
+		return color.RGBA64{}, aKept, nil
+	}
+
+	// A color survives only if all of its channels do.
+	var stats [3][2]float64
+	for ch, xs := range straight {
+		m, err := sampleMean(xs)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to compute mean for %v: %v", xs, err)
+		}
+		s, err := sampleStddev(xs)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to compute sample standard deviation %v: %v", xs, err)
+		}
+		stats[ch] = [2]float64{m, s}
+	}
+	var sums [3]float64
+	total, kept := 0.0, 0
+	for k, idx := range visible {
+		if outlier(straight[0][k], stats[0][0], stats[0][1], N) || outlier(straight[1][k], stats[1][0], stats[1][1], N) || outlier(straight[2][k], stats[2][0], stats[2][1], N) {
+			continue
+		}
+		w := opaque[k]
+		if weights != nil {
+			w *= weights[idx]
+		}
+		for ch := range sums {
+			sums[ch] += w * straight[ch][k]
+		}
+		total += w
+		kept++
+	}
+	if kept == 0 {
+		return nil, 0, errAllRejected
+	}
+	if *rejectIsolatedFlag && (kept == 1 || aKept == 1) {
+		return nil, 0, errAllRejected
+	}
+	if total == 0 {
+		// Every surviving color has zero weight, so fall back to an
+		// unweighted mean of them.
+		return decoupledMeanColor(t, colors, nil, N)
+	}
+
+	// Premultiply the straight mean by the output alpha.
+	p := aMean / 0xffff
+	return toRGBA64(t, p*sums[0]/total, p*sums[1]/total, p*sums[2]/total, aMean), kept, nil
+}
+
+// survivingMean averages the values of xs that are not outliers, weighted by
+// weights unless it is nil, and returns how many survived.
+func survivingMean(xs, weights []float64, N float64) (float64, int, error) {
+	m, err := sampleMean(xs)
+	if err != nil {
+		return math.NaN(), 0, err
+	}
+	s, err := sampleStddev(xs)
+	if err != nil {
+		return math.NaN(), 0, err
+	}
+	var kept, ws []float64
+	for idx, x := range xs {
+		if outlier(x, m, s, N) {
+			continue
+		}
+		kept = append(kept, x)
+		if weights != nil {
+			ws = append(ws, weights[idx])
+		}
+	}
+	if len(kept) == 0 {
+		return math.NaN(), 0, errAllRejected
+	}
+	v, err := filteredMean(kept, ws)
+	return v, len(kept), err
+}
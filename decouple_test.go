@@ -0,0 +1,48 @@
+package main
+
+import (
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+// TestDecoupledTranslucent checks --decouple-alpha on translucent samples.
+// Four samples of full straight red at quarter opacity and one opaque sample
+// of the same red must give the red at the surviving alpha, not above it,
+// and random translucent pixels must always give valid premultiplied colors.
+func TestDecoupledTranslucent(t *testing.T) {
+	colors := []color.Color{
+		color.RGBA64{0x4000, 0, 0, 0x4000},
+		color.RGBA64{0x4000, 0, 0, 0x4000},
+		color.RGBA64{0x4000, 0, 0, 0x4000},
+		color.RGBA64{0x4000, 0, 0, 0x4000},
+		color.RGBA64{0xffff, 0, 0, 0xffff},
+	}
+	c, _, err := decoupledMeanColor(nil, colors, nil, 1.3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := color.RGBA64Model.Convert(c); got != (color.RGBA64{0x4000, 0, 0, 0x4000}) {
+		t.Errorf("decoupledMeanColor = %v; want full red at the surviving alpha 0x4000", got)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		colors := make([]color.Color, 2+rng.Intn(10))
+		for k := range colors {
+			a := uint16(rng.Intn(0x10000))
+			ch := func() uint16 { return uint16(rng.Intn(int(a) + 1)) }
+			colors[k] = color.RGBA64{ch(), ch(), ch(), a}
+		}
+		c, _, err := decoupledMeanColor(nil, colors, nil, 1)
+		if err == errAllRejected {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := color.RGBA64Model.Convert(c).(color.RGBA64); got.R > got.A || got.G > got.A || got.B > got.A {
+			t.Fatalf("decoupledMeanColor(nil, %v) = %v, a color channel above alpha", colors, got)
+		}
+	}
+}
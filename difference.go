@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"path/filepath"
+	"strings"
+)
+
+// writeDifferences implements --mode=difference-amplify. It computes the sigma
+// average of images, then writes how --reference, or each input when no
+// reference is given, differs from it. With several inputs, each output is
+// named by inserting the input's base name before the output's extension.
+func writeDifferences(paths []string, images []image.Image) error {
+	reduce, err := newReducer("sigma", images)
+	if err != nil {
+		return err
+	}
+	avg, _, err := mergeImages(images, reduce)
+	if err != nil {
+		return err
+	}
+
+	path := outputPath(*modeFlag, len(paths))
+	if *referenceFlag != "" {
+		ref, err := decodeFile(*referenceFlag)
+		if err != nil {
+			return fmt.Errorf("failed to load --reference: %v", err)
+		}
+		if ref.Bounds() != avg.Bounds() {
+			return fmt.Errorf("unsupported operation; cannot compare images of different sizes: %v, %v", ref.Bounds(), avg.Bounds())
+		}
+		return writeDifference(path, ref, avg)
+	}
+	for idx, p := range differencePaths(path, paths) {
+		if err := writeDifference(p, images[idx], avg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// differencePaths returns the files writeDifferences writes given the output
+// path and the inputs at paths: path itself with --reference, and otherwise
+// one file per input, named by inserting the input's base name before the
+// output's extension.
+func differencePaths(path string, paths []string) []string {
+	if *referenceFlag != "" {
+		return []string{path}
+	}
+	out := make([]string, len(paths))
+	for idx, p := range paths {
+		out[idx] = suffixPath(path, strings.TrimSuffix(filepath.Base(p), filepath.Ext(p)))
+	}
+	return out
+}
+
+// checkDifferencePaths fails if two of the inputs at paths would write their
+// differences to the same file, which happens when they share a base name,
+// like a/frame.png and b/frame.jpg. Without --resume-safe the second would
+// overwrite the first.
+func checkDifferencePaths(path string, paths []string) error {
+	seen := map[string]int{}
+	for idx, p := range differencePaths(path, paths) {
+		if first, ok := seen[p]; ok {
+			return fmt.Errorf("%v and %v would both write their difference to %v; give the inputs distinct names or use --resume-safe", paths[first], paths[idx], p)
+		}
+		seen[p] = idx
+	}
+	return nil
+}
+
+// writeDifference writes the amplified difference of i from avg to path and,
+// with --color-clip-warning, logs how much of it was clamped.
+func writeDifference(path string, i image.Image, avg *image.RGBA) error {
+	clippedPixels, clippedChannels = 0, [4]int64{}
+	diff := amplifyDifference(i, avg)
+	path, err := writeImage(path, diff)
+	if err != nil {
+		return err
+	}
+	if *colorClipWarningFlag {
+		b := diff.Bounds()
+		logClipping(path, b.Dx()*b.Dy())
+	}
+	return nil
+}
+
+// amplifyDifference returns an opaque image where mid-gray means i matches avg,
+// and each channel moves away from mid-gray by --amplify times how far i is
+// from avg in that channel. Channels pushed past the displayable range are
+// clamped and counted as toRGBA64 counts them.
+func amplifyDifference(i image.Image, avg *image.RGBA) *image.RGBA64 {
+	b := avg.Bounds()
+	out := image.NewRGBA64(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := i.At(x, y).RGBA()
+			ar, ag, ab, _ := avg.At(x, y).RGBA()
+			var c [3]float64
+			for ch, d := range [3]float64{
+				float64(r) - float64(ar),
+				float64(g) - float64(ag),
+				float64(bl) - float64(ab),
+			} {
+				c[ch] = 0x8000 + *amplifyFlag*d
+			}
+			out.SetRGBA64(x, y, toRGBA64(nil, c[0], c[1], c[2], 0xffff))
+		}
+	}
+	return out
+}
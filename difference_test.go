@@ -0,0 +1,67 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// TestAmplifyDifferenceClipping checks that an amplified difference pushed
+// past the 16-bit range is clamped and counted for --color-clip-warning,
+// while a difference that stays in range is neither.
+func TestAmplifyDifferenceClipping(t *testing.T) {
+	defer func(a float64) { *amplifyFlag = a }(*amplifyFlag)
+	*amplifyFlag = 4
+
+	avg := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	avg.SetRGBA(0, 0, color.RGBA{100, 100, 100, 255})
+	avg.SetRGBA(1, 0, color.RGBA{100, 100, 100, 255})
+	i := image.NewRGBA(avg.Bounds())
+	i.SetRGBA(0, 0, color.RGBA{250, 100, 101, 255})
+	i.SetRGBA(1, 0, color.RGBA{100, 100, 100, 255})
+
+	clippedPixels, clippedChannels = 0, [4]int64{}
+	diff := amplifyDifference(i, avg)
+	if clippedPixels != 1 || clippedChannels != [4]int64{1, 0, 0, 0} {
+		t.Errorf("clipped %v pixels, by channel %v; want 1 pixel, red only", clippedPixels, clippedChannels)
+	}
+	if got := diff.RGBA64At(0, 0); got.R != 0xffff || got.G != 0x8000 || got.B != 0x8000+4*0x101 {
+		t.Errorf("clamped difference is %v; want red at full, green at mid-gray and blue just above", got)
+	}
+	if got := diff.RGBA64At(1, 0); got != (color.RGBA64{0x8000, 0x8000, 0x8000, 0xffff}) {
+		t.Errorf("matching pixel is %v; want mid-gray", got)
+	}
+}
+
+// TestToRGBA64PremultipliedClamp checks that color channels are clamped to
+// alpha, since a premultiplied color channel above alpha is invalid, and that
+// each such channel is counted.
+func TestToRGBA64PremultipliedClamp(t *testing.T) {
+	clippedPixels, clippedChannels = 0, [4]int64{}
+	got := toRGBA64(nil, 0x9000, 0x7000, -5, 0x8000)
+	if want := (color.RGBA64{0x8000, 0x7000, 0, 0x8000}); got != want {
+		t.Errorf("toRGBA64 = %v; want %v", got, want)
+	}
+	if clippedPixels != 1 || clippedChannels != [4]int64{1, 0, 1, 0} {
+		t.Errorf("clipped %v pixels, by channel %v; want 1 pixel, red and blue", clippedPixels, clippedChannels)
+	}
+}
+
+// TestCheckDifferencePaths checks that inputs sharing a base name, which
+// would overwrite each other's differences, are caught before any merging,
+// and that a --reference run, which writes one file, is not.
+func TestCheckDifferencePaths(t *testing.T) {
+	defer func(r string) { *referenceFlag = r }(*referenceFlag)
+	*referenceFlag = ""
+
+	if err := checkDifferencePaths("out.png", []string{"a/frame1.png", "b/frame2.png"}); err != nil {
+		t.Errorf("distinct names: %v; want no error", err)
+	}
+	if err := checkDifferencePaths("out.png", []string{"a/frame.png", "b/frame.jpg"}); err == nil {
+		t.Errorf("a/frame.png and b/frame.jpg: no error; want a collision on out_frame.png")
+	}
+	*referenceFlag = "ref.png"
+	if err := checkDifferencePaths("out.png", []string{"a/frame.png", "b/frame.jpg"}); err != nil {
+		t.Errorf("with --reference: %v; want no error", err)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"io"
+	"math"
+)
+
+// resolution is a physical pixel density in dots per inch, horizontally and
+// vertically.
+type resolution struct {
+	x, y float64
+}
+
+// inputResolution is the --preserve-dpi resolution read from the first input,
+// or nil when it isn't being preserved.
+var inputResolution *resolution
+
+// inchesPerMeter converts between dots per inch and the pixels per meter of
+// PNG's pHYs chunk.
+const inchesPerMeter = 1 / 0.0254
+
+// errNoResolution is returned by readResolution for images that don't record
+// a physical resolution.
+var errNoResolution = errors.New("no resolution metadata")
+
+// readResolution returns the resolution recorded in the image at path: the
+// pHYs chunk of a PNG or the JFIF density of a JPEG. A density that only gives
+// the pixel aspect ratio, without a unit, counts as no resolution.
+func readResolution(path string) (resolution, error) {
+	f, err := openInput(path)
+	if err != nil {
+		return resolution{}, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic, err := r.Peek(8)
+	if err != nil {
+		return resolution{}, fmt.Errorf("failed reading %v: %v", path, err)
+	}
+	switch {
+	case bytes.Equal(magic, []byte("\x89PNG\r\n\x1a\n")):
+		return pngResolution(r)
+	case magic[0] == 0xff && magic[1] == 0xd8:
+		return jpegResolution(r)
+	}
+	return resolution{}, errNoResolution
+}
+
+// pngResolution reads the pHYs chunk, which comes before the image data.
+func pngResolution(r io.Reader) (resolution, error) {
+	if _, err := io.CopyN(io.Discard, r, 8); err != nil {
+		return resolution{}, err
+	}
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return resolution{}, errNoResolution
+		}
+		length, kind := binary.BigEndian.Uint32(hdr[:4]), string(hdr[4:])
+		if kind == "IDAT" || kind == "IEND" {
+			return resolution{}, errNoResolution
+		}
+		if kind != "pHYs" || length != 9 {
+			if _, err := io.CopyN(io.Discard, r, int64(length)+4); err != nil {
+				return resolution{}, errNoResolution
+			}
+			continue
+		}
+		var data [9]byte
+		if _, err := io.ReadFull(r, data[:]); err != nil {
+			return resolution{}, errNoResolution
+		}
+		// Unit 1 is pixels per meter; 0 only gives the aspect ratio.
+		if data[8] != 1 {
+			return resolution{}, errNoResolution
+		}
+		x, y := binary.BigEndian.Uint32(data[:4]), binary.BigEndian.Uint32(data[4:8])
+		return resolution{float64(x) / inchesPerMeter, float64(y) / inchesPerMeter}, nil
+	}
+}
+
+// jpegResolution reads the density of the JFIF APP0 segment, which comes
+// before the scan.
+func jpegResolution(r io.Reader) (resolution, error) {
+	if _, err := io.CopyN(io.Discard, r, 2); err != nil {
+		return resolution{}, err
+	}
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil || hdr[0] != 0xff {
+			return resolution{}, errNoResolution
+		}
+		marker, length := hdr[1], int(binary.BigEndian.Uint16(hdr[2:]))-2
+		// Start of scan: the headers are over.
+		if marker == 0xda || length < 0 {
+			return resolution{}, errNoResolution
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return resolution{}, errNoResolution
+		}
+		if marker != 0xe0 || len(data) < 12 || string(data[:5]) != "JFIF\x00" {
+			continue
+		}
+		x, y := float64(binary.BigEndian.Uint16(data[8:10])), float64(binary.BigEndian.Uint16(data[10:12]))
+		switch data[7] {
+		case 1: // dots per inch
+			return resolution{x, y}, nil
+		case 2: // dots per centimeter
+			return resolution{x * 2.54, y * 2.54}, nil
+		}
+		return resolution{}, errNoResolution
+	}
+}
+
+// resolutionImage is an image to be encoded with a resolution.
+type resolutionImage struct {
+	image.Image
+	res resolution
+}
+
+// withResolution attaches inputResolution to img for encodeImage, scaled so
+// that img prints at the size an image of the merged bounds would. It returns
+// img unchanged without --preserve-dpi.
+func withResolution(img image.Image, merged image.Rectangle) image.Image {
+	if inputResolution == nil {
+		return img
+	}
+	b := img.Bounds()
+	return resolutionImage{img, resolution{
+		inputResolution.x * float64(b.Dx()) / float64(merged.Dx()),
+		inputResolution.y * float64(b.Dy()) / float64(merged.Dy()),
+	}}
+}
+
+// encodeWithResolution writes what encode produces to w, adding res as a PNG
+// pHYs chunk for format "png" or a JPEG JFIF segment for "jpeg". Other formats
+// are written unchanged.
+func encodeWithResolution(w io.Writer, format string, res resolution, encode func(io.Writer) error) error {
+	var buf bytes.Buffer
+	if err := encode(&buf); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	switch format {
+	case "png":
+		// The pHYs chunk goes right after IHDR, which follows the 8-byte
+		// signature and takes 25 bytes.
+		chunk := make([]byte, 21)
+		binary.BigEndian.PutUint32(chunk[0:4], 9)
+		copy(chunk[4:8], "pHYs")
+		binary.BigEndian.PutUint32(chunk[8:12], uint32(math.Round(res.x*inchesPerMeter)))
+		binary.BigEndian.PutUint32(chunk[12:16], uint32(math.Round(res.y*inchesPerMeter)))
+		chunk[16] = 1
+		binary.BigEndian.PutUint32(chunk[17:21], crc32.ChecksumIEEE(chunk[4:17]))
+		return writeAll(w, data[:33], chunk, data[33:])
+	case "jpeg":
+		// image/jpeg writes no APP0, so the JFIF segment goes right after
+		// the start of image marker.
+		segment := []byte{0xff, 0xe0, 0, 16, 'J', 'F', 'I', 'F', 0, 1, 1, 1, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint16(segment[12:14], uint16(math.Min(math.Round(res.x), 0xffff)))
+		binary.BigEndian.PutUint16(segment[14:16], uint16(math.Min(math.Round(res.y), 0xffff)))
+		return writeAll(w, data[:2], segment, data[2:])
+	}
+	_, err := w.Write(data)
+	return err
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestPreserveDPI writes a resolution into PNG and JPEG output, the JPEG
+// with EXIF metadata as well, and checks that readResolution reads back the
+// resolution scaled to a half-size output and that every file still decodes.
+// PNG stores pixels per meter, so its resolution comes back only to within
+// rounding.
+func TestPreserveDPI(t *testing.T) {
+	defer func(r *resolution) { inputResolution = r }(inputResolution)
+	inputResolution = &resolution{300, 200}
+	dir := t.TempDir()
+	e, err := parseEXIF(littleEndianTIFF("2024:05:01 10:00:00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := image.NewGray(image.Rect(0, 0, 4, 4))
+	merged := image.Rect(0, 0, 8, 8)
+	for _, tc := range []struct {
+		name string
+		img  image.Image
+	}{
+		{"out.png", withResolution(img, merged)},
+		{"out.jpeg", withResolution(img, merged)},
+		{"exif.jpeg", exifImage{withResolution(img, merged), e}},
+	} {
+		path := filepath.Join(dir, tc.name)
+		var buf bytes.Buffer
+		if err := encodeImage(&buf, path, tc.img); err != nil {
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+		var decodeErr error
+		if outputFormat(path) == "png" {
+			_, decodeErr = png.Decode(bytes.NewReader(buf.Bytes()))
+		} else {
+			_, decodeErr = jpeg.Decode(bytes.NewReader(buf.Bytes()))
+		}
+		if decodeErr != nil {
+			t.Errorf("%v: output does not decode: %v", tc.name, decodeErr)
+		}
+		if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := readResolution(path); err != nil || math.Abs(got.x-150) > 0.05 || math.Abs(got.y-100) > 0.05 {
+			t.Errorf("%v: readResolution returned %v, %v; want 150x100", tc.name, got, err)
+		}
+	}
+	if got, err := readEXIF(filepath.Join(dir, "exif.jpeg")); err != nil || !reflect.DeepEqual(got, e) {
+		t.Errorf("EXIF written after the JFIF segment reads back as %v, %v; want %v", got, err, e)
+	}
+}
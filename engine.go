@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"image/color"
+	"math"
+
+	"github.com/montanaflynn/stats"
+)
+
+// errEmptyInput matches the error github.com/montanaflynn/stats returns for an
+// empty slice.
+var errEmptyInput = errors.New("input must not be empty")
+
+// sampleMean returns the mean of xs using the --stats-engine implementation.
+//
+// The internal engine follows the same summation order as
+// github.com/montanaflynn/stats, so both engines return identical results, as
+// TestEngineMatchesMontanaflynn checks. BenchmarkMeanColor times the two.
+func sampleMean(xs []float64) (float64, error) {
+	if allEqual(xs) {
+		return xs[0], nil
+	}
+	if *statsEngineFlag == "montanaflynn" {
+		return stats.Mean(xs)
+	}
+	if len(xs) == 0 {
+		return math.NaN(), errEmptyInput
+	}
+	sum := 0.0
+	for _, x := range xs {
+		sum += x
+	}
+	return sum / float64(len(xs)), nil
+}
+
+// pixelStats returns the mean and sample standard deviation of each of the
+// R, G, B and A channels of colors, indexed R=0, G=1, B=2, A=3, as sampleMean
+// and sampleStddev would for each channel on its own with the internal
+// engine, and with the same results. It reads colors once into a buffer on
+// the stack, so a pixel of up to pixelStatsStack samples allocates nothing,
+// where building a slice per channel cost more than the statistics. colors
+// must not be empty.
+func pixelStats(colors []color.Color) (means, stddevs [4]float64) {
+	var stack [pixelStatsStack][4]float64
+	vs := stack[:]
+	if len(colors) > len(stack) {
+		vs = make([][4]float64, len(colors))
+	}
+	vs = vs[:len(colors)]
+	var sums [4]float64
+	equal := [4]bool{true, true, true, true}
+	for i, c := range colors {
+		r, g, b, a := c.RGBA()
+		vs[i] = [4]float64{float64(r), float64(g), float64(b), float64(a)}
+		for ch, v := range vs[i] {
+			sums[ch] += v
+			equal[ch] = equal[ch] && v == vs[0][ch]
+		}
+	}
+	n := float64(len(colors))
+	for ch := range means {
+		if equal[ch] && len(colors) > 1 {
+			means[ch], stddevs[ch] = vs[0][ch], 0
+			continue
+		}
+		means[ch] = sums[ch] / n
+		variance := 0.0
+		for _, v := range vs {
+			variance += (v[ch] - means[ch]) * (v[ch] - means[ch])
+		}
+		stddevs[ch] = math.Sqrt(variance / (n - 1))
+	}
+	return means, stddevs
+}
+
+// pixelStatsStack is the number of samples pixelStats buffers on the
+// stack.
+const pixelStatsStack = 64
+
+// allEqual reports whether xs holds more than one sample and all of them are
+// the same. sampleMean and sampleStddev answer such channels, which include
+// a region that is black in every input, with exactly that value and a zero
+// spread, so outlier keeps every sample without depending on how the sums
+// round.
+func allEqual(xs []float64) bool {
+	if len(xs) < 2 {
+		return false
+	}
+	for _, x := range xs[1:] {
+		if x != xs[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// sampleStddev returns the sample standard deviation of xs using the
+// --stats-engine implementation. Like github.com/montanaflynn/stats, it is NaN
+// for a single sample.
+func sampleStddev(xs []float64) (float64, error) {
+	if allEqual(xs) {
+		return 0, nil
+	}
+	if *statsEngineFlag == "montanaflynn" {
+		return stats.StandardDeviationSample(xs)
+	}
+	m, err := sampleMean(xs)
+	if err != nil {
+		return math.NaN(), err
+	}
+	variance := 0.0
+	for _, x := range xs {
+		variance += (x - m) * (x - m)
+	}
+	return math.Sqrt(variance / float64(len(xs)-1)), nil
+}
+
+// weightedMean returns the mean of xs with each value weighted by the matching
+// entry of ws. It falls back to the plain mean if the weights sum to zero.
+//
+// The mean is summed as offsets from the first value and clamped to the range
+// of xs, so that rounding in weights like 0.1 cannot move it past the largest
+// or smallest sample; identical samples give exactly their value.
+func weightedMean(xs, ws []float64) (float64, error) {
+	if len(xs) == 0 {
+		return math.NaN(), errEmptyInput
+	}
+	x0, lo, hi := xs[0], xs[0], xs[0]
+	sum, total := 0.0, 0.0
+	for i, x := range xs {
+		sum += ws[i] * (x - x0)
+		total += ws[i]
+		lo, hi = math.Min(lo, x), math.Max(hi, x)
+	}
+	if total == 0 {
+		return sampleMean(xs)
+	}
+	return math.Min(math.Max(x0+sum/total, lo), hi), nil
+}
+
+// weightedStddev returns the standard deviation of xs about mean with each
+// value weighted by the matching entry of ws. It treats the weights as
+// reliability weights, correcting the bias by V1²/(V1²-V2) where V1 and V2
+// are the sums of the weights and of their squares, so equal weights give
+// sampleStddev. Like weightedMean, it falls back to the unweighted form if the
+// weights sum to zero, and like sampleStddev it is NaN when only one sample
+// has weight.
+func weightedStddev(xs, ws []float64, mean float64) (float64, error) {
+	if len(xs) == 0 {
+		return math.NaN(), errEmptyInput
+	}
+	v1, v2, sum := 0.0, 0.0, 0.0
+	for i, x := range xs {
+		v1 += ws[i]
+		v2 += ws[i] * ws[i]
+		sum += ws[i] * (x - mean) * (x - mean)
+	}
+	if v1 == 0 {
+		return sampleStddev(xs)
+	}
+	if v1*v1 == v2 {
+		return math.NaN(), nil
+	}
+	return math.Sqrt(sum / (v1 - v2/v1)), nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/montanaflynn/stats"
+)
+
+// sameFloat reports whether a and b are equal, counting NaN as equal to NaN.
+func sameFloat(a, b float64) bool {
+	return a == b || math.IsNaN(a) && math.IsNaN(b)
+}
+
+func TestEngineMatchesMontanaflynn(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		xs := make([]float64, rng.Intn(30))
+		for j := range xs {
+			xs[j] = float64(rng.Intn(0x10000))
+		}
+
+		m, err := sampleMean(xs)
+		want, wantErr := stats.Mean(xs)
+		if !sameFloat(m, want) || (err == nil) != (wantErr == nil) {
+			t.Errorf("sampleMean(%v) = %v, %v; montanaflynn gives %v, %v", xs, m, err, want, wantErr)
+		}
+		s, err := sampleStddev(xs)
+		want, wantErr = stats.StandardDeviationSample(xs)
+		if !sameFloat(s, want) || (err == nil) != (wantErr == nil) {
+			t.Errorf("sampleStddev(%v) = %v, %v; montanaflynn gives %v, %v", xs, s, err, want, wantErr)
+		}
+	}
+}
+
+// TestPixelStats checks that pixelStats gives exactly the per-channel results
+// of sampleMean and sampleStddev, including for one sample, identical samples
+// and more samples than fit its stack buffer, and that it allocates nothing
+// for a pixel that fits.
+func TestPixelStats(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, n := range []int{1, 2, 5, 20, pixelStatsStack, pixelStatsStack + 1} {
+		for _, identical := range []bool{false, true} {
+			colors := make([]color.Color, n)
+			for i := range colors {
+				v := uint16(rng.Intn(0x10000))
+				if identical {
+					v = 1234
+				}
+				colors[i] = color.RGBA64{v, uint16(rng.Intn(0x10000)), v, 0xffff}
+			}
+			means, stddevs := pixelStats(colors)
+			for ch := 0; ch < 4; ch++ {
+				xs := make([]float64, n)
+				for i, c := range colors {
+					r, g, b, a := c.RGBA()
+					xs[i] = float64([4]uint32{r, g, b, a}[ch])
+				}
+				m, _ := sampleMean(xs)
+				s, _ := sampleStddev(xs)
+				if !sameFloat(means[ch], m) || !sameFloat(stddevs[ch], s) {
+					t.Errorf("%v samples, identical=%v, channel %v: pixelStats gives %v, %v; want %v, %v", n, identical, ch, means[ch], stddevs[ch], m, s)
+				}
+			}
+		}
+	}
+
+	colors := make([]color.Color, 20)
+	for i := range colors {
+		colors[i] = color.RGBA64{uint16(i), 2, 3, 0xffff}
+	}
+	if allocs := testing.AllocsPerRun(100, func() { pixelStats(colors) }); allocs != 0 {
+		t.Errorf("pixelStats of 20 samples made %v allocations; want 0", allocs)
+	}
+}
+
+func BenchmarkMeanColor(b *testing.B) {
+	defer func(engine string) { *statsEngineFlag = engine }(*statsEngineFlag)
+	rng := rand.New(rand.NewSource(1))
+	colors := make([]color.Color, 20)
+	for i := range colors {
+		colors[i] = color.RGBA64{uint16(rng.Intn(0x10000)), uint16(rng.Intn(0x10000)), uint16(rng.Intn(0x10000)), 0xffff}
+	}
+	for _, engine := range []string{"internal", "montanaflynn"} {
+		b.Run(engine, func(b *testing.B) {
+			*statsEngineFlag = engine
+			for i := 0; i < b.N; i++ {
+				if _, _, err := meanColor(nil, colors, nil, 1.5); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkTwoStage reduces a whole image with --mode=sigma, computing the
+// statistics at every pixel and with --two-stage.
+func BenchmarkTwoStage(b *testing.B) {
+	defer func(two bool) { *twoStageFlag = two }(*twoStageFlag)
+	images := noisyFrames(20, 64, 64)
+	bounds := images[0].Bounds()
+	for _, two := range []bool{false, true} {
+		b.Run(map[bool]string{false: "direct", true: "two-stage"}[two], func(b *testing.B) {
+			*twoStageFlag = two
+			for i := 0; i < b.N; i++ {
+				reduce, err := newReducer("sigma", images)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+					for x := bounds.Min.X; x < bounds.Max.X; x++ {
+						if _, _, err := reduce(x, y, colors(x, y, images), nil); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestTwoStageFallback checks that a pixel unlike the coarse grid around it,
+// whose samples the interpolated statistics all reject, is averaged with its
+// own statistics and counted in twoStageFallbacks.
+func TestTwoStageFallback(t *testing.T) {
+	defer func(two, fast bool, factor int) {
+		*twoStageFlag, *identicalFastPathFlag, *twoStageFactorFlag = two, fast, factor
+	}(*twoStageFlag, *identicalFastPathFlag, *twoStageFactorFlag)
+	*twoStageFlag, *identicalFastPathFlag, *twoStageFactorFlag = true, false, 4
+	defer func() { twoStageFallbacks = 0 }()
+	twoStageFallbacks = 0
+
+	// The coarse grid samples x=0, 4 and 8, which are black in every frame,
+	// so the statistics interpolated at x=2 reject anything else.
+	images := make([]image.Image, 3)
+	for i := range images {
+		img := image.NewRGBA(image.Rect(0, 0, 9, 1))
+		for x := 0; x < 9; x++ {
+			img.SetRGBA(x, 0, color.RGBA{0, 0, 0, 255})
+		}
+		img.SetRGBA(2, 0, color.RGBA{uint8(200 + i), 0, 0, 255})
+		images[i] = img
+	}
+	reduce, err := newReducer("sigma", images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, kept, err := reduce(2, 0, colors(2, 0, images), nil)
+	if err != nil {
+		t.Fatalf("reducing x=2 failed: %v", err)
+	}
+	if r, _, _, _ := c.RGBA(); kept != 3 || r>>8 != 201 {
+		t.Errorf("x=2 = %v from %v samples; want red 201 from 3", c, kept)
+	}
+	if twoStageFallbacks != 1 {
+		t.Errorf("twoStageFallbacks = %v after one rejected pixel; want 1", twoStageFallbacks)
+	}
+	if _, _, err := reduce(1, 0, colors(1, 0, images), nil); err != nil {
+		t.Fatalf("reducing x=1 failed: %v", err)
+	}
+	if twoStageFallbacks != 1 {
+		t.Errorf("twoStageFallbacks = %v after a pixel matching the grid; want 1", twoStageFallbacks)
+	}
+}
+
+func TestWeightedMeanWithinSamples(t *testing.T) {
+	tests := []struct {
+		name string
+		xs   []float64
+		ws   []float64
+	}{
+		{"identical opaque", []float64{65535, 65535, 65535, 65535, 65535}, []float64{0.1, 0.2, 0.3, 0.4, 0.7}},
+		{"identical opaque above", []float64{65535, 65535}, []float64{0.3, 0.4}},
+		{"identical opaque below", []float64{65535, 65535}, []float64{0.1, 0.2}},
+		{"identical", []float64{1234, 1234, 1234}, []float64{0.3, 0.3, 0.3}},
+		{"spread", []float64{0, 65535, 32768}, []float64{0.1, 0.7, 0.2}},
+		{"one weighted", []float64{10, 20, 30}, []float64{0, 0.1, 0}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := weightedMean(tc.xs, tc.ws)
+			if err != nil {
+				t.Fatalf("weightedMean(%v, %v) failed: %v", tc.xs, tc.ws, err)
+			}
+			lo, hi := tc.xs[0], tc.xs[0]
+			for _, x := range tc.xs {
+				if x < lo {
+					lo = x
+				}
+				if x > hi {
+					hi = x
+				}
+			}
+			if m < lo || m > hi {
+				t.Errorf("weightedMean(%v, %v) = %v; want within [%v, %v]", tc.xs, tc.ws, m, lo, hi)
+			}
+			if lo == hi && m != lo {
+				t.Errorf("weightedMean(%v, %v) = %v; want exactly %v", tc.xs, tc.ws, m, lo)
+			}
+		})
+	}
+}
+
+// TestWeightedFilterMatchesUnweighted checks that --weighted-filter with
+// equal weights rejects and averages like the unweighted filter, and that
+// uneven weights on opaque samples keep them exactly opaque.
+func TestWeightedFilterMatchesUnweighted(t *testing.T) {
+	defer func(w, fast bool) { *weightedFilterFlag, *identicalFastPathFlag = w, fast }(*weightedFilterFlag, *identicalFastPathFlag)
+	*identicalFastPathFlag = false
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		colors := make([]color.Color, 3+rng.Intn(8))
+		weights := make([]float64, len(colors))
+		for j := range colors {
+			colors[j] = color.RGBA64{uint16(rng.Intn(0x10000)), uint16(rng.Intn(0x10000)), uint16(rng.Intn(0x10000)), 0xffff}
+			weights[j] = 0.3
+		}
+		if rng.Intn(4) == 0 {
+			colors[0] = color.RGBA64{0xffff, 0, 0xffff, 0xffff}
+		}
+
+		*weightedFilterFlag = false
+		want, wantKept, wantErr := meanColor(nil, colors, nil, 1)
+		*weightedFilterFlag = true
+		got, gotKept, gotErr := meanColor(nil, colors, weights, 1)
+		if (wantErr == nil) != (gotErr == nil) || wantKept != gotKept {
+			t.Fatalf("%v: weighted kept %v (%v), unweighted kept %v (%v)", colors, gotKept, gotErr, wantKept, wantErr)
+		}
+		if wantErr != nil {
+			continue
+		}
+		wr, wg, wb, wa := want.RGBA()
+		gr, gg, gb, ga := got.RGBA()
+		for ch, d := range [4]int{int(gr) - int(wr), int(gg) - int(wg), int(gb) - int(wb), int(ga) - int(wa)} {
+			if d < -1 || d > 1 {
+				t.Errorf("%v: channel %v differs by %v between weighted %v and unweighted %v", colors, ch, d, got, want)
+			}
+		}
+	}
+
+	colors := []color.Color{
+		color.RGBA64{100, 200, 300, 0xffff},
+		color.RGBA64{140, 240, 340, 0xffff},
+	}
+	c, _, err := meanColor(nil, colors, []float64{0.1, 0.2}, 2)
+	if err != nil {
+		t.Fatalf("meanColor failed: %v", err)
+	}
+	if _, _, _, a := c.RGBA(); a != 0xffff {
+		t.Errorf("alpha = %v; want 0xffff", a)
+	}
+}
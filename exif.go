@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"sort"
+)
+
+// outputEXIF is the --merge-metadata-strategy EXIF written into JPEG output,
+// or nil when the output gets none.
+var outputEXIF exifData
+
+// errNoEXIF is returned by readEXIF for images without EXIF metadata.
+var errNoEXIF = errors.New("no EXIF metadata")
+
+// The EXIF directories readEXIF reads, which are also where exifTag.ifd
+// points.
+const (
+	ifdMain = iota // IFD0, which describes the image
+	ifdExif        // the Exif sub-IFD, with capture settings
+	ifdGPS         // the GPS sub-IFD
+)
+
+// exifPointers are the IFD0 tags that hold the offset of a sub-IFD, by the
+// sub-IFD they point to.
+var exifPointers = map[int]uint16{ifdExif: 0x8769, ifdGPS: 0x8825}
+
+// exifDropped lists the tags that are never copied: those that describe how
+// the input's pixels were stored and at what resolution, which no longer fit
+// the output, and the maker note and interoperability pointer, whose
+// contents hold offsets into the input file.
+var exifDropped = map[exifTag]bool{
+	{ifdMain, 0x0100}: true, // ImageWidth
+	{ifdMain, 0x0101}: true, // ImageLength
+	{ifdMain, 0x0102}: true, // BitsPerSample
+	{ifdMain, 0x0103}: true, // Compression
+	{ifdMain, 0x0106}: true, // PhotometricInterpretation
+	{ifdMain, 0x0111}: true, // StripOffsets
+	{ifdMain, 0x0115}: true, // SamplesPerPixel
+	{ifdMain, 0x0116}: true, // RowsPerStrip
+	{ifdMain, 0x0117}: true, // StripByteCounts
+	{ifdMain, 0x011a}: true, // XResolution
+	{ifdMain, 0x011b}: true, // YResolution
+	{ifdMain, 0x011c}: true, // PlanarConfiguration
+	{ifdMain, 0x0128}: true, // ResolutionUnit
+	{ifdMain, 0x0201}: true, // JPEGInterchangeFormat
+	{ifdMain, 0x0202}: true, // JPEGInterchangeFormatLength
+	{ifdExif, 0x927c}: true, // MakerNote
+	{ifdExif, 0xa002}: true, // PixelXDimension
+	{ifdExif, 0xa003}: true, // PixelYDimension
+	{ifdExif, 0xa005}: true, // InteroperabilityIFDPointer
+}
+
+// exifTag identifies an EXIF field by the directory it is in and its tag.
+type exifTag struct {
+	ifd int
+	tag uint16
+}
+
+// exifEntry is the value of an EXIF field: its TIFF type, its count and its
+// bytes, always stored big-endian so equal values compare equal whichever
+// byte order their files used.
+type exifEntry struct {
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// exifData holds the fields of an image's EXIF metadata.
+type exifData map[exifTag]exifEntry
+
+// exifUnitSize is the size of one number of each TIFF type. Rationals are two
+// numbers.
+var exifUnitSize = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 4, 6: 1, 7: 1, 8: 2, 9: 4, 10: 4, 11: 4, 12: 8}
+
+// exifTypeSize is the size of one value of a TIFF type.
+func exifTypeSize(typ uint16) int {
+	if typ == 5 || typ == 10 {
+		return 8
+	}
+	return exifUnitSize[typ]
+}
+
+// readEXIF returns the EXIF metadata of the JPEG at path, from its APP1
+// segment. Other formats, and JPEGs without one, return errNoEXIF.
+func readEXIF(path string) (exifData, error) {
+	f, err := openInput(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return nil, errNoEXIF
+	}
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil || hdr[0] != 0xff {
+			return nil, errNoEXIF
+		}
+		marker, length := hdr[1], int(binary.BigEndian.Uint16(hdr[2:]))-2
+		// Start of scan: the headers are over.
+		if marker == 0xda || length < 0 {
+			return nil, errNoEXIF
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, errNoEXIF
+		}
+		if marker == 0xe1 && bytes.HasPrefix(data, []byte("Exif\x00\x00")) {
+			e, err := parseEXIF(data[6:])
+			if err != nil {
+				return nil, fmt.Errorf("failed reading the EXIF metadata of %v: %v", path, err)
+			}
+			return e, nil
+		}
+	}
+}
+
+// parseEXIF reads IFD0 and its Exif and GPS sub-IFDs from tiff, the TIFF
+// structure inside an EXIF APP1 segment. The thumbnail in IFD1 is skipped.
+func parseEXIF(tiff []byte) (exifData, error) {
+	if len(tiff) < 8 {
+		return nil, fmt.Errorf("TIFF header is truncated")
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("bad TIFF header")
+	}
+	e := exifData{}
+	pointers, err := e.parseIFD(tiff, order, order.Uint32(tiff[4:]), ifdMain)
+	if err != nil {
+		return nil, err
+	}
+	for _, ifd := range []int{ifdExif, ifdGPS} {
+		if off, ok := pointers[ifd]; ok {
+			if _, err := e.parseIFD(tiff, order, off, ifd); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return e, nil
+}
+
+// parseIFD adds the fields of the directory at offset off to e. For IFD0 it
+// also returns where the sub-IFDs are.
+func (e exifData) parseIFD(tiff []byte, order binary.ByteOrder, off uint32, ifd int) (map[int]uint32, error) {
+	if uint64(off)+2 > uint64(len(tiff)) {
+		return nil, fmt.Errorf("IFD at %v is past the end", off)
+	}
+	n := int(order.Uint16(tiff[off:]))
+	start := int(off) + 2
+	if start+12*n > len(tiff) {
+		return nil, fmt.Errorf("IFD at %v is truncated", off)
+	}
+	pointers := map[int]uint32{}
+	for i := 0; i < n; i++ {
+		entry := tiff[start+12*i : start+12*i+12]
+		tag, typ, count := order.Uint16(entry), order.Uint16(entry[2:]), order.Uint32(entry[4:])
+		if ifd == ifdMain {
+			found := false
+			for sub, p := range exifPointers {
+				if tag == p {
+					pointers[sub] = order.Uint32(entry[8:])
+					found = true
+				}
+			}
+			if found {
+				continue
+			}
+		}
+		unit := exifUnitSize[typ]
+		if unit == 0 || exifDropped[exifTag{ifd, tag}] {
+			continue
+		}
+		size := uint64(exifTypeSize(typ)) * uint64(count)
+		value := entry[8:12]
+		if size > 4 {
+			at := uint64(order.Uint32(entry[8:]))
+			if at+size > uint64(len(tiff)) {
+				return nil, fmt.Errorf("value of tag %#04x is past the end", tag)
+			}
+			value = tiff[at : at+size]
+		}
+		value = append([]byte(nil), value[:size]...)
+		if order == binary.LittleEndian {
+			for k := 0; k+unit <= len(value); k += unit {
+				for a, b := k, k+unit-1; a < b; a, b = a+1, b-1 {
+					value[a], value[b] = value[b], value[a]
+				}
+			}
+		}
+		e[exifTag{ifd, tag}] = exifEntry{typ, count, value}
+	}
+	return pointers, nil
+}
+
+// commonEXIF returns the fields that have the same value in every one of sets.
+func commonEXIF(sets []exifData) exifData {
+	common := exifData{}
+	if len(sets) == 0 {
+		return common
+	}
+	for tag, entry := range sets[0] {
+		same := true
+		for _, s := range sets[1:] {
+			other, ok := s[tag]
+			if !ok || other.typ != entry.typ || other.count != entry.count || !bytes.Equal(other.value, entry.value) {
+				same = false
+				break
+			}
+		}
+		if same {
+			common[tag] = entry
+		}
+	}
+	return common
+}
+
+// mergeEXIF implements --merge-metadata-strategy: "first" returns the EXIF
+// metadata of the first input, and "common" the fields identical across
+// every input, so an input without EXIF leaves nothing in common. It
+// returns nil when there is nothing to write.
+func mergeEXIF(paths []string, strategy string) (exifData, error) {
+	if strategy == "first" {
+		paths = paths[:1]
+	}
+	var sets []exifData
+	for _, p := range paths {
+		e, err := readEXIF(p)
+		if err == errNoEXIF {
+			log.Printf("--merge-metadata-strategy=%v: %v has no EXIF metadata, so the output gets none", strategy, p)
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, e)
+	}
+	e := commonEXIF(sets)
+	if *verboseFlag {
+		log.Printf("--merge-metadata-strategy=%v: writing %v EXIF fields", strategy, len(e))
+	}
+	if len(e) == 0 {
+		return nil, nil
+	}
+	return e, nil
+}
+
+// marshal encodes e as the TIFF structure of an EXIF APP1 segment, in
+// big-endian byte order with the fields of each directory sorted by tag.
+func (e exifData) marshal() []byte {
+	var dirs [3][]exifTag
+	for tag := range e {
+		dirs[tag.ifd] = append(dirs[tag.ifd], tag)
+	}
+	for _, d := range dirs {
+		sort.Slice(d, func(i, j int) bool { return d[i].tag < d[j].tag })
+	}
+	// Each directory is its count, its entries, the offset of the next
+	// directory and then the values too long to fit in an entry, padded to
+	// an even length.
+	size := func(d []exifTag, extra int) int {
+		n := 2 + 12*(len(d)+extra) + 4
+		for _, tag := range d {
+			if v := len(e[tag].value); v > 4 {
+				n += v + v%2
+			}
+		}
+		return n
+	}
+	subs := 0
+	for _, ifd := range []int{ifdExif, ifdGPS} {
+		if len(dirs[ifd]) > 0 {
+			subs++
+		}
+	}
+	offsets := [3]int{8, 0, 0}
+	next := 8 + size(dirs[ifdMain], subs)
+	for _, ifd := range []int{ifdExif, ifdGPS} {
+		if len(dirs[ifd]) > 0 {
+			offsets[ifd] = next
+			next += size(dirs[ifd], 0)
+		}
+	}
+
+	out := make([]byte, 8, next)
+	copy(out, "MM\x00*")
+	binary.BigEndian.PutUint32(out[4:], 8)
+	for ifd, d := range dirs {
+		if ifd != ifdMain && len(d) == 0 {
+			continue
+		}
+		entries := map[uint16]exifEntry{}
+		for _, tag := range d {
+			entries[tag.tag] = e[tag]
+		}
+		if ifd == ifdMain {
+			for sub, p := range exifPointers {
+				if offsets[sub] != 0 {
+					v := make([]byte, 4)
+					binary.BigEndian.PutUint32(v, uint32(offsets[sub]))
+					entries[p] = exifEntry{4, 1, v}
+				}
+			}
+		}
+		tags := make([]uint16, 0, len(entries))
+		for t := range entries {
+			tags = append(tags, t)
+		}
+		sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+
+		data := offsets[ifd] + 2 + 12*len(tags) + 4
+		var values []byte
+		out = appendUint16(out, uint16(len(tags)))
+		for _, t := range tags {
+			entry := entries[t]
+			out = appendUint16(out, t)
+			out = appendUint16(out, entry.typ)
+			out = appendUint32(out, entry.count)
+			if len(entry.value) <= 4 {
+				var inline [4]byte
+				copy(inline[:], entry.value)
+				out = append(out, inline[:]...)
+				continue
+			}
+			out = appendUint32(out, uint32(data+len(values)))
+			values = append(values, entry.value...)
+			if len(entry.value)%2 == 1 {
+				values = append(values, 0)
+			}
+		}
+		out = appendUint32(out, 0)
+		out = append(out, values...)
+	}
+	return out
+}
+
+// exifImage is an image to be encoded with EXIF metadata.
+type exifImage struct {
+	image.Image
+	exif exifData
+}
+
+// withEXIF attaches outputEXIF to img for encodeImage. It returns img
+// unchanged when there is no EXIF metadata to write.
+func withEXIF(img image.Image) image.Image {
+	if outputEXIF == nil {
+		return img
+	}
+	return exifImage{img, outputEXIF}
+}
+
+// encodeWithEXIF writes what encode produces to w, adding e as an APP1
+// segment for format "jpeg". Other formats are written unchanged.
+func encodeWithEXIF(w io.Writer, format string, e exifData, encode func(io.Writer) error) error {
+	var buf bytes.Buffer
+	if err := encode(&buf); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if format != "jpeg" {
+		_, err := w.Write(data)
+		return err
+	}
+	tiff := e.marshal()
+	if 2+6+len(tiff) > 0xffff {
+		return fmt.Errorf("%v bytes of EXIF metadata do not fit in a JPEG segment", len(tiff))
+	}
+	segment := append([]byte{0xff, 0xe1, 0, 0}, "Exif\x00\x00"...)
+	binary.BigEndian.PutUint16(segment[2:], uint16(2+6+len(tiff)))
+	segment = append(segment, tiff...)
+	// The segment goes after the start of image marker and any JFIF segment,
+	// which must come first.
+	at := 2
+	if len(data) >= 6 && data[2] == 0xff && data[3] == 0xe0 {
+		at += 2 + int(binary.BigEndian.Uint16(data[4:]))
+	}
+	return writeAll(w, data[:at], segment, data[at:])
+}
+
+func writeAll(w io.Writer, parts ...[]byte) error {
+	for _, p := range parts {
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// littleEndianTIFF builds the TIFF structure of an EXIF segment the way many
+// cameras write it: little-endian, with a Make, Model and DateTime in IFD0,
+// an ImageWidth that must not be copied, and an Exif sub-IFD with the
+// exposure time and capture time.
+func littleEndianTIFF(date string) []byte {
+	le := binary.LittleEndian
+	type field struct {
+		tag, typ uint16
+		count    uint32
+		value    []byte
+	}
+	rational := make([]byte, 8)
+	le.PutUint32(rational, 1)
+	le.PutUint32(rational[4:], 125)
+	width := make([]byte, 2)
+	le.PutUint16(width, 640)
+	dirs := [][]field{
+		{
+			{0x0100, 3, 1, width},
+			{0x010f, 2, 4, []byte("Cam\x00")},
+			{0x0110, 2, 8, []byte("Model X\x00")},
+			{0x0132, 2, 20, []byte(date + "\x00")},
+			{0x8769, 4, 1, nil},
+		},
+		{
+			{0x829a, 5, 1, rational},
+			{0x9003, 2, 20, []byte(date + "\x00")},
+		},
+	}
+	out := []byte("II*\x00\x08\x00\x00\x00")
+	for d, fields := range dirs {
+		start := len(out)
+		data := start + 2 + 12*len(fields) + 4
+		var values []byte
+		out = append(out, 0, 0)
+		le.PutUint16(out[start:], uint16(len(fields)))
+		for _, f := range fields {
+			entry := make([]byte, 12)
+			le.PutUint16(entry, f.tag)
+			le.PutUint16(entry[2:], f.typ)
+			le.PutUint32(entry[4:], f.count)
+			switch {
+			case f.tag == 0x8769:
+				// Set below, once IFD0 and its values are complete.
+			case len(f.value) <= 4:
+				copy(entry[8:], f.value)
+			default:
+				le.PutUint32(entry[8:], uint32(data+len(values)))
+				values = append(values, f.value...)
+			}
+			out = append(out, entry...)
+		}
+		out = append(out, 0, 0, 0, 0)
+		out = append(out, values...)
+		if d == 0 {
+			// The Exif sub-IFD comes right after.
+			for i := 0; i < len(fields); i++ {
+				at := start + 2 + 12*i
+				if le.Uint16(out[at:]) == 0x8769 {
+					le.PutUint32(out[at+8:], uint32(len(out)))
+				}
+			}
+		}
+	}
+	return out
+}
+
+// TestMergeMetadataStrategy writes two JPEGs with EXIF metadata in different
+// byte orders, where only the dates differ, and checks the fields each
+// strategy writes into the output.
+func TestMergeMetadataStrategy(t *testing.T) {
+	dir := t.TempDir()
+	first, err := parseEXIF(littleEndianTIFF("2024:05:01 10:00:00"))
+	if err != nil {
+		t.Fatalf("parseEXIF failed: %v", err)
+	}
+	second, err := parseEXIF(littleEndianTIFF("2024:05:01 10:00:07"))
+	if err != nil {
+		t.Fatalf("parseEXIF failed: %v", err)
+	}
+	if _, ok := first[exifTag{ifdMain, 0x0100}]; ok {
+		t.Errorf("parseEXIF kept ImageWidth")
+	}
+	if got := first[exifTag{ifdExif, 0x829a}].value; !bytes.Equal(got, []byte{0, 0, 0, 1, 0, 0, 0, 125}) {
+		t.Errorf("ExposureTime is %v; want 1/125 stored big-endian", got)
+	}
+
+	// The second input is written big-endian by marshal.
+	var paths []string
+	for i, e := range []exifData{first, second} {
+		path := filepath.Join(dir, []string{"a.jpeg", "b.jpeg"}[i])
+		var buf bytes.Buffer
+		if err := encodeImage(&buf, path, exifImage{image.NewGray(image.Rect(0, 0, 8, 8)), e}); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	if got, err := readEXIF(paths[0]); err != nil || !reflect.DeepEqual(got, first) {
+		t.Errorf("readEXIF of the written file returned %v, %v; want %v", got, err, first)
+	}
+
+	for _, tc := range []struct {
+		strategy string
+		want     []exifTag
+	}{
+		{"first", []exifTag{{ifdMain, 0x010f}, {ifdMain, 0x0110}, {ifdMain, 0x0132}, {ifdExif, 0x829a}, {ifdExif, 0x9003}}},
+		{"common", []exifTag{{ifdMain, 0x010f}, {ifdMain, 0x0110}, {ifdExif, 0x829a}}},
+	} {
+		e, err := mergeEXIF(paths, tc.strategy)
+		if err != nil {
+			t.Fatalf("%v: mergeEXIF failed: %v", tc.strategy, err)
+		}
+		if len(e) != len(tc.want) {
+			t.Errorf("%v: got %v fields; want %v", tc.strategy, len(e), len(tc.want))
+		}
+		for _, tag := range tc.want {
+			if !reflect.DeepEqual(e[tag], first[tag]) {
+				t.Errorf("%v: field %#04x is %v; want %v", tc.strategy, tag.tag, e[tag], first[tag])
+			}
+		}
+
+		out := filepath.Join(dir, "out.jpeg")
+		var buf bytes.Buffer
+		img := exifImage{image.NewGray(image.Rect(0, 0, 8, 8)), e}
+		if err := encodeImage(&buf, out, img); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		if data[2] != 0xff || data[3] != 0xe1 {
+			t.Errorf("%v: output does not start with the EXIF segment", tc.strategy)
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(data)); err != nil {
+			t.Errorf("%v: output does not decode: %v", tc.strategy, err)
+		}
+		if err := os.WriteFile(out, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := readEXIF(out); err != nil || !reflect.DeepEqual(got, e) {
+			t.Errorf("%v: output EXIF is %v, %v; want %v", tc.strategy, got, err, e)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+)
+
+// adaptiveRadius is the half-width of the square neighborhood used to measure
+// local detail for --filter=adaptive, giving a 5x5 window.
+const adaptiveRadius = 2
+
+// Bounds on how far --filter=adaptive may scale --N, so that perfectly flat or
+// extremely busy regions don't end up rejecting everything or nothing.
+const (
+	minAdaptiveScale = 0.75
+	maxAdaptiveScale = 1.5
+)
+
+// thresholds returns the rejection threshold, in standard deviations, to use at
+// each pixel according to --filter, scaled by --n-map when one was given.
+func thresholds(images []image.Image) (func(x, y int) float64, error) {
+	n, err := filterThresholds(images)
+	if err != nil || nMapScale == nil {
+		return n, err
+	}
+	bounds := images[0].Bounds()
+	return func(x, y int) float64 {
+		return n(x, y) * nMapScale[(y-bounds.Min.Y)*bounds.Dx()+(x-bounds.Min.X)]
+	}, nil
+}
+
+func filterThresholds(images []image.Image) (func(x, y int) float64, error) {
+	switch *filterFlag {
+	case "stddev", "spatiotemporal", "largest-cluster", "gradient-direction":
+		return func(_, _ int) float64 { return *nFlag }, nil
+	case "adaptive":
+		bounds := images[0].Bounds()
+		scale := adaptiveScale(images)
+		return func(x, y int) float64 {
+			return *nFlag * scale[(y-bounds.Min.Y)*bounds.Dx()+(x-bounds.Min.X)]
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown --filter %q; must be 'stddev', 'adaptive', 'spatiotemporal', 'largest-cluster' or 'gradient-direction'", *filterFlag)
+}
+
+// adaptiveScale estimates how much detail surrounds every pixel and returns a
+// per-pixel factor for --N, indexed by row-major offset from bounds.Min.
+//
+// The detail at a pixel is the standard deviation of the brightness over the
+// neighborhood around it, averaged across all images. The factor is the square
+// root of that detail divided by the median detail of the whole frame, clamped
+// to [minAdaptiveScale, maxAdaptiveScale]. Flat regions therefore get a tighter
+// threshold than textured ones, where real variation between frames is
+// expected to be larger.
+func adaptiveScale(images []image.Image) []float64 {
+	bounds := images[0].Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	detail := make([]float64, w*h)
+	v := make([]float64, w*h)
+	vSq := make([]float64, w*h)
+	for _, i := range images {
+		for k := range v {
+			v[k] = brightness(i, bounds.Min.X+k%w, bounds.Min.Y+k/w)
+			vSq[k] = v[k] * v[k]
+		}
+		m := boxMean(v, w, h, adaptiveRadius)
+		mSq := boxMean(vSq, w, h, adaptiveRadius)
+		for k := range detail {
+			detail[k] += math.Sqrt(math.Max(mSq[k]-m[k]*m[k], 0)) / float64(len(images))
+		}
+	}
+
+	sorted := append([]float64(nil), detail...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+
+	scale := detail
+	for k, d := range detail {
+		if median == 0 {
+			scale[k] = 1
+			continue
+		}
+		scale[k] = math.Min(math.Max(math.Sqrt(d/median), minAdaptiveScale), maxAdaptiveScale)
+	}
+	return scale
+}
+
+// spatiotemporalReducer implements --filter=spatiotemporal. A sample is
+// rejected when any channel is more than n(x, y) standard deviations from the
+// mean of every sample, across all images, in the --neighborhood around the
+// pixel. Localized artifacts that stay put across frames, such as dust or hot
+// pixels, stand out against their neighborhood even though every frame agrees
+// about them. If every sample at a pixel is rejected, the pixel takes the
+// neighborhood mean instead, which fills those artifacts in from their
+// surroundings. That mean includes every sample at the pixel, so the pixel
+// counts them all as kept rather than being reported as empty.
+func spatiotemporalReducer(images []image.Image, n func(x, y int) float64, weights func(x, y int) []float64) (reducer, error) {
+	size := *neighborhoodFlag
+	if size < 1 || size%2 == 0 {
+		return nil, fmt.Errorf("--neighborhood must be a positive odd number, not %v", size)
+	}
+
+	bounds := images[0].Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	count := float64(len(images))
+	var centers, spreads [4][]float64
+	for ch := range centers {
+		sum := make([]float64, w*h)
+		sumSq := make([]float64, w*h)
+		for _, i := range images {
+			for k := range sum {
+				r, g, b, a := i.At(bounds.Min.X+k%w, bounds.Min.Y+k/w).RGBA()
+				v := float64([4]uint32{r, g, b, a}[ch])
+				sum[k] += v
+				sumSq[k] += v * v
+			}
+		}
+		m := boxMean(sum, w, h, size/2)
+		mSq := boxMean(sumSq, w, h, size/2)
+		centers[ch] = make([]float64, w*h)
+		spreads[ch] = make([]float64, w*h)
+		for k := range m {
+			mean := m[k] / count
+			centers[ch][k] = mean
+			spreads[ch][k] = math.Sqrt(math.Max(mSq[k]/count-mean*mean, 0))
+		}
+	}
+
+	return func(x, y int, colors []color.Color, t *tally) (color.Color, int, error) {
+		k := (y-bounds.Min.Y)*w + (x - bounds.Min.X)
+		means := []float64{centers[0][k], centers[1][k], centers[2][k], centers[3][k]}
+		stddevs := []float64{spreads[0][k], spreads[1][k], spreads[2][k], spreads[3][k]}
+		c, kept, err := filterMean(t, colors, weights(x, y), means, stddevs, n(x, y))
+		if err == errAllRejected {
+			return toRGBA64(t, means[0], means[1], means[2], means[3]), len(colors), nil
+		}
+		return c, kept, err
+	}, nil
+}
+
+// brightness is the unweighted mean of the color channels of i at x, y.
+func brightness(i image.Image, x, y int) float64 {
+	r, g, b, _ := i.At(x, y).RGBA()
+	return (float64(r) + float64(g) + float64(b)) / 3
+}
+
+// boxMean returns the mean of v, a w by h row-major grid, over the square
+// neighborhood of the given radius around every cell. Neighborhoods are cut
+// off at the edges of the grid.
+func boxMean(v []float64, w, h, radius int) []float64 {
+	// A summed-area table makes every neighborhood sum a constant-time
+	// lookup. It has an extra leading row and column of zeros.
+	sum := make([]float64, (w+1)*(h+1))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			k := (y+1)*(w+1) + (x + 1)
+			sum[k] = v[y*w+x] + sum[k-1] + sum[k-w-1] - sum[k-w-2]
+		}
+	}
+
+	out := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		y0, y1 := maxInt(y-radius, 0), minInt(y+radius+1, h)
+		for x := 0; x < w; x++ {
+			x0, x1 := maxInt(x-radius, 0), minInt(x+radius+1, w)
+			n := float64((y1 - y0) * (x1 - x0))
+			out[y*w+x] = (sum[y1*(w+1)+x1] - sum[y0*(w+1)+x1] - sum[y1*(w+1)+x0] + sum[y0*(w+1)+x0]) / n
+		}
+	}
+	return out
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
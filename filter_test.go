@@ -0,0 +1,40 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// TestSpatiotemporalFill checks that a hot pixel present in every frame is
+// filled in from its neighborhood under --filter=spatiotemporal, and that the
+// filled pixel reports its samples as kept, so --confidence-alpha and
+// --mask-output treat it as written.
+func TestSpatiotemporalFill(t *testing.T) {
+	defer func(n float64, filter string) { *nFlag, *filterFlag = n, filter }(*nFlag, *filterFlag)
+	*nFlag, *filterFlag = 1, "spatiotemporal"
+
+	var images []image.Image
+	for i := 0; i < 3; i++ {
+		img := image.NewGray(image.Rect(0, 0, 3, 3))
+		img.SetGray(1, 1, color.Gray{255})
+		images = append(images, img)
+	}
+	reduce, err := newReducer("sigma", images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, kept, err := mergeImages(images, reduce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := out.RGBAAt(1, 1); c.R >= 255 || c.A != 255 {
+		t.Errorf("hot pixel is %v; want it filled in from its neighborhood", c)
+	}
+	if kept[4] != 3 {
+		t.Errorf("filled pixel kept %v samples; want 3", kept[4])
+	}
+	if a := confidenceAlpha(out, kept, 3).RGBAAt(1, 1).A; a != 255 {
+		t.Errorf("--confidence-alpha gives the filled pixel alpha %v; want 255", a)
+	}
+}
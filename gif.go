@@ -0,0 +1,113 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"sort"
+)
+
+// encodeGIF writes img to w as a single-frame GIF with a palette of at most
+// --palette-colors colors chosen by median cut. With --gif-dither, pixels are
+// mapped onto the palette with Floyd-Steinberg error diffusion. Otherwise each
+// pixel takes the nearest palette color, which bands on smooth gradients.
+func encodeGIF(w io.Writer, img image.Image) error {
+	var drawer draw.Drawer = draw.Src
+	if *gifDitherFlag {
+		drawer = draw.FloydSteinberg
+	}
+	return gif.Encode(w, img, &gif.Options{
+		NumColors: *paletteColorsFlag,
+		Quantizer: medianCut{},
+		Drawer:    drawer,
+	})
+}
+
+// medianCut is a draw.Quantizer that splits the colors of an image into boxes,
+// always cutting the box with the widest channel range at the median of that
+// channel, and uses the mean color of each box as a palette entry. When the
+// image has fully transparent pixels, one entry is transparent.
+type medianCut struct{}
+
+func (medianCut) Quantize(p color.Palette, m image.Image) color.Palette {
+	n := cap(p) - len(p)
+	b := m.Bounds()
+	pixels := make([][3]uint8, 0, b.Dx()*b.Dy())
+	transparent := false
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := m.At(x, y).RGBA()
+			if a == 0 {
+				transparent = true
+				continue
+			}
+			pixels = append(pixels, [3]uint8{uint8(r >> 8), uint8(g >> 8), uint8(bl >> 8)})
+		}
+	}
+	if transparent {
+		p = append(p, color.RGBA{})
+		n--
+	}
+	if len(pixels) == 0 || n <= 0 {
+		return p
+	}
+
+	boxes := [][][3]uint8{pixels}
+	for len(boxes) < n {
+		// Cut the box with the widest range in any channel.
+		best, bestCh, bestRange := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			ch, r := widestChannel(box)
+			if r > bestRange {
+				best, bestCh, bestRange = i, ch, r
+			}
+		}
+		if best < 0 {
+			break
+		}
+		box := boxes[best]
+		sort.Slice(box, func(i, j int) bool { return box[i][bestCh] < box[j][bestCh] })
+		mid := len(box) / 2
+		boxes[best] = box[:mid]
+		boxes = append(boxes, box[mid:])
+	}
+	for _, box := range boxes {
+		var sum [3]int
+		for _, c := range box {
+			sum[0] += int(c[0])
+			sum[1] += int(c[1])
+			sum[2] += int(c[2])
+		}
+		k := len(box)
+		p = append(p, color.RGBA{uint8((sum[0] + k/2) / k), uint8((sum[1] + k/2) / k), uint8((sum[2] + k/2) / k), 0xff})
+	}
+	return p
+}
+
+// widestChannel returns the channel of box with the largest range and that
+// range.
+func widestChannel(box [][3]uint8) (int, int) {
+	lo, hi := box[0], box[0]
+	for _, c := range box {
+		for ch := range c {
+			if c[ch] < lo[ch] {
+				lo[ch] = c[ch]
+			}
+			if c[ch] > hi[ch] {
+				hi[ch] = c[ch]
+			}
+		}
+	}
+	best, r := 0, 0
+	for ch := range lo {
+		if int(hi[ch])-int(lo[ch]) > r {
+			best, r = ch, int(hi[ch])-int(lo[ch])
+		}
+	}
+	return best, r
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"math"
+	"testing"
+)
+
+// TestGIFDitherGradient encodes a gray ramp with an 8-color palette and checks
+// that --gif-dither brings each 8×8 block's average close to the ramp, where
+// nearest-color mapping leaves the flat bands of the palette. The blocks at
+// either end are skipped, since the palette's darkest and lightest entries
+// are box means that diffusion cannot get beyond.
+func TestGIFDitherGradient(t *testing.T) {
+	defer func(dither bool, colors int) { *gifDitherFlag, *paletteColorsFlag = dither, colors }(*gifDitherFlag, *paletteColorsFlag)
+	*paletteColorsFlag = 8
+
+	ramp := image.NewRGBA(image.Rect(0, 0, 256, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 256; x++ {
+			ramp.SetRGBA(x, y, color.RGBA{uint8(x), uint8(x), uint8(x), 255})
+		}
+	}
+
+	blockError := func(dither bool) float64 {
+		*gifDitherFlag = dither
+		var buf bytes.Buffer
+		if err := encodeGIF(&buf, ramp); err != nil {
+			t.Fatalf("encodeGIF failed: %v", err)
+		}
+		img, err := gif.Decode(&buf)
+		if err != nil {
+			t.Fatalf("failed to decode the GIF: %v", err)
+		}
+		worst := 0.0
+		for by := 0; by < 16; by += 8 {
+			for bx := 16; bx < 240; bx += 8 {
+				got, want := 0.0, 0.0
+				for y := by; y < by+8; y++ {
+					for x := bx; x < bx+8; x++ {
+						r, _, _, _ := img.At(x, y).RGBA()
+						got += float64(r >> 8)
+						want += float64(x)
+					}
+				}
+				worst = math.Max(worst, math.Abs(got-want)/64)
+			}
+		}
+		return worst
+	}
+
+	nearest, dithered := blockError(false), blockError(true)
+	if dithered >= nearest {
+		t.Errorf("dithered block error %.2f is not below the nearest-color error %.2f", dithered, nearest)
+	}
+	if dithered > 1.5 {
+		t.Errorf("dithered block error = %.2f levels; want at most 1.5", dithered)
+	}
+}
@@ -2,4 +2,7 @@ module average-image-cli
 
 go 1.17
 
-require github.com/montanaflynn/stats v0.6.6
+require (
+	github.com/montanaflynn/stats v0.6.6
+	golang.org/x/image v0.5.0
+)
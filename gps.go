@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+)
+
+// GPS sub-IFD tags that --merge-exif-gps-average reads and writes.
+const (
+	gpsVersionID    = 0x0000
+	gpsLatitudeRef  = 0x0001
+	gpsLatitude     = 0x0002
+	gpsLongitudeRef = 0x0003
+	gpsLongitude    = 0x0004
+)
+
+// gpsPosition returns the latitude and longitude in e, in degrees with north
+// and east positive. ok is false if e has no complete position.
+func (e exifData) gpsPosition() (lat, lon float64, ok bool) {
+	lat, ok = e.gpsCoordinate(gpsLatitude, gpsLatitudeRef, "N", "S")
+	if !ok {
+		return 0, 0, false
+	}
+	lon, ok = e.gpsCoordinate(gpsLongitude, gpsLongitudeRef, "E", "W")
+	if !ok || math.Abs(lat) > 90 || math.Abs(lon) > 180 {
+		return 0, 0, false
+	}
+	return lat, lon, true
+}
+
+// gpsCoordinate reads a coordinate stored as degrees, minutes and seconds in
+// tag, with its hemisphere in ref as positive or negative.
+func (e exifData) gpsCoordinate(tag, ref uint16, positive, negative string) (float64, bool) {
+	v, ok := e[exifTag{ifdGPS, tag}]
+	if !ok || v.typ != 5 || v.count != 3 {
+		return 0, false
+	}
+	r, ok := e[exifTag{ifdGPS, ref}]
+	if !ok || r.typ != 2 || len(r.value) == 0 {
+		return 0, false
+	}
+	deg := 0.0
+	for i, scale := range []float64{1, 60, 3600} {
+		num, den := binary.BigEndian.Uint32(v.value[8*i:]), binary.BigEndian.Uint32(v.value[8*i+4:])
+		if den == 0 {
+			return 0, false
+		}
+		deg += float64(num) / float64(den) / scale
+	}
+	switch string(r.value[:1]) {
+	case positive:
+		return deg, true
+	case negative:
+		return -deg, true
+	}
+	return 0, false
+}
+
+// averagePosition returns the mean of positions, each a latitude and
+// longitude in degrees, as the direction of the sum of their unit vectors on
+// the sphere. Unlike averaging the degrees, this is right for sets that
+// straddle the antimeridian, where 179.9° and -179.9° average to 180°.
+func averagePosition(positions [][2]float64) (lat, lon float64, err error) {
+	var x, y, z float64
+	for _, p := range positions {
+		phi, lambda := p[0]*math.Pi/180, p[1]*math.Pi/180
+		x += math.Cos(phi) * math.Cos(lambda)
+		y += math.Cos(phi) * math.Sin(lambda)
+		z += math.Sin(phi)
+	}
+	n := math.Sqrt(x*x + y*y + z*z)
+	if n < 1e-9*float64(len(positions)) {
+		return 0, 0, fmt.Errorf("the positions cancel out and have no mean")
+	}
+	return math.Asin(z/n) * 180 / math.Pi, math.Atan2(y, x) * 180 / math.Pi, nil
+}
+
+// setGPSPosition replaces the GPS fields of e with lat and lon, in degrees.
+func (e exifData) setGPSPosition(lat, lon float64) {
+	for tag := range e {
+		if tag.ifd == ifdGPS {
+			delete(e, tag)
+		}
+	}
+	e[exifTag{ifdGPS, gpsVersionID}] = exifEntry{1, 4, []byte{2, 3, 0, 0}}
+	for _, c := range []struct {
+		tag, ref           uint16
+		v                  float64
+		positive, negative string
+	}{
+		{gpsLatitude, gpsLatitudeRef, lat, "N", "S"},
+		{gpsLongitude, gpsLongitudeRef, lon, "E", "W"},
+	} {
+		hemisphere := c.positive
+		if c.v < 0 {
+			hemisphere = c.negative
+		}
+		e[exifTag{ifdGPS, c.ref}] = exifEntry{2, 2, []byte(hemisphere + "\x00")}
+		// Whole degrees and minutes, and seconds to a ten-thousandth, which
+		// is about 3 mm.
+		abs := math.Abs(c.v)
+		deg := math.Floor(abs)
+		min := math.Floor((abs - deg) * 60)
+		sec := math.Round(((abs-deg)*60 - min) * 60 * 10000)
+		if sec >= 60*10000 {
+			sec, min = 0, min+1
+		}
+		if min >= 60 {
+			min, deg = 0, deg+1
+		}
+		value := make([]byte, 24)
+		for i, r := range [3][2]uint32{{uint32(deg), 1}, {uint32(min), 1}, {uint32(sec), 10000}} {
+			binary.BigEndian.PutUint32(value[8*i:], r[0])
+			binary.BigEndian.PutUint32(value[8*i+4:], r[1])
+		}
+		e[exifTag{ifdGPS, c.tag}] = exifEntry{5, 3, value}
+	}
+}
+
+// averageGPS implements --merge-exif-gps-average. It returns e, or a new
+// exifData if e is nil, with its GPS fields replaced by the mean position of
+// the inputs in paths that are geotagged. Inputs without a position are left
+// out and logged. If none has one, e is returned unchanged.
+func averageGPS(paths []string, e exifData) (exifData, error) {
+	var positions [][2]float64
+	var missing []string
+	for _, p := range paths {
+		in, err := readEXIF(p)
+		if err != nil && err != errNoEXIF {
+			return nil, err
+		}
+		lat, lon, ok := in.gpsPosition()
+		if !ok {
+			missing = append(missing, p)
+			continue
+		}
+		positions = append(positions, [2]float64{lat, lon})
+	}
+	if len(missing) > 0 {
+		log.Printf("--merge-exif-gps-average: %v of %v inputs have no GPS position and are left out of the average", len(missing), len(paths))
+		if *verboseFlag {
+			for _, p := range missing {
+				log.Printf("--merge-exif-gps-average: no GPS position in %v", p)
+			}
+		}
+	}
+	if len(positions) == 0 {
+		log.Printf("--merge-exif-gps-average: no input has a GPS position; the output gets none")
+		return e, nil
+	}
+	lat, lon, err := averagePosition(positions)
+	if err != nil {
+		return nil, err
+	}
+	// Report how far the inputs are from the mean, since averaging positions
+	// taken far apart describes none of them.
+	farthest := 0.0
+	for _, p := range positions {
+		farthest = math.Max(farthest, distanceMeters(lat, lon, p[0], p[1]))
+	}
+	log.Printf("--merge-exif-gps-average: mean of %v positions is %.6f, %.6f; the farthest is %.0f m from it", len(positions), lat, lon, farthest)
+	if e == nil {
+		e = exifData{}
+	}
+	e.setGPSPosition(lat, lon)
+	return e, nil
+}
+
+// distanceMeters returns the great-circle distance between two positions in
+// degrees, on a sphere the mean size of the earth.
+func distanceMeters(lat1, lon1, lat2, lon2 float64) float64 {
+	const radius = 6371000
+	p1, p2 := lat1*math.Pi/180, lat2*math.Pi/180
+	dp, dl := p2-p1, (lon2-lon1)*math.Pi/180
+	h := math.Sin(dp/2)*math.Sin(dp/2) + math.Cos(p1)*math.Cos(p2)*math.Sin(dl/2)*math.Sin(dl/2)
+	return 2 * radius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
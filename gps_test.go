@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAveragePosition(t *testing.T) {
+	tests := []struct {
+		name      string
+		positions [][2]float64
+		lat, lon  float64
+	}{
+		{"one", [][2]float64{{52.37, 4.89}}, 52.37, 4.89},
+		{"equator", [][2]float64{{0, 10}, {0, 20}}, 0, 15},
+		{"antimeridian", [][2]float64{{10, 179.9}, {10, -179.9}}, 10, 180},
+		{"south and west", [][2]float64{{-33.86, -70.6}, {-33.88, -70.62}}, -33.87, -70.61},
+	}
+	for _, tc := range tests {
+		lat, lon, err := averagePosition(tc.positions)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+		// 180° and -180° are the same meridian.
+		dlon := math.Mod(lon-tc.lon+540, 360) - 180
+		if math.Abs(lat-tc.lat) > 1e-3 || math.Abs(dlon) > 1e-3 {
+			t.Errorf("%v: mean is %v, %v; want %v, %v", tc.name, lat, lon, tc.lat, tc.lon)
+		}
+	}
+	if _, _, err := averagePosition([][2]float64{{0, 0}, {0, 180}}); err == nil {
+		t.Errorf("averagePosition of antipodes returned no error")
+	}
+}
+
+// TestAverageGPS writes two geotagged JPEGs and one without EXIF, and checks
+// the output gets the mean of the two positions while keeping its other
+// fields.
+func TestAverageGPS(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for i, pos := range [][2]float64{{48.8584, 2.2945}, {48.8588, 2.2951}, {}} {
+		path := filepath.Join(dir, []string{"a.jpeg", "b.jpeg", "c.jpeg"}[i])
+		var img image.Image = image.NewGray(image.Rect(0, 0, 8, 8))
+		if i < 2 {
+			e := exifData{}
+			e.setGPSPosition(pos[0], pos[1])
+			img = exifImage{img, e}
+		}
+		var buf bytes.Buffer
+		if err := encodeImage(&buf, path, img); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	model := exifTag{ifdMain, 0x0110}
+	e := exifData{model: {2, 4, []byte("Cam\x00")}}
+	e, err := averageGPS(paths, e)
+	if err != nil {
+		t.Fatalf("averageGPS failed: %v", err)
+	}
+	lat, lon, ok := e.gpsPosition()
+	if !ok {
+		t.Fatalf("output has no GPS position")
+	}
+	if d := distanceMeters(lat, lon, 48.8586, 2.2948); d > 0.1 {
+		t.Errorf("mean position is %v, %v, %.2f m from the midpoint", lat, lon, d)
+	}
+	if _, ok := e[model]; !ok {
+		t.Errorf("averageGPS dropped the camera model")
+	}
+
+	none, err := averageGPS(paths[2:], nil)
+	if err != nil || none != nil {
+		t.Errorf("averageGPS without geotagged inputs returned %v, %v; want nil", none, err)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// minGradient is the smallest Sobel gradient magnitude of brightness, on the
+// 16-bit scale, whose direction --filter=gradient-direction trusts: about a
+// step of 5 levels of an 8-bit channel. Flatter samples have a direction that
+// is mostly noise, so they are never rejected.
+const minGradient = 4 * 5 * 0x101
+
+// minGradientSamples is how many samples at a pixel need a trusted direction
+// before --filter=gradient-direction forms a consensus from them. With fewer,
+// a single artifact could outvote the frames that agree.
+const minGradientSamples = 3
+
+// gradientReducer implements --filter=gradient-direction, an experimental
+// filter for directional artifacts such as motion blur that amplitude filters
+// miss: a smeared edge can keep plausible colors while pointing the wrong way.
+//
+// At every pixel it measures each image's brightness gradient with a 3x3 Sobel
+// operator. The consensus orientation is the mean of the samples' gradient
+// orientations, weighted by gradient magnitude. Orientations are compared modulo
+// 180 degrees, so an edge counts the same whichever side is brighter. Samples
+// whose orientation is more than --gradient-tolerance degrees from the
+// consensus are rejected, and the rest are averaged, weighted by weights. If
+// that rejects every sample, they are all averaged.
+func gradientReducer(images []image.Image, weights func(x, y int) []float64) (reducer, error) {
+	if *gradientToleranceFlag <= 0 || *gradientToleranceFlag >= 90 {
+		return nil, fmt.Errorf("--gradient-tolerance must be between 0 and 90 degrees, not %v", *gradientToleranceFlag)
+	}
+	tolerance := *gradientToleranceFlag * math.Pi / 180
+	return func(x, y int, colors []color.Color, t *tally) (color.Color, int, error) {
+		if *identicalFastPathFlag && len(colors) > 1 {
+			if c, ok := identicalColor(colors); ok {
+				t.count(&identicalPixels)
+				return c, len(colors), nil
+			}
+		}
+
+		// Doubling each angle makes opposite directions coincide, so their
+		// vectors sum to a mean orientation instead of cancelling.
+		angles := make([]float64, len(images))
+		strong := make([]bool, len(images))
+		var sumCos, sumSin float64
+		trusted := 0
+		for idx, i := range images {
+			gx, gy := sobel(i, x, y)
+			mag := math.Hypot(gx, gy)
+			if mag < minGradient {
+				continue
+			}
+			angles[idx] = math.Atan2(gy, gx)
+			strong[idx] = true
+			sumCos += mag * math.Cos(2*angles[idx])
+			sumSin += mag * math.Sin(2*angles[idx])
+			trusted++
+		}
+
+		ws := weights(x, y)
+		var keptColors []color.Color
+		var keptWeights []float64
+		for idx, c := range colors {
+			if trusted >= minGradientSamples && strong[idx] {
+				consensus := math.Atan2(sumSin, sumCos) / 2
+				if orientationDistance(angles[idx], consensus) > tolerance {
+					continue
+				}
+			}
+			keptColors = append(keptColors, c)
+			if ws != nil {
+				keptWeights = append(keptWeights, ws[idx])
+			}
+		}
+		if len(keptColors) == 0 {
+			keptColors, keptWeights = colors, ws
+		}
+		if *rejectIsolatedFlag && len(keptColors) == 1 {
+			return nil, 0, errAllRejected
+		}
+
+		c, err := reduceChannels(t, keptColors, func(xs []float64) (float64, error) {
+			return filteredMean(xs, keptWeights)
+		})
+		return c, len(keptColors), err
+	}, nil
+}
+
+// sobel returns the horizontal and vertical Sobel gradients of the brightness
+// of i around x, y. Pixels beyond the edges repeat the nearest edge pixel.
+func sobel(i image.Image, x, y int) (float64, float64) {
+	b := i.Bounds()
+	at := func(dx, dy int) float64 {
+		px := minInt(maxInt(x+dx, b.Min.X), b.Max.X-1)
+		py := minInt(maxInt(y+dy, b.Min.Y), b.Max.Y-1)
+		return brightness(i, px, py)
+	}
+	gx := at(1, -1) + 2*at(1, 0) + at(1, 1) - at(-1, -1) - 2*at(-1, 0) - at(-1, 1)
+	gy := at(-1, 1) + 2*at(0, 1) + at(1, 1) - at(-1, -1) - 2*at(0, -1) - at(1, -1)
+	return gx, gy
+}
+
+// orientationDistance is the angle between the lines at angles a and b, in
+// radians from 0 to pi/2.
+func orientationDistance(a, b float64) float64 {
+	d := math.Mod(math.Abs(a-b), math.Pi)
+	return math.Min(d, math.Pi-d)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"path/filepath"
+	"strings"
+)
+
+// splitGrayAlpha splits img into its straight (non-premultiplied) gray level
+// and its alpha, as two 16-bit grayscale images. It fails if any pixel's red,
+// green and blue differ, since the gray level would drop the difference.
+func splitGrayAlpha(img image.Image) (*image.Gray16, *image.Gray16, error) {
+	b := img.Bounds()
+	gray, alpha := image.NewGray16(b), image.NewGray16(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := img.At(x, y).RGBA()
+			if r != g || g != bl {
+				return nil, nil, fmt.Errorf("pixel at x=%v y=%v is not gray: %v", x, y, img.At(x, y))
+			}
+			var v uint32
+			if a > 0 {
+				v = (r*0xffff + a/2) / a
+			}
+			gray.SetGray16(x, y, color.Gray16{uint16(v)})
+			alpha.SetGray16(x, y, color.Gray16{uint16(a)})
+		}
+	}
+	return gray, alpha, nil
+}
+
+// checkGray fails if any pixel of img has differing red, green and blue, so
+// that --preserve-gray-transparency refuses colored inputs before merging
+// rather than after.
+func checkGray(img image.Image) error {
+	switch img.ColorModel() {
+	case color.GrayModel, color.Gray16Model:
+		return nil
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if r, g, bl, _ := img.At(x, y).RGBA(); r != g || g != bl {
+				return fmt.Errorf("pixel at x=%v y=%v is not gray: %v", x, y, img.At(x, y))
+			}
+		}
+	}
+	return nil
+}
+
+// writeGrayTransparency writes img for --preserve-gray-transparency: its gray
+// level to path and its alpha to path with "_alpha" inserted before the
+// extension, both as 16-bit grayscale PNGs. It returns the path the gray level was
+// written to.
+func writeGrayTransparency(path string, img image.Image, merged image.Rectangle) (string, error) {
+	if strings.ToLower(filepath.Ext(path)) != ".png" {
+		return "", fmt.Errorf("unsupported operation; --preserve-gray-transparency writes PNG, so %v must end in .png", path)
+	}
+	gray, alpha, err := splitGrayAlpha(img)
+	if err != nil {
+		return "", fmt.Errorf("failed to write %v as grayscale: %v", path, err)
+	}
+	// Name the alpha after the file the gray level went to, which differs
+	// from path when --resume-safe picks a free name.
+	path, err = writeImage(path, withResolution(gray, merged))
+	if err != nil {
+		return "", err
+	}
+	if _, err := writeImage(alphaPath(path), withResolution(alpha, merged)); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// alphaPath returns the file writeGrayTransparency writes the alpha of the
+// output at path to.
+func alphaPath(path string) string {
+	return suffixPath(path, "alpha")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// TestPreserveGrayTransparency merges translucent grayscale inputs and checks
+// the gray level and alpha that --preserve-gray-transparency writes.
+func TestPreserveGrayTransparency(t *testing.T) {
+	inputs := [][3]color.NRGBA{
+		{{200, 200, 200, 255}, {40, 40, 40, 128}, {0, 0, 0, 0}},
+		{{200, 200, 200, 0}, {40, 40, 40, 128}, {0, 0, 0, 0}},
+		{{100, 100, 100, 0}, {40, 40, 40, 128}, {0, 0, 0, 0}},
+	}
+	var images []image.Image
+	for _, pixels := range inputs {
+		img := image.NewNRGBA(image.Rect(0, 0, 3, 1))
+		for x, c := range pixels {
+			img.SetNRGBA(x, 0, c)
+		}
+		images = append(images, img)
+	}
+	out := image.NewRGBA(image.Rect(0, 0, 3, 1))
+	for x := 0; x < 3; x++ {
+		c, _, err := meanColor(nil, colors(x, 0, images), nil, *nFlag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out.Set(x, 0, c)
+	}
+
+	gray, alpha, err := splitGrayAlpha(out)
+	if err != nil {
+		t.Fatalf("splitGrayAlpha failed: %v", err)
+	}
+	// The fully transparent samples add no color, so the first pixel keeps
+	// the gray of the one opaque sample at a third of its alpha. The merge
+	// stores 8-bit premultiplied color, which costs up to two 8-bit levels of
+	// gray once divided by that alpha.
+	want := []struct{ gray, alpha uint8 }{{200, 85}, {40, 128}, {0, 0}}
+	for x, w := range want {
+		g, a := uint8(gray.Gray16At(x, 0).Y>>8), uint8(alpha.Gray16At(x, 0).Y>>8)
+		if d := int(g) - int(w.gray); d < -2 || d > 2 {
+			t.Errorf("pixel %v: gray %v; want %v", x, g, w.gray)
+		}
+		if d := int(a) - int(w.alpha); d < -1 || d > 1 {
+			t.Errorf("pixel %v: alpha %v; want %v", x, a, w.alpha)
+		}
+	}
+
+	out.SetRGBA(0, 0, color.RGBA{10, 20, 30, 255})
+	if _, _, err := splitGrayAlpha(out); err == nil {
+		t.Errorf("splitGrayAlpha accepted a colored pixel")
+	}
+}
+
+// TestCheckGray checks that --preserve-gray-transparency accepts gray inputs,
+// translucent or not, and refuses an input with a single colored pixel.
+func TestCheckGray(t *testing.T) {
+	if err := checkGray(image.NewGray16(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Errorf("checkGray of a Gray16 image failed: %v", err)
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	img.SetNRGBA(0, 0, color.NRGBA{90, 90, 90, 40})
+	img.SetNRGBA(1, 1, color.NRGBA{200, 200, 200, 255})
+	if err := checkGray(img); err != nil {
+		t.Errorf("checkGray of translucent gray failed: %v", err)
+	}
+	img.SetNRGBA(1, 0, color.NRGBA{200, 201, 200, 255})
+	if err := checkGray(img); err == nil {
+		t.Errorf("checkGray accepted a colored pixel")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Size of the chart --histogram-output draws when writing an image.
+const (
+	histogramWidth  = 512
+	histogramHeight = 200
+)
+
+// histogram holds 256-bin counts of each 8-bit channel of an image.
+type histogram struct {
+	R [256]int `json:"r"`
+	G [256]int `json:"g"`
+	B [256]int `json:"b"`
+	A [256]int `json:"a"`
+}
+
+func newHistogram(img *image.RGBA) *histogram {
+	h := &histogram{}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			h.R[c.R]++
+			h.G[c.G]++
+			h.B[c.B]++
+			h.A[c.A]++
+		}
+	}
+	return h
+}
+
+// writeHistogram writes the histogram of img to path, as CSV for ".csv", JSON
+// for ".json", and otherwise as a chart image in the output format implied by
+// the extension.
+func writeHistogram(path string, img *image.RGBA) error {
+	h := newHistogram(img)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv", ".json":
+	default:
+		_, err := writeImage(path, h.chart())
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create histogram file %v: %v", path, err)
+	}
+	defer f.Close()
+
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		err = json.NewEncoder(f).Encode(h)
+	} else {
+		w := csv.NewWriter(f)
+		w.Write([]string{"value", "r", "g", "b", "a"})
+		for v := 0; v < 256; v++ {
+			w.Write([]string{strconv.Itoa(v), strconv.Itoa(h.R[v]), strconv.Itoa(h.G[v]), strconv.Itoa(h.B[v]), strconv.Itoa(h.A[v])})
+		}
+		w.Flush()
+		err = w.Error()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write histogram file %v: %v", path, err)
+	}
+	return nil
+}
+
+// chart draws the red, green and blue histograms over each other on black,
+// adding their colors where they overlap, each scaled to the tallest bin of
+// any channel.
+func (h *histogram) chart() *image.RGBA {
+	peak := 1
+	for v := 0; v < 256; v++ {
+		for _, n := range [3]int{h.R[v], h.G[v], h.B[v]} {
+			if n > peak {
+				peak = n
+			}
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, histogramWidth, histogramHeight))
+	for x := 0; x < histogramWidth; x++ {
+		v := x * 256 / histogramWidth
+		heights := [3]int{}
+		for ch, n := range [3]int{h.R[v], h.G[v], h.B[v]} {
+			heights[ch] = n * histogramHeight / peak
+		}
+		for y := 0; y < histogramHeight; y++ {
+			above := histogramHeight - y
+			c := color.RGBA{A: 0xff}
+			if heights[0] >= above {
+				c.R = 0xff
+			}
+			if heights[1] >= above {
+				c.G = 0xff
+			}
+			if heights[2] >= above {
+				c.B = 0xff
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
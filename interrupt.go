@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// exitInterrupted is the exit code after --partial-on-interrupt has written
+// what was computed before a SIGINT or SIGTERM arrived.
+const exitInterrupted = 3
+
+var errInterrupted = errors.New("interrupted")
+
+// interruptRequested is set to 1 by the signal handler and read with
+// sync/atomic from the merge loops.
+var interruptRequested int32
+
+// handleInterrupts makes the first SIGINT or SIGTERM ask the merge loops to
+// stop at the end of the current row rather than killing the process. The
+// handler is removed once it fires, so a second signal kills the process as
+// usual.
+func handleInterrupts() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-c
+		signal.Stop(c)
+		log.Printf("received %v; stopping after the current row to write a partial output, signal again to quit immediately", s)
+		atomic.StoreInt32(&interruptRequested, 1)
+	}()
+}
+
+func interrupted() bool {
+	return atomic.LoadInt32(&interruptRequested) != 0
+}
+
+// exitAfterInterrupt ends the run with exitInterrupted. It writes the
+// --json-summary itself because os.Exit skips main's deferred write.
+func exitAfterInterrupt(start time.Time) {
+	if summary != nil {
+		summary.Interrupted = true
+		if err := summary.write(os.Stdout, start); err != nil {
+			log.Printf("failed to write --json-summary: %v", err)
+		}
+	}
+	os.Exit(exitInterrupted)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+)
+
+// layerOpacities holds the --layer-opacity of each input in the order of the
+// paths being merged, or is nil when every layer is fully opaque.
+var layerOpacities []float64
+
+// checkOpacities rejects --layer-opacity values outside [0, 1].
+func checkOpacities(opacities []float64) error {
+	for i, o := range opacities {
+		if o < 0 || o > 1 {
+			return fmt.Errorf("opacity %v for input %v is not between 0 and 1", o, i+1)
+		}
+	}
+	return nil
+}
+
+// flattenColor implements --mode=flatten-layers. It stacks colors in input
+// order, the first at the bottom, and composites each layer over the ones
+// below it with source-over blending, after scaling the layer's alpha by its
+// --layer-opacity. Every layer counts as a surviving sample.
+func flattenColor(t *tally, colors []color.Color) (color.Color, int, error) {
+	var out [4]float64
+	for i, c := range colors {
+		r, g, b, a := c.RGBA()
+		opacity := 1.0
+		if layerOpacities != nil {
+			opacity = layerOpacities[i]
+		}
+		// The channels are premultiplied, so scaling all four by the
+		// opacity fades the layer, and what shows through is what its
+		// alpha leaves uncovered.
+		below := 1 - float64(a)*opacity/0xffff
+		for ch, v := range [4]uint32{r, g, b, a} {
+			out[ch] = float64(v)*opacity + out[ch]*below
+		}
+	}
+	return toRGBA64(t, out[0], out[1], out[2], out[3]), len(colors), nil
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// lazyWindow is how many of the most recently decoded rows a lazyPNG keeps to
+// begin with, which covers the neighborhoods the filters read around each
+// pixel. Reading a row up to twice the window back doubles the window and
+// decodes the file again from the top. Reading further back starts a new pass
+// from the top without widening the window.
+const lazyWindow = 16
+
+// errNotLazy reports that a file cannot be decoded a row at a time, so
+// --lazy-decode decodes it whole instead.
+var errNotLazy = errors.New("not a non-interlaced 8- or 16-bit PNG")
+
+// pngSignature starts every PNG file.
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// PNG color types, from the IHDR chunk.
+const (
+	pngGray      = 0
+	pngTrueColor = 2
+	pngPaletted  = 3
+	pngGrayAlpha = 4
+	pngRGBA      = 6
+)
+
+// lazyPNG is a PNG input that --lazy-decode decodes a row at a time as the
+// merge reaches it, instead of whole up front. Only the last few rows are
+// held, so a few enormous inputs take a few rows of memory each. Pixels come
+// out as the same colors image/png would decode.
+//
+// An image.Image cannot return errors, so a file that turns out to be
+// corrupt partway through reads as transparent from the bad row on, and Err
+// reports the failure for the merge to stop on.
+type lazyPNG struct {
+	path            string
+	width, height   int
+	depth, colorTyp int
+	palette         color.Palette
+	// transparent holds the tRNS color of gray and truecolor images, as
+	// stored in the file, and useTransparent whether there was one.
+	transparent    [6]byte
+	useTransparent bool
+
+	mu   sync.Mutex
+	in   io.ReadCloser // the open file, or nil before the first read
+	z    io.ReadCloser // the decompressed image data in the open file
+	next int           // the row z produces next
+	rows [][]byte      // the last len(rows) rows, indexed by row modulo len(rows)
+	err  error         // the first decoding failure, after which At gives up
+}
+
+// openLazyPNG reads the header of the PNG at path for --lazy-decode. It
+// returns errNotLazy for files that image/png must decode whole: other
+// formats, interlaced PNGs, bit depths below 8, and every file when
+// --decode-format-override names a format other than PNG.
+func openLazyPNG(path string) (*lazyPNG, error) {
+	if *decodeFormatFlag != "" && *decodeFormatFlag != "png" {
+		return nil, errNotLazy
+	}
+	l := &lazyPNG{path: path, rows: make([][]byte, lazyWindow)}
+	in, z, err := l.start()
+	if err != nil {
+		return nil, err
+	}
+	l.in, l.z = in, z
+	if err := l.checkWindow(len(l.rows)); err != nil {
+		l.close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// checkWindow fails if a window of rows rows would take more than
+// maxDecodeBytes, unless --no-decode-limit is set.
+func (l *lazyPNG) checkWindow(rows int) error {
+	if *noDecodeLimitFlag {
+		return nil
+	}
+	if size := int64(rows) * int64(l.width*l.bytesPerPixel()+1); size > maxDecodeBytes {
+		return fmt.Errorf("its rows are %v wide, so %v of them would take about %v MiB, over the limit of %v MiB; pass --no-decode-limit if the size is genuine", l.width, rows, size>>20, maxDecodeBytes>>20)
+	}
+	return nil
+}
+
+// start opens the file, reads every chunk before the image data and returns
+// the file and the decompressed image data.
+func (l *lazyPNG) start() (io.ReadCloser, io.ReadCloser, error) {
+	in, err := os.Open(l.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := bufio.NewReader(in)
+	sig := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(r, sig); err != nil || string(sig) != pngSignature {
+		in.Close()
+		return nil, nil, errNotLazy
+	}
+	for {
+		length, typ, err := readChunkHeader(r)
+		if err != nil {
+			in.Close()
+			return nil, nil, err
+		}
+		if typ == "IDAT" {
+			crc := crc32.NewIEEE()
+			crc.Write([]byte(typ))
+			idat := &idatReader{r: r, left: length, crc: crc}
+			z, err := zlib.NewReader(idat)
+			if err != nil {
+				in.Close()
+				return nil, nil, err
+			}
+			return in, z, nil
+		}
+		data, err := readChunkData(r, typ, length)
+		if err != nil {
+			in.Close()
+			return nil, nil, err
+		}
+		if err := l.parseChunk(typ, data); err != nil {
+			in.Close()
+			return nil, nil, err
+		}
+	}
+}
+
+// parseChunk reads the header chunks that decoding rows depends on.
+func (l *lazyPNG) parseChunk(typ string, data []byte) error {
+	switch typ {
+	case "IHDR":
+		if len(data) != 13 {
+			return fmt.Errorf("bad IHDR length %v", len(data))
+		}
+		w, h := binary.BigEndian.Uint32(data[0:4]), binary.BigEndian.Uint32(data[4:8])
+		if w == 0 || h == 0 || w > 1<<30 || h > 1<<30 {
+			return fmt.Errorf("bad size %vx%v", w, h)
+		}
+		l.width, l.height = int(w), int(h)
+		l.depth, l.colorTyp = int(data[8]), int(data[9])
+		if data[12] != 0 {
+			return errNotLazy
+		}
+		switch {
+		case l.depth == 8 && l.colorTyp <= pngRGBA && l.colorTyp != 1 && l.colorTyp != 5:
+		case l.depth == 16 && l.colorTyp != pngPaletted && l.colorTyp <= pngRGBA && l.colorTyp != 1 && l.colorTyp != 5:
+		default:
+			return errNotLazy
+		}
+	case "PLTE":
+		if len(data)%3 != 0 || len(data) == 0 || len(data) > 3*256 {
+			return fmt.Errorf("bad PLTE length %v", len(data))
+		}
+		// Indices past the palette are opaque black, as in image/png.
+		l.palette = make(color.Palette, 256)
+		for i := range l.palette {
+			l.palette[i] = color.RGBA{0, 0, 0, 0xff}
+		}
+		for i := 0; i < len(data)/3; i++ {
+			l.palette[i] = color.RGBA{data[3*i], data[3*i+1], data[3*i+2], 0xff}
+		}
+	case "tRNS":
+		switch l.colorTyp {
+		case pngPaletted:
+			if l.palette == nil || len(data) > 256 {
+				return fmt.Errorf("bad tRNS chunk")
+			}
+			for i, a := range data {
+				rgba := l.palette[i].(color.RGBA)
+				l.palette[i] = color.NRGBA{rgba.R, rgba.G, rgba.B, a}
+			}
+		case pngGray, pngTrueColor:
+			if len(data) != 2 && len(data) != 6 {
+				return fmt.Errorf("bad tRNS length %v", len(data))
+			}
+			copy(l.transparent[:], data)
+			l.useTransparent = true
+		}
+	}
+	return nil
+}
+
+// restart closes the open file and decodes it again from the first row.
+func (l *lazyPNG) restart() error {
+	l.close()
+	in, z, err := l.start()
+	if err != nil {
+		return err
+	}
+	l.in, l.z, l.next = in, z, 0
+	return nil
+}
+
+// close closes the open file and its decompressor, if any.
+func (l *lazyPNG) close() {
+	if l.in != nil {
+		l.z.Close()
+		l.in.Close()
+		l.in, l.z = nil, nil
+	}
+}
+
+// bytesPerPixel is how many bytes a pixel takes in the file, which is also
+// the distance the row filters look back.
+func (l *lazyPNG) bytesPerPixel() int {
+	channels := map[int]int{pngGray: 1, pngTrueColor: 3, pngPaletted: 1, pngGrayAlpha: 2, pngRGBA: 4}[l.colorTyp]
+	return channels * l.depth / 8
+}
+
+// row returns the unfiltered bytes of row y, decoding forward to it.
+func (l *lazyPNG) row(y int) ([]byte, error) {
+	if back := l.next - y; back > 2*len(l.rows) {
+		// A read this far back is a new pass over the image, such as the
+		// merge after a pass computing thresholds. Widening the window to
+		// cover it would end up holding every row, so only start again.
+		if err := l.restart(); err != nil {
+			return nil, err
+		}
+	} else if back > len(l.rows) {
+		// A short step back, such as where neighborhoods overlap. Decoding
+		// again from the top for every such read would be quadratic, so
+		// keep enough rows that the next one is in the window.
+		window := minInt(2*len(l.rows), l.height)
+		if err := l.checkWindow(window); err != nil {
+			return nil, err
+		}
+		l.rows = make([][]byte, window)
+		if *verboseFlag {
+			log.Printf("--lazy-decode: widening the row window of %v to %v rows", l.path, window)
+		}
+		if err := l.restart(); err != nil {
+			return nil, err
+		}
+	} else if l.z == nil {
+		if err := l.restart(); err != nil {
+			return nil, err
+		}
+	}
+	bpp := l.bytesPerPixel()
+	n := l.width * bpp
+	for l.next <= y {
+		cur := l.rows[l.next%len(l.rows)]
+		if cur == nil {
+			cur = make([]byte, n+1)
+			l.rows[l.next%len(l.rows)] = cur
+		}
+		if _, err := io.ReadFull(l.z, cur); err != nil {
+			return nil, fmt.Errorf("row %v: %v", l.next, err)
+		}
+		var prev []byte
+		if l.next > 0 {
+			prev = l.rows[(l.next-1)%len(l.rows)][1:]
+		} else {
+			prev = make([]byte, n)
+		}
+		if err := unfilter(cur[0], cur[1:], prev, bpp); err != nil {
+			return nil, fmt.Errorf("row %v: %v", l.next, err)
+		}
+		l.next++
+	}
+	return l.rows[y%len(l.rows)][1:], nil
+}
+
+// unfilter undoes PNG filter type ft on row cur, given the previous row prev
+// and bpp bytes per pixel.
+func unfilter(ft byte, cur, prev []byte, bpp int) error {
+	switch ft {
+	case 0:
+	case 1:
+		for i := bpp; i < len(cur); i++ {
+			cur[i] += cur[i-bpp]
+		}
+	case 2:
+		for i := range cur {
+			cur[i] += prev[i]
+		}
+	case 3:
+		for i := 0; i < bpp; i++ {
+			cur[i] += prev[i] / 2
+		}
+		for i := bpp; i < len(cur); i++ {
+			cur[i] += uint8((int(cur[i-bpp]) + int(prev[i])) / 2)
+		}
+	case 4:
+		for i := range cur {
+			var a, c int
+			if i >= bpp {
+				a, c = int(cur[i-bpp]), int(prev[i-bpp])
+			}
+			b := int(prev[i])
+			p := a + b - c
+			pa, pb, pc := absInt(p-a), absInt(p-b), absInt(p-c)
+			switch {
+			case pa <= pb && pa <= pc:
+				cur[i] += uint8(a)
+			case pb <= pc:
+				cur[i] += uint8(b)
+			default:
+				cur[i] += uint8(c)
+			}
+		}
+	default:
+		return fmt.Errorf("bad filter type %v", ft)
+	}
+	return nil
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func (l *lazyPNG) Bounds() image.Rectangle {
+	return image.Rect(0, 0, l.width, l.height)
+}
+
+// ColorModel is the model of the image image/png would decode.
+func (l *lazyPNG) ColorModel() color.Model {
+	switch {
+	case l.colorTyp == pngPaletted:
+		return l.palette
+	case l.depth == 8 && l.colorTyp == pngGray && !l.useTransparent:
+		return color.GrayModel
+	case l.depth == 8 && l.colorTyp == pngTrueColor && !l.useTransparent:
+		return color.RGBAModel
+	case l.depth == 8:
+		return color.NRGBAModel
+	case l.colorTyp == pngGray && !l.useTransparent:
+		return color.Gray16Model
+	case l.colorTyp == pngTrueColor && !l.useTransparent:
+		return color.RGBA64Model
+	}
+	return color.NRGBA64Model
+}
+
+func (l *lazyPNG) At(x, y int) color.Color {
+	if !(image.Point{x, y}.In(l.Bounds())) {
+		return l.ColorModel().Convert(color.Transparent)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return l.ColorModel().Convert(color.Transparent)
+	}
+	row, err := l.row(y)
+	if err != nil {
+		l.err = fmt.Errorf("failed decoding image %v: %v", l.path, err)
+		return l.ColorModel().Convert(color.Transparent)
+	}
+	if l.depth == 8 {
+		return l.at8(row, x)
+	}
+	return l.at16(row, x)
+}
+
+// Err returns the first error hit while decoding a row, if any.
+func (l *lazyPNG) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// at8 returns pixel x of an 8-bit row.
+func (l *lazyPNG) at8(row []byte, x int) color.Color {
+	switch l.colorTyp {
+	case pngGray:
+		v := row[x]
+		if l.useTransparent {
+			a := uint8(0xff)
+			if v == l.transparent[1] {
+				a = 0
+			}
+			return color.NRGBA{v, v, v, a}
+		}
+		return color.Gray{v}
+	case pngTrueColor:
+		r, g, b := row[3*x], row[3*x+1], row[3*x+2]
+		if l.useTransparent {
+			a := uint8(0xff)
+			if r == l.transparent[1] && g == l.transparent[3] && b == l.transparent[5] {
+				a = 0
+			}
+			return color.NRGBA{r, g, b, a}
+		}
+		return color.RGBA{r, g, b, 0xff}
+	case pngPaletted:
+		return l.palette[row[x]]
+	case pngGrayAlpha:
+		return color.NRGBA{row[2*x], row[2*x], row[2*x], row[2*x+1]}
+	}
+	return color.NRGBA{row[4*x], row[4*x+1], row[4*x+2], row[4*x+3]}
+}
+
+// at16 returns pixel x of a 16-bit row.
+func (l *lazyPNG) at16(row []byte, x int) color.Color {
+	u := func(i int) uint16 { return binary.BigEndian.Uint16(row[2*i:]) }
+	switch l.colorTyp {
+	case pngGray:
+		v := u(x)
+		if l.useTransparent {
+			a := uint16(0xffff)
+			if v == binary.BigEndian.Uint16(l.transparent[0:]) {
+				a = 0
+			}
+			return color.NRGBA64{v, v, v, a}
+		}
+		return color.Gray16{v}
+	case pngTrueColor:
+		r, g, b := u(3*x), u(3*x+1), u(3*x+2)
+		if l.useTransparent {
+			a := uint16(0xffff)
+			if r == binary.BigEndian.Uint16(l.transparent[0:]) && g == binary.BigEndian.Uint16(l.transparent[2:]) && b == binary.BigEndian.Uint16(l.transparent[4:]) {
+				a = 0
+			}
+			return color.NRGBA64{r, g, b, a}
+		}
+		return color.RGBA64{r, g, b, 0xffff}
+	case pngGrayAlpha:
+		return color.NRGBA64{u(2 * x), u(2 * x), u(2 * x), u(2*x + 1)}
+	}
+	return color.NRGBA64{u(4 * x), u(4*x + 1), u(4*x + 2), u(4*x + 3)}
+}
+
+// readChunkHeader reads the length and type that start a PNG chunk.
+func readChunkHeader(r io.Reader) (uint32, string, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, "", fmt.Errorf("failed reading a chunk header: %v", err)
+	}
+	return binary.BigEndian.Uint32(hdr[:4]), string(hdr[4:]), nil
+}
+
+// readChunkData reads the length bytes of a chunk of type typ along with the
+// CRC that follows them, and checks the CRC.
+func readChunkData(r io.Reader, typ string, length uint32) ([]byte, error) {
+	if length > 1<<26 {
+		return nil, fmt.Errorf("%v chunk of %v bytes is too large", typ, length)
+	}
+	data := make([]byte, length+4)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("failed reading the %v chunk: %v", typ, err)
+	}
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(typ))
+	crc.Write(data[:length])
+	if crc.Sum32() != binary.BigEndian.Uint32(data[length:]) {
+		return nil, fmt.Errorf("bad checksum in the %v chunk", typ)
+	}
+	return data[:length], nil
+}
+
+// idatReader reads the data of consecutive IDAT chunks as one stream,
+// checking each chunk's CRC, and ends at the first chunk of another type.
+type idatReader struct {
+	r    io.Reader
+	left uint32 // bytes left in the current chunk
+	crc  hash.Hash32
+	done bool
+}
+
+func (d *idatReader) Read(p []byte) (int, error) {
+	for d.left == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		var sum [4]byte
+		if _, err := io.ReadFull(d.r, sum[:]); err != nil {
+			return 0, err
+		}
+		if d.crc.Sum32() != binary.BigEndian.Uint32(sum[:]) {
+			return 0, fmt.Errorf("bad checksum in an IDAT chunk")
+		}
+		length, typ, err := readChunkHeader(d.r)
+		if err != nil {
+			return 0, err
+		}
+		if typ != "IDAT" {
+			d.done = true
+			return 0, io.EOF
+		}
+		d.left = length
+		d.crc.Reset()
+		d.crc.Write([]byte(typ))
+	}
+	if uint32(len(p)) > d.left {
+		p = p[:d.left]
+	}
+	n, err := d.r.Read(p)
+	d.crc.Write(p[:n])
+	d.left -= uint32(n)
+	return n, err
+}
+
+// lazyImages opens every file in paths for --lazy-decode, in the same order.
+// Files that cannot be decoded a row at a time are decoded whole.
+func lazyImages(paths []string) ([]image.Image, error) {
+	images := make([]image.Image, len(paths))
+	lazy := 0
+	for idx, p := range paths {
+		l, err := openLazyPNG(p)
+		if err == nil {
+			images[idx] = l
+			lazy++
+			continue
+		}
+		if err != errNotLazy {
+			return nil, fmt.Errorf("failed decoding image %v: %v", p, err)
+		}
+		if *verboseFlag {
+			log.Printf("decoding %v whole: %v", p, err)
+		}
+		if images[idx], err = decodeFile(p); err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("--lazy-decode: decoding %v of %v inputs a row at a time", lazy, len(paths))
+	return images, nil
+}
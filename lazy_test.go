@@ -0,0 +1,238 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestLazyPNGMatchesDecode encodes an image of each color type image/png
+// writes and checks that every pixel --lazy-decode reads, in row order and
+// then backwards, is the color png.Decode returns.
+func TestLazyPNGMatchesDecode(t *testing.T) {
+	const w, h = 13, 2*lazyWindow + 5
+	r := rand.New(rand.NewSource(1))
+	// More than 16 colors, so the palette is written at 8 bits per pixel,
+	// with a transparent entry for a tRNS chunk.
+	palette := color.Palette{color.NRGBA{0, 0, 0, 0}}
+	for i := 1; i < 20; i++ {
+		palette = append(palette, color.RGBA{uint8(12 * i), 0, uint8(255 - 12*i), 255})
+	}
+	images := map[string]image.Image{
+		"gray":     image.NewGray(image.Rect(0, 0, w, h)),
+		"gray16":   image.NewGray16(image.Rect(0, 0, w, h)),
+		"rgb":      image.NewRGBA(image.Rect(0, 0, w, h)),
+		"nrgba":    image.NewNRGBA(image.Rect(0, 0, w, h)),
+		"rgb16":    image.NewRGBA64(image.Rect(0, 0, w, h)),
+		"nrgba64":  image.NewNRGBA64(image.Rect(0, 0, w, h)),
+		"paletted": image.NewPaletted(image.Rect(0, 0, w, h), palette),
+	}
+	dir := t.TempDir()
+	for name, img := range images {
+		set := img.(interface{ Set(x, y int, c color.Color) })
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				c := color.NRGBA64{uint16(r.Intn(1 << 16)), uint16(r.Intn(1 << 16)), uint16(r.Intn(1 << 16)), uint16(r.Intn(1 << 16))}
+				if name == "rgb" || name == "rgb16" {
+					c.A = 0xffff
+				}
+				set.Set(x, y, c)
+			}
+		}
+		path := filepath.Join(dir, name+".png")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := png.Encode(f, img); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run(name, func(t *testing.T) {
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			want, err := png.Decode(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l, err := openLazyPNG(path)
+			if err != nil {
+				t.Fatalf("openLazyPNG failed: %v", err)
+			}
+			defer l.close()
+			if l.Bounds() != want.Bounds() {
+				t.Fatalf("bounds %v; want %v", l.Bounds(), want.Bounds())
+			}
+			if name != "paletted" && l.ColorModel() != want.ColorModel() {
+				t.Errorf("color model differs from png.Decode")
+			}
+			check := func(x, y int) {
+				if got, want := l.At(x, y), want.At(x, y); got != want {
+					t.Fatalf("pixel %v,%v is %#v; want %#v", x, y, got, want)
+				}
+			}
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					check(x, y)
+				}
+			}
+			for y := h - 1; y >= 0; y-- {
+				check(w-1, y)
+			}
+		})
+	}
+}
+
+// TestLazyPNGFallsBack checks that files image/png must decode whole are
+// reported as such rather than decoded wrongly.
+func TestLazyPNGFallsBack(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "not.png")
+	if err := os.WriteFile(path, []byte("GIF89a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openLazyPNG(path); err != errNotLazy {
+		t.Errorf("openLazyPNG of a GIF returned %v; want errNotLazy", err)
+	}
+
+	// A two-color palette is written at 1 bit per pixel.
+	img := image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Black, color.White})
+	path = filepath.Join(dir, "1bit.png")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := openLazyPNG(path); err != errNotLazy {
+		t.Errorf("openLazyPNG of a 1-bit PNG returned %v; want errNotLazy", err)
+	}
+}
+
+// writeLazyTestPNG writes a random 8-bit gray PNG of w×h pixels to path and
+// returns the image it holds.
+func writeLazyTestPNG(t *testing.T, path string, w, h int) *image.Gray {
+	t.Helper()
+	r := rand.New(rand.NewSource(1))
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	r.Read(img.Pix)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// TestLazyPNGWidensWindow checks that reading a row further back than the
+// window widens the window to reach it, so reading back and forth over that
+// distance no longer decodes the file again for every row.
+func TestLazyPNGWidensWindow(t *testing.T) {
+	const w, h = 5, 3 * lazyWindow
+	path := filepath.Join(t.TempDir(), "in.png")
+	want := writeLazyTestPNG(t, path, w, h)
+	l, err := openLazyPNG(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+
+	back := lazyWindow + 4
+	for y := 0; y < h; y++ {
+		if got := l.At(0, y); got != want.At(0, y) {
+			t.Fatalf("pixel 0,%v is %v; want %v", y, got, want.At(0, y))
+		}
+		if y >= back {
+			if got := l.At(1, y-back); got != want.At(1, y-back) {
+				t.Fatalf("pixel 1,%v is %v; want %v", y-back, got, want.At(1, y-back))
+			}
+		}
+	}
+	if len(l.rows) <= back {
+		t.Errorf("window is %v rows after reading %v rows back; want more than %v", len(l.rows), back, back)
+	}
+	if err := l.Err(); err != nil {
+		t.Errorf("Err() = %v; want nil", err)
+	}
+}
+
+// TestLazyPNGPassesKeepWindow checks that reading the image top to bottom
+// twice, as a threshold pass followed by the merge does, starts the second
+// pass again without widening the window to the whole image.
+func TestLazyPNGPassesKeepWindow(t *testing.T) {
+	const w, h = 5, 8 * lazyWindow
+	path := filepath.Join(t.TempDir(), "in.png")
+	want := writeLazyTestPNG(t, path, w, h)
+	l, err := openLazyPNG(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+
+	for pass := 0; pass < 2; pass++ {
+		for y := 0; y < h; y++ {
+			if got := l.At(0, y); got != want.At(0, y) {
+				t.Fatalf("pass %v: pixel 0,%v is %v; want %v", pass, y, got, want.At(0, y))
+			}
+		}
+		if len(l.rows) != lazyWindow {
+			t.Errorf("window is %v rows after pass %v; want %v", len(l.rows), pass, lazyWindow)
+		}
+	}
+	if err := l.Err(); err != nil {
+		t.Errorf("Err() = %v; want nil", err)
+	}
+}
+
+// TestLazyPNGCorruptFailsMerge checks that a PNG cut short partway through
+// its image data fails the merge with an error naming the file, instead of
+// stopping the process from inside At.
+func TestLazyPNGCorruptFailsMerge(t *testing.T) {
+	dir := t.TempDir()
+	var images []image.Image
+	for i, name := range []string{"good.png", "cut.png"} {
+		path := filepath.Join(dir, name)
+		writeLazyTestPNG(t, path, 64, 64)
+		if i == 1 {
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Truncate(path, info.Size()/2); err != nil {
+				t.Fatal(err)
+			}
+		}
+		l, err := openLazyPNG(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.close()
+		images = append(images, l)
+	}
+	reduce, err := newReducer("sigma", images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = mergeImages(images, reduce)
+	if err == nil || !strings.Contains(err.Error(), "cut.png") {
+		t.Errorf("mergeImages returned %v; want an error naming cut.png", err)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// cubeLUT is a color lookup table read from an Adobe/Resolve .cube file. It is
+// either one-dimensional, mapping each channel on its own, or three-dimensional,
+// mapping every RGB triple.
+type cubeLUT struct {
+	size      int
+	is3D      bool
+	domainMin [3]float64
+	domainMax [3]float64
+	table     [][3]float64
+}
+
+// outputLUT is the table loaded from --apply-lut, or nil.
+var outputLUT *cubeLUT
+
+// loadCubeLUT parses the .cube file at path.
+func loadCubeLUT(path string) (*cubeLUT, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	l := &cubeLUT{domainMax: [3]float64{1, 1, 1}}
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch fields[0] {
+		case "TITLE":
+			continue
+		case "LUT_1D_SIZE", "LUT_3D_SIZE":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %v: %v takes a single size", line, fields[0])
+			}
+			n, err := strconv.Atoi(fields[1])
+			if err != nil || n < 2 {
+				return nil, fmt.Errorf("line %v: invalid %v %q", line, fields[0], fields[1])
+			}
+			l.size, l.is3D = n, fields[0] == "LUT_3D_SIZE"
+			continue
+		case "DOMAIN_MIN", "DOMAIN_MAX":
+			v, err := parseTriple(fields[1:])
+			if err != nil {
+				return nil, fmt.Errorf("line %v: invalid %v: %v", line, fields[0], err)
+			}
+			if fields[0] == "DOMAIN_MIN" {
+				l.domainMin = v
+			} else {
+				l.domainMax = v
+			}
+			continue
+		}
+		v, err := parseTriple(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", line, err)
+		}
+		l.table = append(l.table, v)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if l.size == 0 {
+		return nil, fmt.Errorf("missing LUT_1D_SIZE or LUT_3D_SIZE")
+	}
+	want := l.size
+	if l.is3D {
+		want = l.size * l.size * l.size
+	}
+	if len(l.table) != want {
+		return nil, fmt.Errorf("expected %v table entries, found %v", want, len(l.table))
+	}
+	for ch := range l.domainMin {
+		if l.domainMax[ch] <= l.domainMin[ch] {
+			return nil, fmt.Errorf("DOMAIN_MAX must be greater than DOMAIN_MIN")
+		}
+	}
+	return l, nil
+}
+
+func parseTriple(fields []string) ([3]float64, error) {
+	var v [3]float64
+	if len(fields) != 3 {
+		return v, fmt.Errorf("expected 3 values, found %v", len(fields))
+	}
+	for i, f := range fields {
+		n, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return v, err
+		}
+		v[i] = n
+	}
+	return v, nil
+}
+
+// apply maps every pixel of img through the table. Lookups use the straight
+// (non-premultiplied) color, and alpha is left untouched.
+func (l *cubeLUT) apply(img *image.RGBA) *image.RGBA {
+	b := img.Bounds()
+	out := image.NewRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			var in [3]float64
+			for ch, v := range [3]uint16{c.R, c.G, c.B} {
+				// Scale from [0, 1] to the table's [0, size-1] grid coordinates.
+				t := float64(v) / 0xffff
+				t = (t - l.domainMin[ch]) / (l.domainMax[ch] - l.domainMin[ch])
+				in[ch] = math.Min(math.Max(t, 0), 1) * float64(l.size-1)
+			}
+
+			var m [3]float64
+			if l.is3D {
+				m = l.trilinear(in)
+			} else {
+				m = l.linear(in)
+			}
+			r, _ := clampChannel(m[0] * 0xffff)
+			g, _ := clampChannel(m[1] * 0xffff)
+			bl, _ := clampChannel(m[2] * 0xffff)
+			out.Set(x, y, color.NRGBA64{r, g, bl, c.A})
+		}
+	}
+	return out
+}
+
+// linear interpolates each channel of in, given in grid coordinates, along its
+// own column of a 1D table.
+func (l *cubeLUT) linear(in [3]float64) [3]float64 {
+	var out [3]float64
+	for ch, t := range in {
+		i0, f := gridCell(t, l.size)
+		out[ch] = l.table[i0][ch]*(1-f) + l.table[i0+1][ch]*f
+	}
+	return out
+}
+
+// trilinear interpolates in, given in grid coordinates, between the eight
+// surrounding entries of a 3D table. Red varies fastest in the table.
+func (l *cubeLUT) trilinear(in [3]float64) [3]float64 {
+	r0, fr := gridCell(in[0], l.size)
+	g0, fg := gridCell(in[1], l.size)
+	b0, fb := gridCell(in[2], l.size)
+	at := func(r, g, b int) [3]float64 {
+		return l.table[r+l.size*(g+l.size*b)]
+	}
+
+	var out [3]float64
+	for ch := range out {
+		c00 := at(r0, g0, b0)[ch]*(1-fr) + at(r0+1, g0, b0)[ch]*fr
+		c10 := at(r0, g0+1, b0)[ch]*(1-fr) + at(r0+1, g0+1, b0)[ch]*fr
+		c01 := at(r0, g0, b0+1)[ch]*(1-fr) + at(r0+1, g0, b0+1)[ch]*fr
+		c11 := at(r0, g0+1, b0+1)[ch]*(1-fr) + at(r0+1, g0+1, b0+1)[ch]*fr
+		c0 := c00*(1-fg) + c10*fg
+		c1 := c01*(1-fg) + c11*fg
+		out[ch] = c0*(1-fb) + c1*fb
+	}
+	return out
+}
+
+// gridCell splits grid coordinate t into the index of the cell's lower entry
+// and the fraction of the way to the upper entry, keeping the upper entry in
+// range at the top edge.
+func gridCell(t float64, size int) (int, float64) {
+	i := int(t)
+	if i >= size-1 {
+		return size - 2, 1
+	}
+	return i, t - float64(i)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeCube writes a .cube file with the given contents and returns its path.
+func writeCube(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "grade.cube")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestLoadCubeLUT checks that well-formed 1D and 3D tables parse, including
+// comments, titles and domains, and that malformed ones are refused with the
+// reason.
+func TestLoadCubeLUT(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		wantErr  string
+	}{
+		{"1D", "TITLE \"invert\"\n# comment\nLUT_1D_SIZE 2\n1 1 1\n0 0 0\n", ""},
+		{"3D with domain", "LUT_3D_SIZE 2\nDOMAIN_MIN 0 0 0\nDOMAIN_MAX 1 1 1\n" + strings.Repeat("0.5 0.5 0.5\n", 8), ""},
+		{"no size", "0 0 0\n1 1 1\n", "missing LUT_1D_SIZE"},
+		{"size too small", "LUT_1D_SIZE 1\n0 0 0\n", "invalid LUT_1D_SIZE"},
+		{"too few entries", "LUT_3D_SIZE 2\n" + strings.Repeat("0 0 0\n", 7), "expected 8 table entries, found 7"},
+		{"two values", "LUT_1D_SIZE 2\n0 0\n1 1 1\n", "line 2: expected 3 values"},
+		{"not a number", "LUT_1D_SIZE 2\n0 0 x\n1 1 1\n", "line 2:"},
+		{"empty domain", "LUT_1D_SIZE 2\nDOMAIN_MIN 1 0 0\n0 0 0\n1 1 1\n", "DOMAIN_MAX must be greater"},
+	}
+	for _, tc := range tests {
+		_, err := loadCubeLUT(writeCube(t, tc.contents))
+		switch {
+		case tc.wantErr == "" && err != nil:
+			t.Errorf("%v: loadCubeLUT failed: %v", tc.name, err)
+		case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+			t.Errorf("%v: loadCubeLUT returned %v; want an error containing %q", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+// TestCubeLUTApply grades one translucent pixel through a 1D table that
+// inverts every channel, a 3D table that swaps red and green, and a 1D
+// identity over half the domain. All three are linear, so interpolation
+// between the entries reproduces them exactly, and alpha is kept.
+func TestCubeLUTApply(t *testing.T) {
+	var swap strings.Builder
+	swap.WriteString("LUT_3D_SIZE 2\n")
+	for b := 0; b < 2; b++ {
+		for g := 0; g < 2; g++ {
+			for r := 0; r < 2; r++ {
+				fmt.Fprintf(&swap, "%v %v %v\n", g, r, b)
+			}
+		}
+	}
+	tests := []struct {
+		name     string
+		contents string
+		want     color.NRGBA
+	}{
+		{"invert", "LUT_1D_SIZE 2\n1 1 1\n0 0 0\n", color.NRGBA{191, 127, 0, 128}},
+		{"swap red and green", swap.String(), color.NRGBA{128, 64, 255, 128}},
+		{"half domain", "LUT_1D_SIZE 2\nDOMAIN_MAX 0.5 0.5 0.5\n0 0 0\n1 1 1\n", color.NRGBA{128, 255, 255, 128}},
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	img.Set(0, 0, color.NRGBA{64, 128, 255, 128})
+	in := color.NRGBAModel.Convert(img.At(0, 0)).(color.NRGBA)
+	for _, tc := range tests {
+		l, err := loadCubeLUT(writeCube(t, tc.contents))
+		if err != nil {
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+		got := color.NRGBAModel.Convert(l.apply(img).At(0, 0)).(color.NRGBA)
+		if got.A != in.A || absDiff(got.R, tc.want.R) > 2 || absDiff(got.G, tc.want.G) > 2 || absDiff(got.B, tc.want.B) > 2 {
+			t.Errorf("%v: graded %v to %v; want about %v", tc.name, in, got, tc.want)
+		}
+	}
+}
+
+func absDiff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"log"
+	"math"
+	"sort"
+
+	"github.com/montanaflynn/stats"
+)
+
+// writeMAD implements --mad-output. It writes a grayscale image of the median
+// absolute deviation of every pixel's samples across images, averaged over
+// the R, G and B channels. Unlike the standard deviation, the MAD ignores a
+// minority of outlying samples, so it shows where the inputs genuinely
+// disagree rather than where one of them is unusual. The image is scaled so
+// the largest MAD is white, and that MAD is logged.
+//
+// The samples are those mergeImages would combine, chosen by --regions and
+// --reject-saturated and weighted by --weights and --weighted-by-sharpness,
+// except that --max-samples-per-pixel does not thin them. A pixel no input
+// covers is black.
+func writeMAD(path string, images []image.Image) error {
+	bounds := images[0].Bounds()
+	weights := sampleWeights(images)
+	mads := make([]float64, 0, bounds.Dx()*bounds.Dy())
+	largest := 0.0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			samples, ok := pixelSamples(x, y, images, colors)
+			m := 0.0
+			if ok {
+				m = sampleMAD(samples, weights(x, y))
+			}
+			mads = append(mads, m)
+			if m > largest {
+				largest = m
+			}
+		}
+	}
+
+	out := image.NewGray16(bounds)
+	if largest > 0 {
+		for k, m := range mads {
+			out.SetGray16(bounds.Min.X+k%bounds.Dx(), bounds.Min.Y+k/bounds.Dx(), color.Gray16{uint16(m / largest * 0xffff)})
+		}
+	}
+	path, err := writeImage(path, out)
+	if err != nil {
+		return err
+	}
+	log.Printf("wrote --mad-output %v; white is a MAD of %.2f on the 0-255 scale", path, largest/0x101)
+	return nil
+}
+
+// sampleMAD is the mean of the R, G and B median absolute deviations of
+// colors, each sample weighted by the matching entry of ws unless ws is nil.
+func sampleMAD(colors []color.Color, ws []float64) float64 {
+	var chans [3][]float64
+	for _, c := range colors {
+		r, g, b, _ := c.RGBA()
+		chans[0] = append(chans[0], float64(r))
+		chans[1] = append(chans[1], float64(g))
+		chans[2] = append(chans[2], float64(b))
+	}
+	sum := 0.0
+	for _, xs := range chans {
+		m, err := weightedMAD(xs, ws)
+		if err != nil {
+			continue
+		}
+		sum += m
+	}
+	return sum / 3
+}
+
+// weightedMAD returns the median absolute deviation of xs, taking both
+// medians with weightedMedian. A nil ws weights every value the same.
+func weightedMAD(xs, ws []float64) (float64, error) {
+	if ws == nil {
+		return stats.MedianAbsoluteDeviation(xs)
+	}
+	m, err := weightedMedian(xs, ws)
+	if err != nil {
+		return math.NaN(), err
+	}
+	devs := make([]float64, len(xs))
+	for i, x := range xs {
+		devs[i] = math.Abs(x - m)
+	}
+	return weightedMedian(devs, ws)
+}
+
+// weightedMedian returns the value of xs with half of the weight ws below it
+// and half above, averaging the two values either side when the weight splits
+// exactly between them, so equal weights give the plain median. Like
+// weightedMean, it falls back to the plain median if the weights sum to zero.
+func weightedMedian(xs, ws []float64) (float64, error) {
+	if len(xs) == 0 {
+		return math.NaN(), errEmptyInput
+	}
+	order := make([]int, len(xs))
+	total := 0.0
+	for i := range order {
+		order[i] = i
+		total += ws[i]
+	}
+	if total == 0 {
+		return stats.Median(xs)
+	}
+	sort.Slice(order, func(a, b int) bool { return xs[order[a]] < xs[order[b]] })
+	below := 0.0
+	for k, i := range order {
+		below += ws[i]
+		if below > total/2 {
+			return xs[i], nil
+		}
+		if below == total/2 {
+			// Skip the weightless values to find the next one up.
+			for _, j := range order[k+1:] {
+				if ws[j] > 0 {
+					return (xs[i] + xs[j]) / 2, nil
+				}
+			}
+			return xs[i], nil
+		}
+	}
+	return xs[order[len(order)-1]], nil
+}
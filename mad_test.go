@@ -0,0 +1,83 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"path/filepath"
+	"testing"
+
+	"github.com/montanaflynn/stats"
+)
+
+// TestMADFollowsRegions checks that --mad-output only measures the samples of
+// the images whose --regions rectangle covers a pixel, as the merge does.
+func TestMADFollowsRegions(t *testing.T) {
+	defer func(r []image.Rectangle) { inputRegions = r }(inputRegions)
+
+	// Both pixels see 0, 0, 100 and 100, a MAD of 50. Leaving out the first
+	// image at x=1 leaves 0, 100 and 100, whose MAD is 0.
+	images := make([]image.Image, 4)
+	for i := range images {
+		img := image.NewGray(image.Rect(0, 0, 2, 1))
+		v := uint8(0)
+		if i >= 2 {
+			v = 100
+		}
+		img.SetGray(0, 0, color.Gray{v})
+		img.SetGray(1, 0, color.Gray{v})
+		images[i] = img
+	}
+
+	for _, tc := range []struct {
+		name    string
+		regions []image.Rectangle
+		want    [2]uint8
+	}{
+		{"all", nil, [2]uint8{255, 255}},
+		{"regions", []image.Rectangle{image.Rect(0, 0, 1, 1), image.Rect(0, 0, 2, 1), image.Rect(0, 0, 2, 1), image.Rect(0, 0, 2, 1)}, [2]uint8{255, 0}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inputRegions = tc.regions
+			path := filepath.Join(t.TempDir(), "mad.png")
+			if err := writeMAD(path, images); err != nil {
+				t.Fatal(err)
+			}
+			out, err := decodeFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for x, want := range tc.want {
+				if got := color.GrayModel.Convert(out.At(x, 0)).(color.Gray).Y; got != want {
+					t.Errorf("x=%v = %v; want %v", x, got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestWeightedMedian checks weightedMedian against the plain median for equal
+// weights, and that a heavy or weightless value moves it.
+func TestWeightedMedian(t *testing.T) {
+	for _, xs := range [][]float64{{3}, {1, 2}, {5, 1, 3}, {4, 1, 3, 2}} {
+		ws := make([]float64, len(xs))
+		for i := range ws {
+			ws[i] = 2
+		}
+		want, _ := stats.Median(xs)
+		if got, err := weightedMedian(xs, ws); err != nil || got != want {
+			t.Errorf("weightedMedian(%v) with equal weights = %v, %v; want %v", xs, got, err, want)
+		}
+	}
+	for _, tc := range []struct {
+		xs, ws []float64
+		want   float64
+	}{
+		{[]float64{1, 2, 3}, []float64{1, 1, 5}, 3},
+		{[]float64{1, 2, 3, 4}, []float64{1, 1, 0, 2}, 3},
+		{[]float64{1, 2, 3}, []float64{0, 0, 0}, 2},
+	} {
+		if got, err := weightedMedian(tc.xs, tc.ws); err != nil || got != tc.want {
+			t.Errorf("weightedMedian(%v, %v) = %v, %v; want %v", tc.xs, tc.ws, got, err, tc.want)
+		}
+	}
+}
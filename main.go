@@ -7,87 +7,1061 @@
 //   The average of the remaining pixels is used to set the output pixel's color.
 //
 // Usage:
-//   go run main.go \
+//   go run . \
 //    --path=Demo/Input/*.jpeg \
 //    --output=Demo/output.jpeg
 package main
 
 import (
+	"crypto/sha256"
+	"errors"
 	"flag"
 	"fmt"
 	"image"
+	"io"
 	"log"
+	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
-
-	"github.com/montanaflynn/stats"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"image/color"
-	"image/jpeg"
 )
 
 var pathFlag = flag.String("path", "", "Path to files which supports glob formatting. Ex: 'Captchas/*.jpeg'.")
-var outFlag = flag.String("output", "", "Name of the output file. Must end in '.jpeg'.")
+var tarFlag = flag.String("tar", "", "Read the inputs from the image members of this tar or gzipped tar archive instead of --path.")
+var skipErrorsFlag = flag.Bool("skip-errors", false, "With --tar, log and skip archive members that are not supported images instead of failing.")
+var outFlag = flag.String("output", "", "Name of the output file. Written as PNG if it ends in '.png', as GIF if it ends in '.gif' and as JPEG otherwise.")
+var base64Flag = flag.Bool("base64", false, "Write the result to stdout as a base64 data URI instead of to a file. Same as --output=data:.")
+var formatFlag = flag.String("format", "png", "Encoding of the data URI written by --base64 or --output=data: ('png', 'jpeg' or 'gif').")
+var paletteColorsFlag = flag.Int("palette-colors", 256, "Number of colors, from 1 to 256, in the palette of GIF output.")
+var gifDitherFlag = flag.Bool("gif-dither", false, "Map GIF output onto its palette with Floyd-Steinberg error diffusion instead of the nearest color, which reduces banding on smooth gradients.")
+var outputTemplateFlag = flag.String("output-template", "", "Output file name with {count}, {n}, {mode} and {date} expanded. Ex: 'avg_{mode}_n{n}_{count}img.jpeg'. Overrides --output.")
+var resumeSafeFlag = flag.Bool("resume-safe", false, "Write each output image that would overwrite an existing file under the next free numbered name, such as avg_1.jpeg, and log the name chosen. --force turns this off.")
+var mergeMetadataFlag = flag.String("merge-metadata-strategy", "none", "EXIF metadata to write into JPEG output: 'none', 'first' to copy the first input's, or 'common' for only the fields with the same value in every input.")
+var gpsAverageFlag = flag.Bool("merge-exif-gps-average", false, "Write the mean GPS position of the geotagged JPEG inputs into the EXIF metadata of JPEG output.")
+var preserveDPIFlag = flag.Bool("preserve-dpi", false, "Write the resolution recorded in the first input, from a PNG pHYs chunk or JPEG JFIF header, into PNG and JPEG output.")
+var grayTransparencyFlag = flag.Bool("preserve-gray-transparency", false, "Write the result of grayscale inputs as a 16-bit grayscale PNG plus a separate '_alpha' 16-bit grayscale PNG of its alpha, instead of one RGBA PNG. Every input must be gray.")
+var premultipliedFlag = flag.Bool("output-premultiplied", false, "Store premultiplied rather than straight alpha in PNG output. PNG readers expect straight alpha, so only set this for consumers that want premultiplied data.")
 var nFlag = flag.Float64("N", 1.3, "Strength of the pixel rejection, measured in multiples of standard deviation.")
+var nMapFlag = flag.String("n-map", "", "Grayscale image, the same size as the inputs, whose brightness scales --N at each pixel. Mid-gray (128) leaves --N unchanged, white almost doubles it and black makes it 0.")
+var rejectIsolatedFlag = flag.Bool("reject-isolated", false, "Treat pixels where only a single sample survives the filter the same as pixels where none survive, following --on-empty.")
+var streamingFlag = flag.Bool("streaming", false, "Read the inputs twice from disk, holding one decoded image at a time, instead of loading them all into memory.")
+var filterFlag = flag.String("filter", "stddev", "How --mode=sigma rejects samples: 'stddev' uses --N everywhere, 'adaptive' scales --N by the local image detail, 'spatiotemporal' measures deviation from all samples in the surrounding --neighborhood, 'largest-cluster' averages only the biggest group of similar values in each channel, 'gradient-direction' (experimental) rejects samples whose local edge direction disagrees with the other frames.")
+var twoStageFlag = flag.Bool("two-stage", false, "With --mode=sigma, reject samples against statistics computed on a coarse grid of pixels and interpolated, instead of computing them at every pixel.")
+var twoStageFactorFlag = flag.Int("two-stage-factor", 4, "With --two-stage, the spacing in pixels of the coarse grid.")
+var clusterGapFlag = flag.Float64("cluster-gap", 0.05, "With --filter=largest-cluster, the gap between neighboring sample values, as a fraction of the full range, that splits them into separate clusters.")
+var filterPerChannelFlag = flag.String("filter-per-channel", "", "With --mode=sigma, combine each channel on its own with 'stddev', 'median' or 'none' (a plain mean). Channels not listed use stddev. Ex: 'R:stddev,G:stddev,B:median,A:none'.")
+var gradientToleranceFlag = flag.Float64("gradient-tolerance", 30, "With --filter=gradient-direction, how many degrees a sample's edge direction may differ from the consensus before it is rejected.")
+var neighborhoodFlag = flag.Int("neighborhood", 3, "Width of the square neighborhood used by --filter=spatiotemporal. Must be odd.")
+var modeFlag = flag.String("mode", "sigma", "How each pixel's samples are combined: 'sigma' (mean after standard deviation rejection), 'mean', or 'median'. 'difference-amplify' instead writes how images differ from the sigma average, and 'flatten-layers' composites the inputs as layers.")
+var layerOpacityFlag = flag.String("layer-opacity", "", "With --mode=flatten-layers, comma separated opacity from 0 to 1 for each input, listed in sorted path order like --weights. Ex: '1,0.5,0.25'.")
+var mergeOrderFlag = flag.String("merge-order", "", "Process the inputs in this order instead of sorted path order: 'name', 'reverse-name', 'mtime' or 'reverse-mtime'.")
+var amplifyFlag = flag.Float64("amplify", 4, "With --mode=difference-amplify, how much to scale each image's difference from the average.")
+var referenceFlag = flag.String("reference", "", "With --mode=difference-amplify, the only image to compare against the average. By default every input is compared.")
+var sharpnessFlag = flag.Bool("weighted-by-sharpness", false, "With --mode=sigma, weight each surviving sample by how sharp its image is around that pixel.")
+var weightsFlag = flag.String("weights", "", "Comma separated weight for each input, in the sorted order the inputs are merged, for --mode=sigma and --mode=mean. Ex: '1,1,2'.")
+var verifyWeightsSumFlag = flag.Bool("verify-weights-sum", false, "Fail on negative --weights, and normalize them with a warning unless they sum to 1.")
+var decoupleAlphaFlag = flag.Bool("decouple-alpha", false, "With --mode=sigma, reject outliers in color and in alpha separately, so a sample with unusual alpha can still contribute its color and vice versa.")
+var validateAlphaFlag = flag.Bool("validate-alpha-consistency", false, "Before merging, fail if some inputs are fully opaque and others have transparency, listing which are which.")
+var regionsFlag = flag.String("regions", "", "Manifest of 'path x y width height' lines giving the rectangle each input is valid within. Outside it the input contributes no samples. Inputs not listed are valid everywhere.")
+var rejectSaturatedFlag = flag.Int("reject-saturated", 0, "Drop samples with a red, green or blue channel within this distance of 0 or 65535, on the 16-bit scale, before combining. Ex: '500'. Zero keeps them.")
+var distanceWeightedFlag = flag.Bool("distance-weighted", false, "With --mode=sigma, weight each surviving sample by how close it is to the mean, falling to zero at the --N threshold, instead of weighting survivors equally.")
+var weightedFilterFlag = flag.Bool("weighted-filter", false, "With --weights or --weighted-by-sharpness, center and scale the rejection on the weighted mean and weighted standard deviation instead of the unweighted ones.")
+var compareModesFlag = flag.Bool("compare-modes", false, "Write one output per mode, named by inserting '_<mode>' before the output's extension.")
+var identicalFastPathFlag = flag.Bool("preserve-exact-when-identical", true, "Skip the statistics for pixels whose samples are all identical and output that exact value.")
+var precisionFlag = flag.String("precision", "float64", "With --streaming, the type of the per-pixel running sums: 'float64', or 'float32' to halve their memory at some cost in accuracy.")
+var onSizeChangeFlag = flag.String("on-size-change", "abort", "With --streaming, what to do with an input whose size differs from the first: 'abort' the run, or 'skip' the file with a warning.")
+var checkpointOutFlag = flag.String("checkpoint-output", "", "With --streaming, periodically write the running average to this file.")
+var checkpointEveryFlag = flag.Int("checkpoint-every", 10, "Number of images between writes of --checkpoint-output.")
+var applyLUTFlag = flag.String("apply-lut", "", "Grade the output with this 1D or 3D .cube LUT before it is written.")
+var confidenceAlphaFlag = flag.Bool("confidence-alpha", false, "Scale each output pixel's alpha by the fraction of its samples that survived the filter.")
+var accumulateFlag = flag.String("accumulate", "", "Fold the inputs into this earlier --mode=sigma or --mode=mean output, weighted by the input count in its '.count' sidecar, and write the output's own '.count' and full-precision '.mean' sidecars. If the file does not exist yet, a new running average is started. Ex: --accumulate=avg.png --output=avg.png.")
+var backgroundImageFlag = flag.String("background-image", "", "Composite the output over this image, which must be the same size as the inputs, wherever the output is not fully opaque.")
+var trimBoundsFlag = flag.Bool("trim-bounds", false, "Crop away borders of one uniform color, or of full transparency, from the output.")
+var scaleOutputFlag = flag.String("scale-output", "", "Resize the output to this size, given as WxH, before it is written.")
+var scaleOutputFactorFlag = flag.Float64("scale-output-factor", 0, "Resize the output by this factor before it is written. Ex: 0.5 halves each side.")
+var pixelAspectFlag = flag.String("pixel-aspect", "", "Aspect ratio of the input pixels, given as W:H, to correct to square pixels by stretching the output. Ex: '4:3'.")
+var resampleFilterFlag = flag.String("resample-filter", "auto", "Filter used when resizing: 'nearest', 'bilinear', 'catmull-rom', 'lanczos', or 'auto' for nearest on whole-number downscales and catmull-rom otherwise.")
+var sourceMapFlag = flag.String("source-map", "", "Write a false-color image where each pixel's color identifies the input whose sample is closest to the output there. The colors are logged.")
+var madOutputFlag = flag.String("mad-output", "", "Write a grayscale image of each pixel's median absolute deviation across the inputs, scaled so the largest is white.")
+var reportOutliersFlag = flag.Bool("report-outlier-images", false, "With --mode=sigma, print a table ranking the inputs by how many pixels rejected their sample, to find inputs that don't belong.")
+var rejectReportFlag = flag.String("reject-report-image", "", "Write an image that overlays a heat color showing how many samples were rejected at each pixel on a dimmed copy of the output.")
+var templateFlag = flag.String("template", "first", "How strictly inputs must match the first image: 'first' only requires the same size, 'strict' also requires the same format and color model and reports every mismatch before processing.")
+var forceDimensionsFlag = flag.String("force-dimensions", "", "Fail before processing unless every input is exactly this size, given as WxH. Ex: '1920x1080'.")
+var colorClipWarningFlag = flag.Bool("color-clip-warning", false, "Report how many output pixels had a channel clamped to the displayable range.")
+var statsEngineFlag = flag.String("stats-engine", "internal", "Implementation of the per-pixel mean and standard deviation: 'internal', or 'montanaflynn' to use github.com/montanaflynn/stats for comparison.")
+var probeFlag = flag.Bool("probe", false, "Print the format, color model and effective bit depth of every input, then exit without merging.")
+var jsonSummaryFlag = flag.Bool("json-summary", false, "Print a JSON summary of the inputs, options, results and timing to stdout once the run completes. Logs always go to stderr.")
+var dedupeFlag = flag.Bool("deduplicate-identical", false, "Keep only the first of any input files with byte-identical contents.")
+var pixelReportFlag = flag.Bool("pixel-format-report", false, "Print a table to stderr of how the output pixels were produced and how many samples survived at each.")
+var histogramOutFlag = flag.String("histogram-output", "", "Write per-channel histograms of the output: as CSV for '.csv', JSON for '.json', otherwise as a chart image.")
+var rowStatsFlag = flag.String("row-stats", "", "Write a CSV file with each output row's mean brightness, mean number of surviving samples and mean sample standard deviation.")
+var safeModeFlag = flag.Bool("safe-mode", false, "Before merging, check that every input decodes and matches in size, estimate memory and run time, then print the plan and ask for confirmation.")
+var forceFlag = flag.Bool("force", false, "Let --safe-mode and --resume-safe overwrite existing output files.")
+var partialOnInterruptFlag = flag.Bool("partial-on-interrupt", false, "On SIGINT or SIGTERM, finish the current row, write what has been merged so far, and exit with status 3.")
+var pixelTimeoutFlag = flag.Duration("pixel-reducer-timeout", 0, "Give up on any pixel whose samples take longer than this to combine, leave it transparent and log its coordinate. Zero waits for every pixel. Ex: '50ms'.")
+var baselineFlag = flag.String("baseline", "", "After writing the output, report its PSNR, SSIM and largest channel difference against this previously saved image.")
+var toleranceFlag = flag.String("tolerance", "", "With --baseline, exit with an error unless the output is within these limits. Ex: 'psnr=40,ssim=0.99,max-delta=2'.")
+var inputOrderFlag = flag.String("input-order", "sorted", "Order inputs are processed in: 'sorted' by path, or 'shuffle' for a random order chosen by --seed.")
+var seedFlag = flag.Int64("seed", 0, "Seed for --input-order=shuffle and --max-samples-per-pixel. Without it a seed is picked from the clock and logged.")
+var maxSamplesFlag = flag.Int("max-samples-per-pixel", 0, "With --mode=sigma, mean or median, combine a random sample of at most this many inputs at each pixel instead of all of them. Zero keeps every input.")
+var selfTestFlag = flag.Bool("self-test", false, "Merge synthetic inputs with known exact answers, report whether this build reproduces them, and exit. Other flags are ignored.")
+var progressETAFlag = flag.Bool("progress-eta", false, "Log the percentage of scanlines merged, with an estimate of the time left, every few seconds.")
+var strictProgressFlag = flag.Bool("strict-monotonic-progress", false, "With --progress-eta and --merge-workers, report the share of rows every worker has reached instead of the total merged, so the percentage never runs ahead of the slowest strip.")
+var verboseFlag = flag.Bool("verbose", false, "Log additional detail about the run.")
+var maskOutputFlag = flag.String("mask-output", "", "Write a grayscale mask that is white where the output pixel was averaged from at least one sample, and black where it was left empty, such as by --on-empty=transparent.")
+var onEmptyFlag = flag.String("on-empty", "fail", "What to do with an output pixel where the filter rejected every sample: 'fail' the run, or leave the pixel 'transparent'.")
+var decodeFormatFlag = flag.String("decode-format-override", "", "Decode every image file as this format, 'png', 'jpeg' or 'gif', instead of detecting the format from its contents.")
+var decodeBudgetFlag = flag.Int64("decode-memory-budget", 0, "Decode images concurrently while keeping the estimated size of in-flight decodes under this many MiB. Zero decodes one image at a time.")
+var lazyDecodeFlag = flag.Bool("lazy-decode", false, "Decode non-interlaced PNG inputs a row at a time as the merge reaches them, instead of whole up front.")
+var mergeWorkersFlag = flag.Int("merge-workers", 1, "Merge this many strips of rows in parallel, each on its own goroutine. 1 merges on a single goroutine.")
+var stripAlignedFlag = flag.Bool("strip-cache-line-aligned", false, "Pad each output row to a whole number of 64-byte cache lines, so --merge-workers strips never write to the same line.")
+var noDecodeLimitFlag = flag.Bool("no-decode-limit", false, "Decode images however large their headers say they are, instead of refusing any over 2 GiB decoded. Only for inputs you trust.")
+var inputCacheFlag = flag.Int64("input-cache-memory", 0, "Keep decoded inputs in a least-recently-used cache of up to this many MiB, so files read more than once, such as by --streaming's two passes or --safe-mode, are decoded once. Zero disables the cache.")
 
 func main() {
 	flag.Parse()
+	start := time.Now()
+
+	if *selfTestFlag {
+		if err := selfTest(os.Stdout); err != nil {
+			log.Fatalf("--self-test: %v", err)
+		}
+		return
+	}
+
+	switch *decodeFormatFlag {
+	case "", "png", "jpeg", "gif":
+	default:
+		log.Fatalf("unknown --decode-format-override %q; must be 'png', 'jpeg' or 'gif'", *decodeFormatFlag)
+	}
+
+	if *grayTransparencyFlag {
+		if *premultipliedFlag {
+			log.Fatalf("unsupported operation; --preserve-gray-transparency cannot be used with --output-premultiplied")
+		}
+		if *outputTemplateFlag == "" && strings.ToLower(filepath.Ext(*outFlag)) != ".png" {
+			log.Fatalf("unsupported operation; --preserve-gray-transparency writes PNG, so --output must end in .png")
+		}
+	}
+
+	if *noDecodeLimitFlag {
+		log.Printf("WARNING: --no-decode-limit is set; images are decoded however large their headers claim, so a corrupt or hostile file can exhaust memory")
+	}
+
+	var paths []string
+	var err error
+	switch {
+	case *tarFlag != "" && *pathFlag != "":
+		log.Fatalf("--tar and --path cannot be combined")
+	case *tarFlag != "":
+		tarInput, paths, err = openTar(*tarFlag, *skipErrorsFlag)
+		if err != nil {
+			log.Fatalf("failed to read --tar: %v", err)
+		}
+		if len(paths) == 0 {
+			log.Fatalf("no images found in archive: %v", *tarFlag)
+		}
+	default:
+		paths, err = resolvePaths(*pathFlag)
+		if err != nil {
+			log.Fatalf("failed to parse path: %v", err)
+		}
+		if len(paths) == 0 {
+			log.Fatalf("no files found for path: %v", *pathFlag)
+		}
+	}
+	allPaths := paths
+	if *dedupeFlag {
+		var dropped int
+		paths, dropped, err = deduplicatePaths(paths)
+		if err != nil {
+			log.Fatalf("failed to deduplicate inputs: %v", err)
+		}
+		log.Printf("dropped %v duplicate input files, keeping %v", dropped, len(paths))
+	}
+	paths, err = mergeOrder(paths, *mergeOrderFlag)
+	if err != nil {
+		log.Fatalf("invalid --merge-order: %v", err)
+	}
+	switch *inputOrderFlag {
+	case "sorted":
+	case "shuffle":
+		if *mergeOrderFlag != "" {
+			log.Fatalf("unsupported operation; --input-order=shuffle cannot be combined with --merge-order")
+		}
+		seed := runSeed("shuffling inputs")
+		paths = shufflePaths(paths, seed)
+	default:
+		log.Fatalf("unknown --input-order %q; must be 'sorted' or 'shuffle'", *inputOrderFlag)
+	}
+	if *weightsFlag != "" {
+		inputWeights, err = parseWeights(*weightsFlag, allPaths, paths)
+		if err != nil {
+			log.Fatalf("invalid --weights: %v", err)
+		}
+		if *modeFlag != "sigma" && *modeFlag != "mean" && *modeFlag != "difference-amplify" || *compareModesFlag || *streamingFlag {
+			log.Fatalf("unsupported operation; --weights only supports --mode=sigma, --mode=mean and --mode=difference-amplify, without --compare-modes or --streaming")
+		}
+	}
+	if *layerOpacityFlag != "" {
+		if *modeFlag != "flatten-layers" {
+			log.Fatalf("unsupported operation; --layer-opacity requires --mode=flatten-layers")
+		}
+		layerOpacities, err = parseWeights(*layerOpacityFlag, allPaths, paths)
+		if err == nil {
+			err = checkOpacities(layerOpacities)
+		}
+		if err != nil {
+			log.Fatalf("invalid --layer-opacity: %v", err)
+		}
+	}
+	if *modeFlag == "flatten-layers" && (*compareModesFlag || *regionsFlag != "" || *rejectSaturatedFlag != 0 || inputWeights != nil) {
+		log.Fatalf("unsupported operation; --mode=flatten-layers needs every layer at every pixel, so it cannot be used with --compare-modes, --regions, --reject-saturated or --weights")
+	}
+	if *verifyWeightsSumFlag {
+		if inputWeights == nil {
+			log.Fatalf("unsupported operation; --verify-weights-sum requires --weights")
+		}
+		inputWeights, err = verifyWeightsSum(inputWeights)
+		if err != nil {
+			log.Fatalf("failed --verify-weights-sum: %v", err)
+		}
+	}
+	if *outFlag == dataOutput {
+		*base64Flag = true
+	}
+	if *base64Flag {
+		if *formatFlag != "png" && *formatFlag != "jpeg" && *formatFlag != "gif" {
+			log.Fatalf("unknown --format %q; must be 'png', 'jpeg' or 'gif'", *formatFlag)
+		}
+		if *compareModesFlag || *modeFlag == "difference-amplify" || *jsonSummaryFlag || *probeFlag {
+			log.Fatalf("unsupported operation; a data URI output needs stdout to itself and holds one image, so it cannot be used with --compare-modes, --mode=difference-amplify, --json-summary or --probe")
+		}
+	}
+	if *paletteColorsFlag < 1 || *paletteColorsFlag > 256 {
+		log.Fatalf("invalid --palette-colors %v; must be from 1 to 256", *paletteColorsFlag)
+	}
+	// Catch a bad template before spending time on the merge.
+	outputPath(*modeFlag, len(paths))
+	if *applyLUTFlag != "" {
+		outputLUT, err = loadCubeLUT(*applyLUTFlag)
+		if err != nil {
+			log.Fatalf("failed to load --apply-lut %v: %v", *applyLUTFlag, err)
+		}
+	}
+	if *statsEngineFlag != "internal" && *statsEngineFlag != "montanaflynn" {
+		log.Fatalf("unknown --stats-engine %q; must be 'internal' or 'montanaflynn'", *statsEngineFlag)
+	}
+	switch *templateFlag {
+	case "first":
+	case "strict":
+		if err := checkTemplate(paths); err != nil {
+			log.Fatalf("inputs do not match the first image: %v", err)
+		}
+	default:
+		log.Fatalf("unknown --template %q; must be 'first' or 'strict'", *templateFlag)
+	}
+	if *backgroundImageFlag != "" {
+		backgroundImage, err = loadBackground(*backgroundImageFlag, paths[0])
+		if err != nil {
+			log.Fatalf("failed to load --background-image: %v", err)
+		}
+	}
+	if *accumulateFlag != "" {
+		if *modeFlag != "sigma" && *modeFlag != "mean" || *compareModesFlag || *base64Flag {
+			log.Fatalf("unsupported operation; --accumulate only supports --mode=sigma and --mode=mean, writing one output file")
+		}
+		if outputLUT != nil || backgroundImage != nil || *confidenceAlphaFlag || *trimBoundsFlag || *scaleOutputFlag != "" || *scaleOutputFactorFlag != 0 || *pixelAspectFlag != "" || *premultipliedFlag || *grayTransparencyFlag {
+			log.Fatalf("unsupported operation; --accumulate needs the output to hold the plain average, so it cannot be used with --apply-lut, --background-image, --confidence-alpha, --trim-bounds, --scale-output, --scale-output-factor, --pixel-aspect, --output-premultiplied or --preserve-gray-transparency")
+		}
+		if _, err := os.Stat(*accumulateFlag); os.IsNotExist(err) {
+			log.Printf("--accumulate: %v does not exist yet; starting a new running average", *accumulateFlag)
+		} else {
+			accumulatePrior, accumulateCount, err = loadAccumulate(*accumulateFlag, paths[0])
+			if err != nil {
+				log.Fatalf("failed to load --accumulate: %v", err)
+			}
+		}
+	}
+	if *nMapFlag != "" {
+		nMapScale, err = loadNMap(*nMapFlag, paths[0])
+		if err != nil {
+			log.Fatalf("failed to load --n-map: %v", err)
+		}
+	}
+	if *scaleOutputFlag != "" && *scaleOutputFactorFlag != 0 {
+		log.Fatalf("unsupported operation; use only one of --scale-output and --scale-output-factor")
+	}
+	if *pixelAspectFlag != "" {
+		if *scaleOutputFlag != "" {
+			log.Fatalf("unsupported operation; --scale-output sets the final size, so it cannot be combined with --pixel-aspect")
+		}
+		if _, err := parsePixelAspect(*pixelAspectFlag); err != nil {
+			log.Fatalf("invalid --pixel-aspect: %v", err)
+		}
+	}
+	if *scaleOutputFlag != "" {
+		if _, _, err := parseDimensions(*scaleOutputFlag); err != nil {
+			log.Fatalf("invalid --scale-output: %v", err)
+		}
+	}
+	if _, err := resampler(2, 2, 1, 1); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if *scaleOutputFactorFlag < 0 {
+		log.Fatalf("invalid --scale-output-factor %v; must be positive", *scaleOutputFactorFlag)
+	}
+	if *forceDimensionsFlag != "" {
+		if err := checkDimensions(paths, *forceDimensionsFlag); err != nil {
+			log.Fatalf("failed --force-dimensions check: %v", err)
+		}
+	}
+
+	if *probeFlag {
+		if err := probe(os.Stdout, paths); err != nil {
+			log.Fatalf("failed to probe inputs: %v", err)
+		}
+		return
+	}
+
+	switch *mergeMetadataFlag {
+	case "none":
+	case "first", "common":
+		if outputFormat(outputPath(*modeFlag, len(paths))) != "jpeg" {
+			log.Printf("--merge-metadata-strategy: EXIF metadata is only written into JPEG output")
+		}
+		outputEXIF, err = mergeEXIF(paths, *mergeMetadataFlag)
+		if err != nil {
+			log.Fatalf("--merge-metadata-strategy: %v", err)
+		}
+	default:
+		log.Fatalf("unknown --merge-metadata-strategy %q; must be 'none', 'first' or 'common'", *mergeMetadataFlag)
+	}
+	if *gpsAverageFlag {
+		if outputFormat(outputPath(*modeFlag, len(paths))) != "jpeg" {
+			log.Fatalf("unsupported operation; --merge-exif-gps-average writes EXIF metadata, which is only written into JPEG output")
+		}
+		outputEXIF, err = averageGPS(paths, outputEXIF)
+		if err != nil {
+			log.Fatalf("--merge-exif-gps-average: %v", err)
+		}
+	}
+
+	if *inputCacheFlag > 0 {
+		inputCache = newDecodeCache(*inputCacheFlag << 20)
+		if *verboseFlag {
+			defer func() {
+				log.Printf("input cache: %v hits, %v misses", inputCache.hits, inputCache.misses)
+			}()
+		}
+	}
+
+	if *validateAlphaFlag {
+		if err := checkAlphaConsistency(paths); err != nil {
+			log.Fatalf("--validate-alpha-consistency: %v", err)
+		}
+	}
+	if *preserveDPIFlag {
+		if outputFormat(outputPath(*modeFlag, len(paths))) == "gif" {
+			log.Printf("--preserve-dpi: GIF has no resolution field, so the output is written without one")
+		}
+		res, err := readResolution(paths[0])
+		switch {
+		case err == errNoResolution:
+			log.Printf("--preserve-dpi: %v records no resolution; writing the output without one", paths[0])
+		case err != nil:
+			log.Fatalf("--preserve-dpi: %v", err)
+		default:
+			inputResolution = &res
+			if *verboseFlag {
+				log.Printf("--preserve-dpi: using %.4gx%.4g dpi from %v", res.x, res.y, paths[0])
+			}
+		}
+	}
+	if *modeFlag == "difference-amplify" && !*compareModesFlag && !*resumeSafeFlag {
+		if err := checkDifferencePaths(outputPath(*modeFlag, len(paths)), paths); err != nil {
+			log.Fatalf("unsupported operation; %v", err)
+		}
+	}
+	if *safeModeFlag {
+		if err := safeModePreflight(paths, os.Stdin, os.Stderr); err != nil {
+			log.Fatalf("--safe-mode: %v", err)
+		}
+	}
+
+	if *partialOnInterruptFlag {
+		handleInterrupts()
+	}
+
+	if *jsonSummaryFlag {
+		summary = newRunSummary(paths)
+		defer func() {
+			if err := summary.write(os.Stdout, start); err != nil {
+				log.Fatalf("failed to write --json-summary: %v", err)
+			}
+		}()
+	}
+
+	if *regionsFlag != "" {
+		if *streamingFlag || *filterFlag == "spatiotemporal" || *sharpnessFlag || inputWeights != nil {
+			log.Fatalf("unsupported operation; --regions cannot be used with --streaming, --filter=spatiotemporal, --weighted-by-sharpness or --weights")
+		}
+		inputRegions, err = loadRegions(*regionsFlag, paths)
+		if err != nil {
+			log.Fatalf("failed to load --regions %v: %v", *regionsFlag, err)
+		}
+		h, err := readHeader(paths[0])
+		if err != nil {
+			log.Fatalf("failed to read %v: %v", paths[0], err)
+		}
+		for i, r := range inputRegions {
+			if !r.Overlaps(image.Rect(0, 0, h.width, h.height)) {
+				log.Fatalf("invalid --regions: %v of %v lies outside the %vx%v image", r, paths[i], h.width, h.height)
+			}
+		}
+	}
+	if *rejectSaturatedFlag != 0 {
+		if *rejectSaturatedFlag < 0 || *rejectSaturatedFlag >= 0x8000 {
+			log.Fatalf("invalid --reject-saturated %v; must be between 0 and 32767", *rejectSaturatedFlag)
+		}
+		if *streamingFlag || *filterFlag == "spatiotemporal" || *sharpnessFlag || inputWeights != nil {
+			log.Fatalf("unsupported operation; --reject-saturated cannot be used with --streaming, --filter=spatiotemporal, --weighted-by-sharpness or --weights")
+		}
+	}
+	if *baselineFlag != "" && (*compareModesFlag || *modeFlag == "difference-amplify") {
+		log.Fatalf("unsupported operation; --baseline compares a single output, so it cannot be used with --compare-modes or --mode=difference-amplify")
+	}
+	if *toleranceFlag != "" {
+		if *baselineFlag == "" {
+			log.Fatalf("unsupported operation; --tolerance requires --baseline")
+		}
+		if _, err := parseTolerance(*toleranceFlag); err != nil {
+			log.Fatalf("invalid --tolerance: %v", err)
+		}
+	}
+	if *weightedFilterFlag {
+		if inputWeights == nil && !*sharpnessFlag {
+			log.Fatalf("unsupported operation; --weighted-filter requires --weights or --weighted-by-sharpness")
+		}
+		if *filterFlag == "spatiotemporal" || *decoupleAlphaFlag {
+			log.Fatalf("unsupported operation; --weighted-filter cannot be used with --filter=spatiotemporal or --decouple-alpha")
+		}
+	}
+	if *sourceMapFlag != "" {
+		if *streamingFlag || *modeFlag == "difference-amplify" {
+			log.Fatalf("unsupported operation; --source-map cannot be used with --streaming or --mode=difference-amplify")
+		}
+		logSourceColors(paths)
+	}
+	if *madOutputFlag != "" && *streamingFlag {
+		log.Fatalf("unsupported operation; --mad-output needs every sample at once, so it cannot be used with --streaming")
+	}
+	if *distanceWeightedFlag {
+		if *streamingFlag || *decoupleAlphaFlag || *filterPerChannelFlag != "" || *filterFlag == "largest-cluster" || *filterFlag == "gradient-direction" {
+			log.Fatalf("unsupported operation; --distance-weighted cannot be used with --streaming, --decouple-alpha, --filter-per-channel, --filter=largest-cluster or --filter=gradient-direction")
+		}
+	}
+	if *twoStageFlag {
+		if *streamingFlag || (*filterFlag != "stddev" && *filterFlag != "adaptive") {
+			log.Fatalf("unsupported operation; --two-stage only supports --filter=stddev and --filter=adaptive, without --streaming")
+		}
+		if *decoupleAlphaFlag || *filterPerChannelFlag != "" || *weightedFilterFlag || inputRegions != nil {
+			log.Fatalf("unsupported operation; --two-stage cannot be used with --decouple-alpha, --filter-per-channel, --weighted-filter or --regions")
+		}
+	}
+	if *reportOutliersFlag {
+		if *modeFlag != "sigma" || *compareModesFlag || (*filterFlag != "stddev" && *filterFlag != "spatiotemporal") {
+			log.Fatalf("unsupported operation; --report-outlier-images only supports --mode=sigma with --filter=stddev or --filter=spatiotemporal, without --compare-modes")
+		}
+		if *decoupleAlphaFlag || *filterPerChannelFlag != "" || inputRegions != nil || *rejectSaturatedFlag != 0 || *maxSamplesFlag != 0 {
+			log.Fatalf("unsupported operation; --report-outlier-images cannot be used with --decouple-alpha, --filter-per-channel, --regions, --reject-saturated or --max-samples-per-pixel")
+		}
+	}
+	if *maxSamplesFlag != 0 {
+		if *maxSamplesFlag < 2 {
+			log.Fatalf("invalid --max-samples-per-pixel %v; must be at least 2", *maxSamplesFlag)
+		}
+		if *modeFlag != "sigma" && *modeFlag != "mean" && *modeFlag != "median" {
+			log.Fatalf("unsupported operation; --max-samples-per-pixel only supports --mode=sigma, --mode=mean and --mode=median")
+		}
+		if *streamingFlag || *filterFlag == "spatiotemporal" || *filterFlag == "gradient-direction" || *sharpnessFlag || inputWeights != nil || inputRegions != nil {
+			log.Fatalf("unsupported operation; --max-samples-per-pixel cannot be used with --streaming, --filter=spatiotemporal, --filter=gradient-direction, --weighted-by-sharpness, --weights or --regions")
+		}
+		if *mergeWorkersFlag > 1 {
+			log.Fatalf("unsupported operation; --max-samples-per-pixel draws its samples in pixel order from one generator, so it cannot be used with --merge-workers")
+		}
+		seed := runSeed("sampling inputs")
+		sampleRand = rand.New(rand.NewSource(seed))
+	}
+	if *pixelTimeoutFlag > 0 && *streamingFlag {
+		log.Fatalf("unsupported operation; --pixel-reducer-timeout cannot be used with --streaming")
+	}
+	if *filterPerChannelFlag != "" {
+		if *streamingFlag || *filterFlag == "spatiotemporal" || *decoupleAlphaFlag || *weightedFilterFlag {
+			log.Fatalf("unsupported operation; --filter-per-channel cannot be used with --streaming, --filter=spatiotemporal, --decouple-alpha or --weighted-filter")
+		}
+		channelFilters, err = parseChannelFilters(*filterPerChannelFlag)
+		if err != nil {
+			log.Fatalf("invalid --filter-per-channel: %v", err)
+		}
+	}
+	if *filterFlag == "largest-cluster" && (*clusterGapFlag < 0 || *clusterGapFlag >= 1) {
+		log.Fatalf("invalid --cluster-gap %v; must be at least 0 and less than 1", *clusterGapFlag)
+	}
+	if *filterFlag == "largest-cluster" || *filterFlag == "gradient-direction" {
+		if *decoupleAlphaFlag || *filterPerChannelFlag != "" || *weightedFilterFlag || *nMapFlag != "" {
+			log.Fatalf("unsupported operation; --filter=%v does not use --N, so it cannot be used with --decouple-alpha, --filter-per-channel, --weighted-filter or --n-map", *filterFlag)
+		}
+	}
+	if *filterFlag == "gradient-direction" && (*regionsFlag != "" || *rejectSaturatedFlag != 0) {
+		log.Fatalf("unsupported operation; --filter=gradient-direction needs a sample from every input, so it cannot be used with --regions or --reject-saturated")
+	}
+	if *decoupleAlphaFlag && (*streamingFlag || *filterFlag == "spatiotemporal") {
+		log.Fatalf("unsupported operation; --decouple-alpha cannot be used with --streaming or --filter=spatiotemporal")
+	}
+
+	if *precisionFlag != "float64" && (!*streamingFlag || *precisionFlag != "float32") {
+		log.Fatalf("unsupported operation; --precision must be 'float64' or 'float32', and 'float32' requires --streaming")
+	}
+	switch *onSizeChangeFlag {
+	case "abort":
+	case "skip":
+		if !*streamingFlag {
+			log.Fatalf("unsupported operation; --on-size-change=skip requires --streaming")
+		}
+	default:
+		log.Fatalf("unknown --on-size-change %q; must be 'abort' or 'skip'", *onSizeChangeFlag)
+	}
+	if *onEmptyFlag != "fail" && *onEmptyFlag != "transparent" {
+		log.Fatalf("unknown --on-empty %q; must be 'fail' or 'transparent'", *onEmptyFlag)
+	}
+	if *checkpointOutFlag != "" && (!*streamingFlag || *checkpointEveryFlag <= 0) {
+		log.Fatalf("unsupported operation; --checkpoint-output requires --streaming and a positive --checkpoint-every")
+	}
+
+	if *mergeWorkersFlag < 1 {
+		log.Fatalf("invalid --merge-workers %v; must be at least 1", *mergeWorkersFlag)
+	}
+	if *mergeWorkersFlag > 1 && (*lazyDecodeFlag || *streamingFlag) {
+		log.Fatalf("unsupported operation; --merge-workers cannot be used with --lazy-decode, whose inputs decode one row at a time for a single reader, or with --streaming, which accumulates one input at a time")
+	}
+	if *lazyDecodeFlag && (*streamingFlag || *decodeBudgetFlag > 0 || *tarFlag != "") {
+		log.Fatalf("unsupported operation; --lazy-decode cannot be used with --streaming, --decode-memory-budget or --tar")
+	}
+
+	if *streamingFlag {
+		if *modeFlag != "sigma" || *compareModesFlag || *filterFlag != "stddev" || *sharpnessFlag {
+			log.Fatalf("unsupported operation; --streaming only supports --mode=sigma with --filter=stddev and no --weighted-by-sharpness")
+		}
+		out, kept, merged, err := streamAverage(paths)
+		if err == errInterrupted && out == nil {
+			log.Printf("interrupted before the second pass began; nothing to write")
+			exitAfterInterrupt(start)
+		}
+		if err != nil && err != errInterrupted {
+			log.Fatalf("failed to stream images: %v", err)
+		}
+		finish("sigma", out, kept, merged, outputPath("sigma", merged))
+		if err == errInterrupted {
+			exitAfterInterrupt(start)
+		}
+		return
+	}
+
+	images, err := loadImages(paths)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if *madOutputFlag != "" {
+		if err := writeMAD(*madOutputFlag, images); err != nil {
+			log.Fatalf("failed to write --mad-output: %v", err)
+		}
+	}
+
+	if *compareModesFlag {
+		for _, m := range modeNames {
+			reduce, err := newReducer(m, images)
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+			out, kept, err := mergeImages(images, reduce)
+			if err != nil && err != errInterrupted {
+				log.Fatalf("failed to merge images with --mode=%v: %v", m, err)
+			}
+			finish(m, out, kept, len(images), compareOutputPath(m, len(paths)))
+			if err == errInterrupted {
+				exitAfterInterrupt(start)
+			}
+		}
+		return
+	}
+
+	if *modeFlag == "difference-amplify" {
+		if err := writeDifferences(paths, images); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
+	}
+
+	reduce, err := newReducer(*modeFlag, images)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	countRejections(paths)
+	out, kept, err := mergeImages(images, reduce)
+	if err != nil && err != errInterrupted {
+		log.Fatalf("%v", err)
+	}
+	finish(*modeFlag, out, kept, len(images), outputPath(*modeFlag, len(paths)))
+	if err == errInterrupted {
+		exitAfterInterrupt(start)
+	}
+}
 
-	paths, err := filepath.Glob(*pathFlag)
+// finish writes the merged image for mode to path, along with any reports
+// requested by flags. kept holds the number of samples each output pixel was
+// computed from, in row-major order from out.Bounds().Min, out of total
+// samples per pixel.
+func finish(mode string, out *image.RGBA, kept []int, total int, path string) {
+	if *accumulateFlag != "" {
+		out, accumulateMeans = accumulate(out, kept, total, accumulatePrior, accumulateCount)
+	}
+	if outputLUT != nil {
+		out = outputLUT.apply(out)
+	}
+	if *confidenceAlphaFlag {
+		out = confidenceAlpha(out, kept, total)
+	}
+	if backgroundImage != nil {
+		out = composite(out, backgroundImage)
+	}
+	if *colorClipWarningFlag {
+		logClipping("--mode="+mode, len(kept))
+	}
+	if emptyPixels > 0 {
+		log.Printf("--mode=%v: the filter rejected every sample at %v output pixels, which --on-empty=transparent left empty", mode, emptyPixels)
+	}
+	if timedOutPixels > 0 {
+		log.Printf("--mode=%v: %v output pixels were left empty by --pixel-reducer-timeout", mode, timedOutPixels)
+	}
+	if twoStageFallbacks > 0 {
+		log.Printf("--mode=%v: --two-stage rejected every sample at %v output pixels, which used their own statistics instead", mode, twoStageFallbacks)
+	}
+	if saturatedPixels > 0 {
+		log.Printf("--mode=%v: %v output pixels had only near-saturated samples, which --reject-saturated kept", mode, saturatedPixels)
+	}
+	if *pixelReportFlag {
+		writePixelReport(os.Stderr, mode, kept, total)
+	}
+	if rejectedByInput != nil {
+		writeOutlierReport(os.Stderr, len(kept))
+	}
+	if *sourceMapFlag != "" {
+		p := reportPath(*sourceMapFlag, mode)
+		if _, err := writeImage(p, sourceMap(out.Bounds())); err != nil {
+			log.Fatalf("failed to write --source-map: %v", err)
+		}
+	}
+	if *rejectReportFlag != "" {
+		p := reportPath(*rejectReportFlag, mode)
+		if _, err := writeImage(p, rejectReport(out, kept, total)); err != nil {
+			log.Fatalf("failed to write --reject-report-image: %v", err)
+		}
+	}
+	if *maskOutputFlag != "" {
+		p := reportPath(*maskOutputFlag, mode)
+		if _, err := writeImage(p, validMask(out.Bounds(), kept)); err != nil {
+			log.Fatalf("failed to write --mask-output: %v", err)
+		}
+	}
+	if *rowStatsFlag != "" {
+		p := reportPath(*rowStatsFlag, mode)
+		if err := writeRowStats(p, out, kept); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	if *trimBoundsFlag {
+		out = trimBounds(out)
+	}
+	if *histogramOutFlag != "" {
+		p := reportPath(*histogramOutFlag, mode)
+		if err := writeHistogram(p, out); err != nil {
+			log.Fatalf("failed to write --histogram-output: %v", err)
+		}
+	}
+	final := scaleOutput(out)
+	var err error
+	if *grayTransparencyFlag {
+		path, err = writeGrayTransparency(path, final, out.Bounds())
+	} else {
+		path, err = writeImage(path, withEXIF(withResolution(final, out.Bounds())))
+	}
 	if err != nil {
-		log.Fatalf("failed to parse path: %v", err)
+		log.Fatalf("%v", err)
 	}
-	if len(paths) == 0 {
-		log.Fatalf("no files found for path: %v", *pathFlag)
+	if *accumulateFlag != "" {
+		if err := writeCount(path, total+accumulateCount); err != nil {
+			log.Fatalf("failed to write the --accumulate count: %v", err)
+		}
+		if err := writeMeans(path, accumulateMeans); err != nil {
+			log.Fatalf("failed to write the --accumulate average: %v", err)
+		}
 	}
+	// Record and check the image as written: its name may have been numbered
+	// by --resume-safe, and its size changed by --trim-bounds and
+	// --scale-output.
+	if summary != nil {
+		summary.addResult(mode, path, final.Bounds().Dx(), final.Bounds().Dy(), kept, total)
+	}
+	if *baselineFlag != "" {
+		if err := checkBaseline(os.Stderr, path, final); err != nil {
+			log.Fatalf("failed --baseline check: %v", err)
+		}
+	}
+}
 
-	images := []image.Image{}
+// outputFiles lists the files finish writes for mode with the result going to
+// path: the reports of modeReports, the result itself and its sidecars.
+func outputFiles(mode, path string) []string {
+	files := []string{}
+	for _, report := range modeReports {
+		if *report != "" {
+			files = append(files, reportPath(*report, mode))
+		}
+	}
+	files = append(files, path)
+	if *grayTransparencyFlag {
+		files = append(files, alphaPath(path))
+	}
+	if *accumulateFlag != "" {
+		files = append(files, path+countSuffix, path+meanSuffix)
+	}
+	return files
+}
+
+// resolvePaths expands the glob pattern and drops every match that isn't a
+// regular file, such as directories, sockets and devices. Symlinks are followed.
+//
+// The result is sorted by the bytes of each path, independent of locale and
+// platform, so anything that depends on input order is reproducible.
+// filepath.Glob only sorts within each directory, which differs from a full
+// byte-order sort when the pattern has wildcards in a directory component.
+func resolvePaths(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, m := range matches {
+		info, err := os.Stat(m)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat %v: %v", m, err)
+		}
+		if !info.Mode().IsRegular() {
+			if *verboseFlag {
+				log.Printf("skipping %v: not a regular file", m)
+			}
+			continue
+		}
+		paths = append(paths, m)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// deduplicatePaths drops every file in paths whose contents are byte-identical
+// to an earlier one, returning the remaining paths and how many were dropped.
+func deduplicatePaths(paths []string) ([]string, int, error) {
+	seen := map[[sha256.Size]byte]string{}
+	kept := []string{}
 	for _, p := range paths {
-		f, err := os.Open(p)
+		f, err := openInput(p)
 		if err != nil {
-			log.Fatalf("failed opening %v: %v", p, err)
+			return nil, 0, err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed reading %v: %v", p, err)
 		}
-		defer f.Close()
 
-		i, _, err := image.Decode(f)
+		var sum [sha256.Size]byte
+		copy(sum[:], h.Sum(nil))
+		if first, ok := seen[sum]; ok {
+			if *verboseFlag {
+				log.Printf("skipping %v: identical to %v", p, first)
+			}
+			continue
+		}
+		seen[sum] = p
+		kept = append(kept, p)
+	}
+	return kept, len(paths) - len(kept), nil
+}
+
+// shufflePaths returns a copy of paths in a random order determined by seed.
+func shufflePaths(paths []string, seed int64) []string {
+	out := append([]string(nil), paths...)
+	r := rand.New(rand.NewSource(seed))
+	r.Shuffle(len(out), func(i, j int) {
+		out[i], out[j] = out[j], out[i]
+	})
+	return out
+}
+
+// runSeed returns --seed if it was given, and otherwise a seed from the
+// clock, which it logs along with what it is used for. Any value, zero
+// included, can be given explicitly.
+func runSeed(what string) int64 {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == "seed"
+	})
+	if set {
+		return *seedFlag
+	}
+	seed := time.Now().UnixNano()
+	log.Printf("%v with --seed=%v", what, seed)
+	return seed
+}
+
+// checkDimensions reads the header of every file in paths and fails unless each
+// image is exactly as large as dims, given as "WxH".
+func checkDimensions(paths []string, dims string) error {
+	w, h, err := parseDimensions(dims)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		hdr, err := readHeader(p)
 		if err != nil {
-			log.Fatalf("failed decoding image %v: %v", f, err)
+			return err
+		}
+		if hdr.width != w || hdr.height != h {
+			return fmt.Errorf("%v is %vx%v, expected %vx%v", p, hdr.width, hdr.height, w, h)
 		}
-		images = append(images, i)
+	}
+	return nil
+}
+
+// checkTemplate reads the header of every file in paths and fails unless each
+// has the same format, dimensions and color model as the first. Every
+// nonconforming file is listed in the error, not just the first one found.
+func checkTemplate(paths []string) error {
+	var want imageHeader
+	problems := []string{}
+	for idx, p := range paths {
+		h, err := readHeader(p)
+		if err != nil {
+			return err
+		}
+		if idx == 0 {
+			want = h
+			continue
+		}
+		diffs := []string{}
+		if h.format != want.format {
+			diffs = append(diffs, fmt.Sprintf("format %v instead of %v", h.format, want.format))
+		}
+		if h.width != want.width || h.height != want.height {
+			diffs = append(diffs, fmt.Sprintf("size %vx%v instead of %vx%v", h.width, h.height, want.width, want.height))
+		}
+		if h.model != want.model {
+			diffs = append(diffs, fmt.Sprintf("color model %v instead of %v", h.model, want.model))
+		}
+		if len(diffs) > 0 {
+			problems = append(problems, fmt.Sprintf("%v: %v", p, strings.Join(diffs, ", ")))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%v of %v files differ from %v:\n  %v", len(problems), len(paths), paths[0], strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// parseDimensions parses a size given as "WxH".
+func parseDimensions(dims string) (int, int, error) {
+	var w, h int
+	if _, err := fmt.Sscanf(dims, "%dx%d", &w, &h); err != nil || w <= 0 || h <= 0 {
+		return 0, 0, fmt.Errorf("dimensions %q must look like WxH, e.g. 1920x1080", dims)
+	}
+	return w, h, nil
+}
+
+// loadImages decodes every file in paths into memory and checks that they can
+// be merged together.
+func loadImages(paths []string) ([]image.Image, error) {
+	var images []image.Image
+	var err error
+	if *lazyDecodeFlag {
+		images, err = lazyImages(paths)
+	} else {
+		images, err = decodeImages(paths, *decodeBudgetFlag<<20)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load images: %v", err)
 	}
 
 	bounds := images[0].Bounds()
 	for _, i := range images {
 		if i.Bounds() != bounds {
-			log.Fatalf("unsupported operation; cannot merge images of different sizes: %v, %v", i.Bounds(), bounds)
+			return nil, fmt.Errorf("unsupported operation; cannot merge images of different sizes: %v, %v", i.Bounds(), bounds)
 		}
 	}
-	out := image.NewRGBA(image.Rectangle{bounds.Min, bounds.Max})
-
-	// An image's bounds do not necessarily start at (0, 0), so the two loops start
-	// at bounds.Min.Y and bounds.Min.X. Looping over Y first and X second is more
-	// likely to result in better memory access patterns than X first and Y second.
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			colors := colors(x, y, images)
-			c, err := meanColor(colors)
-			if err != nil {
-				log.Fatalf("failed to get mean pixel color at x=%v y=%v: %v", x, y, err)
+	if *grayTransparencyFlag {
+		for k, i := range images {
+			if err := checkGray(i); err != nil {
+				return nil, fmt.Errorf("unsupported operation; --preserve-gray-transparency needs grayscale inputs, but in %v the %v", paths[k], err)
 			}
-			out.Set(x, y, c)
 		}
 	}
+	return images, nil
+}
 
-	f, err := os.Create(*outFlag)
-	if err != nil {
-		log.Fatalf("failed to create output file %v: %v", *outFlag, err)
+// pixelSamples returns the samples mergeImages combines at x, y: those drawn
+// by all, or under --regions those of the images covering the pixel, less any
+// --reject-saturated samples. It reports false when no image covers the pixel.
+func pixelSamples(x, y int, images []image.Image, all func(x, y int, images []image.Image) []color.Color) ([]color.Color, bool) {
+	var colors []color.Color
+	if inputRegions != nil {
+		colors = regionColors(x, y, images)
+		if len(colors) == 0 {
+			return nil, false
+		}
+	} else {
+		colors = all(x, y, images)
+	}
+	if *rejectSaturatedFlag > 0 {
+		colors = unsaturated(colors)
 	}
-	defer f.Close()
+	return colors, true
+}
 
-	err = jpeg.Encode(f, out, &jpeg.Options{Quality: 100})
+// mergeImages combines images pixel-by-pixel, using reduce to turn each
+// pixel's samples into the output color. It also returns how many samples
+// each output pixel was computed from, in row-major order from bounds.Min.
+// With --on-empty=transparent, a pixel where the filter rejects every sample
+// is left transparent with nothing kept instead of failing the merge.
+func mergeImages(images []image.Image, reduce reducer) (*image.RGBA, []int, error) {
+	bounds := images[0].Bounds()
+	out := newOutputRGBA(bounds)
+	kept := make([]int, bounds.Dx()*bounds.Dy())
+	clippedPixels, identicalPixels, timedOutPixels, saturatedPixels, twoStageFallbacks, emptyPixels = 0, 0, 0, 0, 0, 0
+	clippedChannels = [4]int64{}
+	if *rowStatsFlag != "" {
+		rowSpread = make([]float64, bounds.Dy())
+	}
+	if *pixelTimeoutFlag > 0 {
+		reduce = withTimeout(reduce, *pixelTimeoutFlag)
+	}
+	if *sourceMapFlag != "" {
+		sourceIndex = make([]int, bounds.Dx()*bounds.Dy())
+		for k := range sourceIndex {
+			sourceIndex[k] = -1
+		}
+	}
+
+	p := startProgress("merging", bounds.Dy())
+	defer p.stop()
+
+	// Each --merge-workers goroutine merges its own strip of rows. A worker
+	// that fails sets stop, so the others stop after their current row.
+	var stop int32
+	merge := func(lane, y0, y1 int) error {
+		// An image's bounds do not necessarily start at (0, 0), so the two loops start
+		// at bounds.Min.Y and bounds.Min.X. Looping over Y first and X second is more
+		// likely to result in better memory access patterns than X first and Y second.
+		for y := y0; y < y1; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				k := (y-bounds.Min.Y)*bounds.Dx() + (x - bounds.Min.X)
+				colors, ok := pixelSamples(x, y, images, pixelColors)
+				if !ok {
+					// No image covers this pixel, so leave it transparent.
+					continue
+				}
+				c, n, err := reduce(x, y, colors, nil)
+				if err == errPixelTimeout {
+					log.Printf("pixel at x=%v y=%v took longer than --pixel-reducer-timeout=%v; leaving it empty", x, y, *pixelTimeoutFlag)
+					count(&timedOutPixels)
+					continue
+				}
+				if err == errAllRejected && *onEmptyFlag == "transparent" {
+					count(&emptyPixels)
+					continue
+				}
+				if err != nil {
+					atomic.StoreInt32(&stop, 1)
+					return fmt.Errorf("failed to get mean pixel color at x=%v y=%v: %v", x, y, err)
+				}
+				out.Set(x, y, c)
+				kept[k] = n
+				if rowSpread != nil {
+					rowSpread[y-bounds.Min.Y] += sampleSpread(colors)
+				}
+				if sourceIndex != nil {
+					sourceIndex[k] = dominantSource(x, y, images, out.At(x, y))
+				}
+			}
+			if err := imagesErr(images...); err != nil {
+				atomic.StoreInt32(&stop, 1)
+				return err
+			}
+			p.stepLane(lane)
+			if interrupted() {
+				// Rows that were never reached stay transparent black with
+				// nothing kept, so the reports show them as fully rejected.
+				return errInterrupted
+			}
+			if atomic.LoadInt32(&stop) != 0 {
+				return nil
+			}
+		}
+		return nil
+	}
+
+	var err error
+	if *mergeWorkersFlag <= 1 {
+		err = merge(0, bounds.Min.Y, bounds.Max.Y)
+	} else {
+		parts := strips(bounds.Min.Y, bounds.Max.Y, *mergeWorkersFlag)
+		sizes := make([]int, len(parts))
+		for i, s := range parts {
+			sizes[i] = s[1] - s[0]
+		}
+		p.split(sizes)
+		errs := make([]error, len(parts))
+		var wg sync.WaitGroup
+		for i, s := range parts {
+			wg.Add(1)
+			go func(i int, s [2]int) {
+				defer wg.Done()
+				errs[i] = merge(i, s[0], s[1])
+			}(i, s)
+		}
+		wg.Wait()
+		// Report the failure in the topmost strip, and an interrupt only if
+		// nothing failed.
+		for _, e := range errs {
+			if e != nil && (err == nil || err == errInterrupted) {
+				err = e
+			}
+		}
+	}
+	if err == errInterrupted {
+		return out, kept, err
+	}
 	if err != nil {
-		log.Fatalf("failed to save image to output file %v: %v", *outFlag, err)
+		return nil, nil, err
 	}
+	return out, kept, nil
 }
 
 func colors(x, y int, images []image.Image) []color.Color {
@@ -98,7 +1072,32 @@ func colors(x, y int, images []image.Image) []color.Color {
 	return out
 }
 
-func meanColor(colors []color.Color) (color.Color, error) {
+// meanColor averages colors after rejecting every sample that has a channel
+// more than N standard deviations from that channel's mean. It also returns
+// the number of samples that survived.
+//
+// weights holds one weight per sample for the final average of the survivors,
+// or is nil to weight every sample equally. Rejection itself is unweighted
+// unless --weighted-filter is set.
+func meanColor(t *tally, colors []color.Color, weights []float64, N float64) (color.Color, int, error) {
+	if *identicalFastPathFlag && len(colors) > 1 {
+		if c, ok := identicalColor(colors); ok {
+			t.count(&identicalPixels)
+			return c, len(colors), nil
+		}
+	}
+
+	if *decoupleAlphaFlag {
+		return decoupledMeanColor(t, colors, weights, N)
+	}
+	if channelFilters != nil {
+		return perChannelColor(t, colors, weights, N)
+	}
+	if *statsEngineFlag == "internal" && len(colors) > 0 && !(*weightedFilterFlag && weights != nil) {
+		means, stddevs := pixelStats(colors)
+		return filterMean(t, colors, weights, means[:], stddevs[:], N)
+	}
+
 	// Store RGBA data into a master slice of per-channel slices.
 	// The index of the master has R=0, G=1, B=2, A=3
 	channels := [][]float64{}
@@ -117,60 +1116,158 @@ func meanColor(colors []color.Color) (color.Color, error) {
 	means := []float64{}
 	stddevs := []float64{}
 	for _, c := range channels {
-		m, err := stats.Mean(c)
+		if *weightedFilterFlag && weights != nil {
+			m, err := weightedMean(c, weights)
+			if err != nil {
+				return nil, 0, fmt.Errorf("failed to compute weighted mean for %v: %v", c, err)
+			}
+			s, err := weightedStddev(c, weights, m)
+			if err != nil {
+				return nil, 0, fmt.Errorf("failed to compute weighted standard deviation %v: %v", c, err)
+			}
+			means = append(means, m)
+			stddevs = append(stddevs, s)
+			continue
+		}
+		m, err := sampleMean(c)
 		if err != nil {
-			return nil, fmt.Errorf("failed to compute mean for %v: %v", c, err)
+			return nil, 0, fmt.Errorf("failed to compute mean for %v: %v", c, err)
 		}
-		s, err := stats.StandardDeviationSample(c)
+		s, err := sampleStddev(c)
 		if err != nil {
-			return nil, fmt.Errorf("failed to compute sample standard deviation %v: %v", c, err)
+			return nil, 0, fmt.Errorf("failed to compute sample standard deviation %v: %v", c, err)
 		}
 
 		means = append(means, m)
 		stddevs = append(stddevs, s)
 	}
 
+	return filterMean(t, colors, weights, means, stddevs, N)
+}
+
+// filterMean averages colors after rejecting every sample that has a channel
+// more than N times stddevs from means, both indexed R=0, G=1, B=2, A=3. It
+// returns errAllRejected if no sample survives. weights is as for meanColor.
+func filterMean(t *tally, colors []color.Color, weights []float64, means, stddevs []float64, N float64) (color.Color, int, error) {
 	// Filter pixels that have a channel outside of N standard deviations
-	var rsFilt, gsFilt, bsFilt, asFilt []float64
-	for _, c := range colors {
+	var rsFilt, gsFilt, bsFilt, asFilt, wsFilt []float64
+	for idx, c := range colors {
 		r, g, b, a := c.RGBA()
-		N := *nFlag
-		if float64(r) > means[0]+N*stddevs[0] || float64(r) < means[0]-N*stddevs[0] {
-			continue
-		}
-		if float64(g) > means[1]+N*stddevs[1] || float64(g) < means[1]-N*stddevs[1] {
-			continue
-		}
-		if float64(b) > means[2]+N*stddevs[2] || float64(b) < means[2]-N*stddevs[2] {
-			continue
-		}
-		if float64(a) > means[3]+N*stddevs[3] || float64(a) < means[3]-N*stddevs[3] {
+		if outlier(float64(r), means[0], stddevs[0], N) ||
+			outlier(float64(g), means[1], stddevs[1], N) ||
+			outlier(float64(b), means[2], stddevs[2], N) ||
+			outlier(float64(a), means[3], stddevs[3], N) {
+			rejected(t, idx)
 			continue
 		}
 		rsFilt = append(rsFilt, float64(r))
 		gsFilt = append(gsFilt, float64(g))
 		bsFilt = append(bsFilt, float64(b))
 		asFilt = append(asFilt, float64(a))
+		if weights != nil || *distanceWeightedFlag {
+			w := 1.0
+			if weights != nil {
+				w = weights[idx]
+			}
+			if *distanceWeightedFlag {
+				w *= distanceWeight([4]uint32{r, g, b, a}, means, stddevs, N)
+			}
+			wsFilt = append(wsFilt, w)
+		}
 	}
 	if len(rsFilt) == 0 || len(gsFilt) == 0 || len(bsFilt) == 0 || len(asFilt) == 0 {
-		return nil, fmt.Errorf("standard deviation filter removed all pixels; use a higher --N value to make the filter more permissive")
+		return nil, 0, errAllRejected
+	}
+	if *rejectIsolatedFlag && len(rsFilt) == 1 {
+		return nil, 0, errAllRejected
 	}
 
-	rMean, err := stats.Mean(rsFilt)
+	rMean, err := filteredMean(rsFilt, wsFilt)
 	if err != nil {
-		return nil, fmt.Errorf("failed to compute red output using pixels %v: %v", rsFilt, err)
+		return nil, 0, fmt.Errorf("failed to compute red output using pixels %v: %v", rsFilt, err)
 	}
-	gMean, err := stats.Mean(gsFilt)
+	gMean, err := filteredMean(gsFilt, wsFilt)
 	if err != nil {
-		return nil, fmt.Errorf("failed to compute green output using pixels %v: %v", gsFilt, err)
+		return nil, 0, fmt.Errorf("failed to compute green output using pixels %v: %v", gsFilt, err)
 	}
-	bMean, err := stats.Mean(bsFilt)
+	bMean, err := filteredMean(bsFilt, wsFilt)
 	if err != nil {
-		return nil, fmt.Errorf("failed to compute blue output using pixels %v: %v", bsFilt, err)
+		return nil, 0, fmt.Errorf("failed to compute blue output using pixels %v: %v", bsFilt, err)
 	}
-	aMean, err := stats.Mean(asFilt)
+	aMean, err := filteredMean(asFilt, wsFilt)
 	if err != nil {
-		return nil, fmt.Errorf("failed to compute alpha output using pixels %v: %v", asFilt, err)
+		return nil, 0, fmt.Errorf("failed to compute alpha output using pixels %v: %v", asFilt, err)
+	}
+	return toRGBA64(t, rMean, gMean, bMean, aMean), len(rsFilt), nil
+}
+
+// distanceWeight is the --distance-weighted weight of a surviving sample with
+// channels v: Tukey's biweight (1 - (z/N)²)², where z is the sample's largest
+// distance from a channel mean in standard deviations. It is 1 at the mean and
+// falls smoothly to 0 at the rejection threshold, so a sample just inside the
+// threshold counts almost as little as one just outside it. A channel with no
+// spread puts no sample away from the mean.
+func distanceWeight(v [4]uint32, means, stddevs []float64, N float64) float64 {
+	z := 0.0
+	for ch := range v {
+		if stddevs[ch] > 0 {
+			z = math.Max(z, math.Abs(float64(v[ch])-means[ch])/stddevs[ch])
+		}
+	}
+	if z == 0 {
+		return 1
+	}
+	if z >= N {
+		return 0
+	}
+	return sq(1 - sq(z/N))
+}
+
+// errAllRejected is returned by filterMean when no sample survives.
+var errAllRejected = errors.New("standard deviation filter removed all pixels; use a higher --N value to make the filter more permissive, or --on-empty=transparent to leave such pixels empty")
+
+// emptyPixels counts the pixels of the last merge that --on-empty=transparent
+// left empty.
+var emptyPixels int64
+
+// filteredMean averages xs, weighting each value by the matching entry of ws
+// unless ws is nil.
+func filteredMean(xs, ws []float64) (float64, error) {
+	if ws == nil {
+		return sampleMean(xs)
+	}
+	return weightedMean(xs, ws)
+}
+
+// identicalPixels counts the output pixels of the current merge that took the
+// --preserve-exact-when-identical fast path. Each merge resets it.
+var identicalPixels int64
+
+// identicalColor reports whether every sample in colors has the same RGBA
+// value, returning that value exactly if so.
+func identicalColor(colors []color.Color) (color.Color, bool) {
+	r, g, b, a := colors[0].RGBA()
+	for _, c := range colors[1:] {
+		r2, g2, b2, a2 := c.RGBA()
+		if r2 != r || g2 != g || b2 != b || a2 != a {
+			return nil, false
+		}
+	}
+	return color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)}, true
+}
+
+// outlier reports whether v lies more than N standard deviations from mean.
+//
+// Tiny inputs and small stacks hit two degenerate spreads, handled here for
+// every filter. A zero standard deviation means every sample equals the
+// mean, so all of them are kept. A NaN one comes from a single sample, which
+// is also kept, since there is nothing to compare it with.
+func outlier(v, mean, stddev, N float64) bool {
+	if stddev == 0 {
+		return v != mean
+	}
+	if math.IsNaN(stddev) {
+		return false
 	}
-	return color.RGBA64{uint16(rMean), uint16(gMean), uint16(bMean), uint16(aMean)}, nil
+	return v > mean+N*stddev || v < mean-N*stddev
 }
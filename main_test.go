@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestIdenticalInputsByteIdentical checks that merging copies of one image
+// gives back that image byte for byte, with or without the fast path.
+func TestIdenticalInputsByteIdentical(t *testing.T) {
+	defer func(fast bool) { *identicalFastPathFlag = fast }(*identicalFastPathFlag)
+
+	rng := rand.New(rand.NewSource(1))
+	in := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for k := 0; k < len(in.Pix); k += 4 {
+		a := uint8(rng.Intn(256))
+		if k%8 == 0 {
+			a = 255
+		}
+		for ch := 0; ch < 3; ch++ {
+			in.Pix[k+ch] = uint8(rng.Intn(int(a) + 1))
+		}
+		in.Pix[k+3] = a
+	}
+	var want bytes.Buffer
+	if err := png.Encode(&want, in); err != nil {
+		t.Fatal(err)
+	}
+	images := []image.Image{in, in, in, in, in}
+
+	for _, mode := range []string{"sigma", "mean", "median"} {
+		for _, fast := range []bool{true, false} {
+			*identicalFastPathFlag = fast
+			reduce, err := newReducer(mode, images)
+			if err != nil {
+				t.Fatalf("newReducer(%v) failed: %v", mode, err)
+			}
+			out, _, err := mergeImages(images, reduce)
+			if err != nil {
+				t.Fatalf("--mode=%v: mergeImages failed: %v", mode, err)
+			}
+			var got bytes.Buffer
+			if err := png.Encode(&got, out); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), want.Bytes()) {
+				t.Errorf("--mode=%v --preserve-exact-when-identical=%v: output is not byte-identical to the input", mode, fast)
+			}
+		}
+	}
+}
+
+// TestResolvePathsByteOrder checks that inputs come back in byte order, which
+// differs from locale-aware and per-directory glob order for these names.
+func TestResolvePathsByteOrder(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"b.png", "B.png", "_b.png", "10.png", "9.png", "\u00e9.png", "e.png", "a/z.png", "a-b/x.png"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "dir.png"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"*.png", []string{"10.png", "9.png", "B.png", "_b.png", "b.png", "e.png", "\u00e9.png"}},
+		{"*/*.png", []string{"a-b/x.png", "a/z.png"}},
+	}
+	for _, tc := range tests {
+		for run := 0; run < 3; run++ {
+			got, err := resolvePaths(filepath.Join(dir, tc.pattern))
+			if err != nil {
+				t.Fatalf("resolvePaths(%v) failed: %v", tc.pattern, err)
+			}
+			for i := range got {
+				got[i] = filepath.ToSlash(got[i][len(dir)+1:])
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("resolvePaths(%v) = %q; want %q", tc.pattern, got, tc.want)
+			}
+		}
+	}
+}
+
+// gray returns n opaque samples with every color channel at v.
+func gray(n int, v uint16) []color.Color {
+	out := make([]color.Color, n)
+	for i := range out {
+		out[i] = color.RGBA64{v, v, v, 0xffff}
+	}
+	return out
+}
+
+// TestMeanColor checks the N-standard-deviation filter on samples with known
+// results: an outlier above or below a cluster is rejected and the cluster's
+// exact mean returned, and a filter that rejects everything reports
+// errAllRejected.
+func TestMeanColor(t *testing.T) {
+	defer func(fast bool) { *identicalFastPathFlag = fast }(*identicalFastPathFlag)
+
+	tests := []struct {
+		name     string
+		colors   []color.Color
+		N        float64
+		fast     bool
+		want     color.Color
+		wantKept int
+		wantErr  error
+	}{
+		{"identical", gray(5, 1234), 1.3, false, color.RGBA64{1234, 1234, 1234, 0xffff}, 5, nil},
+		{"identical fast path", gray(5, 1234), 1.3, true, color.RGBA64{1234, 1234, 1234, 0xffff}, 5, nil},
+		{"high outlier", append(gray(9, 100), gray(1, 60000)...), 1.3, false, color.RGBA64{100, 100, 100, 0xffff}, 9, nil},
+		{"low outlier", append(gray(9, 60000), gray(1, 100)...), 1.3, false, color.RGBA64{60000, 60000, 60000, 0xffff}, 9, nil},
+		{"all rejected", append(gray(1, 0), gray(1, 0xffff)...), 0.1, false, nil, 0, errAllRejected},
+		{"single sample", gray(1, 4321), 1.3, false, color.RGBA64{4321, 4321, 4321, 0xffff}, 1, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			*identicalFastPathFlag = tc.fast
+			got, kept, err := meanColor(nil, tc.colors, nil, tc.N)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("meanColor(nil, ) error = %v; want %v", err, tc.wantErr)
+			}
+			if kept != tc.wantKept {
+				t.Errorf("meanColor(nil, ) kept %v samples; want %v", kept, tc.wantKept)
+			}
+			if tc.want != nil && color.RGBA64Model.Convert(got) != tc.want {
+				t.Errorf("meanColor(nil, ) = %v; want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestOutlier covers the degenerate spreads outlier handles for every filter:
+// a zero standard deviation keeps only samples equal to the mean, and an
+// undefined one from a single sample keeps it.
+func TestOutlier(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		name               string
+		v, mean, stddev, N float64
+		want               bool
+	}{
+		{"inside", 110, 100, 10, 1.3, false},
+		{"above", 114, 100, 10, 1.3, true},
+		{"below", 86, 100, 10, 1.3, true},
+		{"zero stddev at the mean", 100, 100, 0, 1.3, false},
+		{"zero stddev off the mean", 101, 100, 0, 1.3, true},
+		{"zero stddev with zero N", 100, 100, 0, 0, false},
+		{"NaN stddev", 100, 100, nan, 1.3, false},
+		{"NaN stddev far from the mean", 60000, 100, nan, 1.3, false},
+	}
+	for _, tc := range tests {
+		if got := outlier(tc.v, tc.mean, tc.stddev, tc.N); got != tc.want {
+			t.Errorf("%v: outlier(%v, %v, %v, %v) = %v; want %v", tc.name, tc.v, tc.mean, tc.stddev, tc.N, got, tc.want)
+		}
+	}
+}
+
+// TestFilterMeanDegenerate checks that filterMean, which rejects against given
+// statistics, keeps every sample of a single-sample or zero-spread pixel.
+func TestFilterMeanDegenerate(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		name     string
+		colors   []color.Color
+		means    []float64
+		stddevs  []float64
+		want     color.Color
+		wantKept int
+	}{
+		{"NaN stddev keeps the sample", gray(1, 500), []float64{500, 500, 500, 0xffff}, []float64{nan, nan, nan, nan}, color.RGBA64{500, 500, 500, 0xffff}, 1},
+		{"zero stddev keeps the mean", append(gray(2, 700), gray(1, 800)...), []float64{700, 700, 700, 0xffff}, []float64{0, 0, 0, 0}, color.RGBA64{700, 700, 700, 0xffff}, 2},
+	}
+	for _, tc := range tests {
+		got, kept, err := filterMean(nil, tc.colors, nil, tc.means, tc.stddevs, 1.3)
+		if err != nil {
+			t.Fatalf("%v: filterMean(nil, ) failed: %v", tc.name, err)
+		}
+		if kept != tc.wantKept {
+			t.Errorf("%v: filterMean(nil, ) kept %v samples; want %v", tc.name, kept, tc.wantKept)
+		}
+		if color.RGBA64Model.Convert(got) != tc.want {
+			t.Errorf("%v: filterMean(nil, ) = %v; want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// TestZeroChannels merges a region that is black in every input, next to
+// pixels that vary, and checks it comes out exactly black with every sample
+// kept, for each way the mean and spread can be computed.
+func TestZeroChannels(t *testing.T) {
+	defer func(e string, w, d bool) {
+		*statsEngineFlag, *weightedFilterFlag, *distanceWeightedFlag = e, w, d
+	}(*statsEngineFlag, *weightedFilterFlag, *distanceWeightedFlag)
+	defer func(w []float64) { inputWeights = w }(inputWeights)
+
+	var images []image.Image
+	for i := 0; i < 5; i++ {
+		img := image.NewRGBA(image.Rect(0, 0, 4, 1))
+		for x := 0; x < 2; x++ {
+			img.SetRGBA(x, 0, color.RGBA{0, 0, 0, 255})
+		}
+		for x := 2; x < 4; x++ {
+			v := uint8(40 * (i + x))
+			img.SetRGBA(x, 0, color.RGBA{v, v / 2, 255 - v, 255})
+		}
+		images = append(images, img)
+	}
+
+	for _, tc := range []struct {
+		name                     string
+		engine                   string
+		weights                  []float64
+		weightedFilter, distance bool
+	}{
+		{"internal", "internal", nil, false, false},
+		{"montanaflynn", "montanaflynn", nil, false, false},
+		{"weighted filter", "internal", []float64{0.1, 0.2, 0.3, 0.15, 0.25}, true, false},
+		{"distance weighted", "internal", nil, false, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			*statsEngineFlag, *weightedFilterFlag, *distanceWeightedFlag = tc.engine, tc.weightedFilter, tc.distance
+			inputWeights = tc.weights
+			for _, mode := range []string{"sigma", "mean"} {
+				reduce, err := newReducer(mode, images)
+				if err != nil {
+					t.Fatal(err)
+				}
+				out, kept, err := mergeImages(images, reduce)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for x := 0; x < 2; x++ {
+					if got := out.RGBAAt(x, 0); got != (color.RGBA{0, 0, 0, 255}) {
+						t.Errorf("--mode=%v: black pixel %v is %v", mode, x, got)
+					}
+					if kept[x] != len(images) {
+						t.Errorf("--mode=%v: black pixel %v kept %v of %v samples", mode, x, kept[x], len(images))
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestDistanceWeighted compares --distance-weighted with the equal-weight
+// average of the same survivors.
+func TestDistanceWeighted(t *testing.T) {
+	defer func(d, fast bool) { *distanceWeightedFlag, *identicalFastPathFlag = d, fast }(*distanceWeightedFlag, *identicalFastPathFlag)
+	*identicalFastPathFlag = false
+
+	tests := []struct {
+		name   string
+		colors []color.Color
+		// equal and weighted are the red channel of each average.
+		equal, weighted uint32
+	}{
+		// Samples equally far from the mean weigh the same either way.
+		{"symmetric", append(gray(2, 100), gray(2, 200)...), 150, 150},
+		// A survivor near the threshold barely moves the weighted average.
+		{"borderline survivor", append(gray(6, 100), gray(1, 400)...), 142, 109},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, weighted := range []bool{false, true} {
+				*distanceWeightedFlag = weighted
+				c, kept, err := meanColor(nil, tc.colors, nil, 3)
+				if err != nil {
+					t.Fatalf("--distance-weighted=%v: meanColor failed: %v", weighted, err)
+				}
+				if kept != len(tc.colors) {
+					t.Errorf("--distance-weighted=%v: kept %v samples; want all %v", weighted, kept, len(tc.colors))
+				}
+				want := tc.equal
+				if weighted {
+					want = tc.weighted
+				}
+				if r, _, _, _ := c.RGBA(); r != want {
+					t.Errorf("--distance-weighted=%v: red = %v; want %v", weighted, r, want)
+				}
+			}
+		})
+	}
+
+	means, stddevs := []float64{100, 100, 100, 100}, []float64{10, 10, 10, 0}
+	if w := distanceWeight([4]uint32{100, 100, 100, 100}, means, stddevs, 2); w != 1 {
+		t.Errorf("weight at the mean = %v; want 1", w)
+	}
+	if w := distanceWeight([4]uint32{120, 100, 100, 100}, means, stddevs, 2); w != 0 {
+		t.Errorf("weight at the threshold = %v; want 0", w)
+	}
+}
+
+// TestRunSeedZero checks that an explicit --seed=0 is used as given rather
+// than taken to mean no seed.
+func TestRunSeedZero(t *testing.T) {
+	defer func(s int64) { *seedFlag = s }(*seedFlag)
+	if err := flag.Set("seed", "0"); err != nil {
+		t.Fatal(err)
+	}
+	if got := runSeed("testing"); got != 0 {
+		t.Errorf("runSeed with --seed=0 = %v; want 0", got)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// mergeOrder returns paths in the order --merge-order names: "name" sorts by
+// file name without the directory, "mtime" by modification time, oldest
+// first, and the "reverse-" forms flip either. Files that tie keep their
+// order in paths, and an empty order returns paths as they are.
+func mergeOrder(paths []string, order string) ([]string, error) {
+	out := append([]string(nil), paths...)
+	var less func(i, j int) bool
+	switch order {
+	case "":
+		return out, nil
+	case "name", "reverse-name":
+		less = func(i, j int) bool { return filepath.Base(out[i]) < filepath.Base(out[j]) }
+	case "mtime", "reverse-mtime":
+		times := map[string]time.Time{}
+		for _, p := range paths {
+			info, err := os.Stat(p)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read the modification time of %v: %v", p, err)
+			}
+			times[p] = info.ModTime()
+		}
+		less = func(i, j int) bool { return times[out[i]].Before(times[out[j]]) }
+	default:
+		return nil, fmt.Errorf("unknown order %q; must be 'name', 'reverse-name', 'mtime' or 'reverse-mtime'", order)
+	}
+	if order == "reverse-name" || order == "reverse-mtime" {
+		forward := less
+		less = func(i, j int) bool { return forward(j, i) }
+	}
+	sort.SliceStable(out, less)
+	return out, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeOrderInputs writes two 1×1 inputs in dir, of colors first and second.
+// Sorted by path the first comes first; sorted by file name or modification
+// time, the second does.
+func writeOrderInputs(t *testing.T, dir string, first, second color.Color) (string, string) {
+	t.Helper()
+	a := filepath.Join(dir, "a", "2.png")
+	b := filepath.Join(dir, "b", "1.png")
+	for path, c := range map[string]color.Color{a: first, b: second} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		img := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+		img.Set(0, 0, c)
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := png.Encode(f, img); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	now := time.Now()
+	if err := os.Chtimes(b, now, now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(a, now, now); err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+// TestMergeOrderCheckpoint streams a red and a blue input under each
+// --merge-order and checks both the order and that the checkpoint written
+// after the first input shows the input that order puts first.
+func TestMergeOrderCheckpoint(t *testing.T) {
+	defer func(out string, every int) { *checkpointOutFlag, *checkpointEveryFlag = out, every }(*checkpointOutFlag, *checkpointEveryFlag)
+	dir := t.TempDir()
+	layers := []color.RGBA{{255, 0, 0, 255}, {0, 0, 255, 255}}
+	red, blue := writeOrderInputs(t, dir, layers[0], layers[1])
+	colors := map[string]color.RGBA{red: layers[0], blue: layers[1]}
+
+	*checkpointOutFlag = filepath.Join(dir, "checkpoint.png")
+	*checkpointEveryFlag = 1
+	tests := []struct {
+		order string
+		want  []string
+	}{
+		{"", []string{red, blue}},
+		{"name", []string{blue, red}},
+		{"reverse-name", []string{red, blue}},
+		{"mtime", []string{blue, red}},
+		{"reverse-mtime", []string{red, blue}},
+	}
+	for _, tc := range tests {
+		paths, err := mergeOrder([]string{red, blue}, tc.order)
+		if err != nil {
+			t.Fatalf("--merge-order=%v: %v", tc.order, err)
+		}
+		if !reflect.DeepEqual(paths, tc.want) {
+			t.Errorf("--merge-order=%v: order %v; want %v", tc.order, paths, tc.want)
+		}
+		if _, _, _, err := streamAverage(paths); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(*checkpointOutFlag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkpoint, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := color.RGBAModel.Convert(checkpoint.At(0, 0))
+		if want := colors[tc.want[0]]; got != want {
+			t.Errorf("--merge-order=%v: checkpoint %v; want the first input's %v", tc.order, got, want)
+		}
+	}
+
+	if _, err := mergeOrder([]string{red}, "size"); err == nil {
+		t.Errorf("mergeOrder accepted an unknown order")
+	}
+}
+
+// TestMergeOrderLayers stacks a translucent red layer and an opaque blue one
+// under each --merge-order and checks which is on top.
+func TestMergeOrderLayers(t *testing.T) {
+	red, blue := writeOrderInputs(t, t.TempDir(), color.NRGBA{255, 0, 0, 128}, color.NRGBA{0, 0, 255, 255})
+
+	// Red over blue lets half of the blue through, while blue over red
+	// hides it.
+	redOnTop := color.RGBA{128, 0, 127, 255}
+	blueOnTop := color.RGBA{0, 0, 255, 255}
+	for _, tc := range []struct {
+		order string
+		top   color.RGBA
+	}{
+		{"", blueOnTop},
+		{"name", redOnTop},
+		{"reverse-name", blueOnTop},
+		{"mtime", redOnTop},
+		{"reverse-mtime", blueOnTop},
+	} {
+		paths, err := mergeOrder([]string{red, blue}, tc.order)
+		if err != nil {
+			t.Fatalf("--merge-order=%v: %v", tc.order, err)
+		}
+		images, err := loadImages(paths)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reduce, err := newReducer("flatten-layers", images)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, _, err := mergeImages(images, reduce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := out.RGBAAt(0, 0)
+		for ch, d := range [3]int{int(got.R) - int(tc.top.R), int(got.G) - int(tc.top.G), int(got.B) - int(tc.top.B)} {
+			if d < -1 || d > 1 {
+				t.Errorf("--merge-order=%v: composite %v; want %v (channel %v)", tc.order, got, tc.top, ch)
+			}
+		}
+	}
+}
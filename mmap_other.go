@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package main
+
+import "os"
+
+// mapFile does not map anything on this platform, so tiles are read from the
+// file instead.
+func mapFile(f *os.File, size int64) ([]byte, func(), error) {
+	return nil, nil, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+
+	"github.com/montanaflynn/stats"
+)
+
+// sampleWeights returns the weight of each input's sample at x, y under
+// --weights and --weighted-by-sharpness, or nil when every sample counts the
+// same.
+func sampleWeights(images []image.Image) func(x, y int) []float64 {
+	if !*sharpnessFlag {
+		return func(_, _ int) []float64 { return inputWeights }
+	}
+	sharp := sharpnessWeights(images)
+	if inputWeights == nil {
+		return sharp
+	}
+	return func(x, y int) []float64 {
+		ws := sharp(x, y)
+		for i := range ws {
+			ws[i] *= inputWeights[i]
+		}
+		return ws
+	}
+}
+
+// reducer combines the samples of the pixel at x, y into its output color,
+// also returning how many of the samples that color was computed from. Any
+// counters it updates go through t.
+type reducer func(x, y int, colors []color.Color, t *tally) (color.Color, int, error)
+
+// modeNames lists the --mode values in the order --compare-modes writes them.
+var modeNames = []string{"mean", "median", "sigma"}
+
+// newReducer returns the reducer for mode, doing any preparation over images
+// that the mode needs up front.
+func newReducer(mode string, images []image.Image) (reducer, error) {
+	switch mode {
+	case "sigma":
+		n, err := thresholds(images)
+		if err != nil {
+			return nil, err
+		}
+		weights := sampleWeights(images)
+		if *filterFlag == "spatiotemporal" {
+			return spatiotemporalReducer(images, n, weights)
+		}
+		if *filterFlag == "gradient-direction" {
+			return gradientReducer(images, weights)
+		}
+		if *twoStageFlag {
+			return twoStageReducer(images, n, weights)
+		}
+		if *filterFlag == "largest-cluster" {
+			return func(x, y int, colors []color.Color, t *tally) (color.Color, int, error) {
+				return clusterColor(t, colors, weights(x, y))
+			}, nil
+		}
+		return func(x, y int, colors []color.Color, t *tally) (color.Color, int, error) {
+			return meanColor(t, colors, weights(x, y), n(x, y))
+		}, nil
+	case "mean":
+		return func(_, _ int, colors []color.Color, t *tally) (color.Color, int, error) {
+			c, err := plainMeanColor(t, colors)
+			return c, len(colors), err
+		}, nil
+	case "median":
+		return func(_, _ int, colors []color.Color, t *tally) (color.Color, int, error) {
+			c, err := medianColor(t, colors)
+			return c, len(colors), err
+		}, nil
+	case "flatten-layers":
+		return func(_, _ int, colors []color.Color, t *tally) (color.Color, int, error) {
+			return flattenColor(t, colors)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown --mode %q; must be one of %v, difference-amplify or flatten-layers", mode, modeNames)
+}
+
+// plainMeanColor averages every sample without rejecting outliers, weighted
+// by --weights when given.
+func plainMeanColor(t *tally, colors []color.Color) (color.Color, error) {
+	if inputWeights != nil {
+		return reduceChannels(t, colors, func(xs []float64) (float64, error) {
+			return weightedMean(xs, inputWeights)
+		})
+	}
+	return reduceChannels(t, colors, sampleMean)
+}
+
+// medianColor takes the median of each channel independently.
+func medianColor(t *tally, colors []color.Color) (color.Color, error) {
+	return reduceChannels(t, colors, func(xs []float64) (float64, error) {
+		return stats.Median(xs)
+	})
+}
+
+// reduceChannels applies fn to each of the R,G,B,A channels of colors on its own.
+func reduceChannels(t *tally, colors []color.Color, fn func([]float64) (float64, error)) (color.Color, error) {
+	var rs, gs, bs, as []float64
+	for _, c := range colors {
+		r, g, b, a := c.RGBA()
+		rs = append(rs, float64(r))
+		gs = append(gs, float64(g))
+		bs = append(bs, float64(b))
+		as = append(as, float64(a))
+	}
+
+	var out [4]float64
+	for i, c := range [][]float64{rs, gs, bs, as} {
+		v, err := fn(c)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reduce channel %v: %v", c, err)
+		}
+		out[i] = v
+	}
+	return toRGBA64(t, out[0], out[1], out[2], out[3]), nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+)
+
+// nMapScale holds the --n-map factor for --N at each pixel, in row-major
+// order from the inputs' bounds.Min, or is nil when N is not scaled by a map.
+var nMapScale []float64
+
+// loadNMap decodes the grayscale map at path, checks that it is the same size
+// as the input at first, and returns its per-pixel factors. Mid-gray (128)
+// leaves N unchanged, white nearly doubles it and black makes it 0.
+func loadNMap(path, first string) ([]float64, error) {
+	m, err := decodeFile(path)
+	if err != nil {
+		return nil, err
+	}
+	h, err := readHeader(first)
+	if err != nil {
+		return nil, err
+	}
+	b := m.Bounds()
+	if b.Dx() != h.width || b.Dy() != h.height {
+		return nil, fmt.Errorf("%v is %vx%v but the inputs are %vx%v", path, b.Dx(), b.Dy(), h.width, h.height)
+	}
+	scale := make([]float64, 0, b.Dx()*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			g := color.Gray16Model.Convert(m.At(x, y)).(color.Gray16)
+			scale = append(scale, float64(g.Y)/0x8080)
+		}
+	}
+	return scale, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+// rejectedByInput counts, for --report-outlier-images, how many pixels had
+// the sample of each of rejectedInputs rejected. Both are nil otherwise.
+var (
+	rejectedByInput []int64
+	rejectedInputs  []string
+)
+
+// countRejections starts counting the rejected samples of paths, in merge
+// order, if --report-outlier-images is set.
+func countRejections(paths []string) {
+	if *reportOutliersFlag {
+		rejectedInputs = paths
+		rejectedByInput = make([]int64, len(paths))
+	}
+}
+
+// rejected records that the sample of input idx was rejected at one pixel.
+func rejected(t *tally, idx int) {
+	if rejectedByInput != nil {
+		t.count(&rejectedByInput[idx])
+	}
+}
+
+// writeOutlierReport writes a table of the inputs counted by countRejections,
+// most rejected first, with the share of the image's pixels at which each was
+// rejected. An input rejected far more often than the rest is likely
+// misaligned, differently lit or otherwise not of the same scene.
+func writeOutlierReport(w io.Writer, pixels int) {
+	order := make([]int, len(rejectedInputs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return rejectedByInput[order[i]] > rejectedByInput[order[j]]
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "outlier report: rejected samples per input over %v pixels\n", pixels)
+	fmt.Fprintf(tw, "\trank\trejected\tshare\tinput\n")
+	for rank, i := range order {
+		n := rejectedByInput[i]
+		fmt.Fprintf(tw, "\t%v\t%v\t%.1f%%\t%v\n", rank+1, n, 100*float64(n)/float64(pixels), rejectedInputs[i])
+	}
+	tw.Flush()
+}
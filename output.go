@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// outputExtensions lists the file extensions the output can be written as.
+var outputExtensions = []string{".gif", ".jpeg", ".jpg", ".png"}
+
+// dataOutput is the output path that writes the result to stdout as a base64
+// data URI, in the encoding given by --format, instead of to a file.
+const dataOutput = "data:"
+
+// outputPath returns the file the result of mode should be written to, given
+// the number of images that were merged.
+func outputPath(mode string, count int) string {
+	if *base64Flag {
+		return dataOutput
+	}
+	if *outputTemplateFlag == "" {
+		return *outFlag
+	}
+	p, err := expandOutputTemplate(*outputTemplateFlag, mode, count, time.Now())
+	if err != nil {
+		log.Fatalf("failed to expand --output-template: %v", err)
+	}
+	return p
+}
+
+// compareOutputPath returns the file --compare-modes writes mode to. Templates
+// that mention {mode} already produce distinct names; otherwise "_<mode>" is
+// inserted before the extension.
+func compareOutputPath(mode string, count int) string {
+	p := outputPath(mode, count)
+	if strings.Contains(*outputTemplateFlag, "{mode}") {
+		return p
+	}
+	return suffixPath(p, mode)
+}
+
+// suffixPath inserts "_<suffix>" before the extension of path.
+func suffixPath(path, suffix string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "_" + suffix + ext
+}
+
+// modeReports holds the flags naming the reports finish writes for each mode.
+var modeReports = []*string{sourceMapFlag, rejectReportFlag, maskOutputFlag, rowStatsFlag, histogramOutFlag}
+
+// reportPath returns the file finish writes the report named p to for mode:
+// p itself, or with --compare-modes p with "_<mode>" inserted before the
+// extension, so each mode keeps its own.
+func reportPath(p, mode string) string {
+	if *compareModesFlag {
+		return suffixPath(p, mode)
+	}
+	return p
+}
+
+// expandOutputTemplate replaces the {count}, {n}, {mode} and {date} variables
+// in tmpl and checks that the result has a supported extension.
+func expandOutputTemplate(tmpl, mode string, count int, now time.Time) (string, error) {
+	r := strings.NewReplacer(
+		"{count}", strconv.Itoa(count),
+		"{n}", strconv.FormatFloat(*nFlag, 'g', -1, 64),
+		"{mode}", mode,
+		"{date}", now.Format("2006-01-02"),
+	)
+	p := r.Replace(tmpl)
+	ext := strings.ToLower(filepath.Ext(p))
+	for _, e := range outputExtensions {
+		if ext == e {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("%q must end in one of %v", p, outputExtensions)
+}
+
+// writeImage writes img to path and returns the path it was written to, which
+// differs from path when --resume-safe picks a free name.
+func writeImage(path string, img image.Image) (string, error) {
+	if path == dataOutput {
+		if err := writeDataURI(os.Stdout, img); err != nil {
+			return "", fmt.Errorf("failed to write data URI: %v", err)
+		}
+		return path, nil
+	}
+	f, path, err := createOutput(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to create output file %v: %v", path, err)
+	}
+	defer f.Close()
+
+	err = encodeImage(f, path, img)
+	if err != nil {
+		return "", fmt.Errorf("failed to save image to output file %v: %v", path, err)
+	}
+	if summary != nil {
+		summary.Files = append(summary.Files, path)
+	}
+	return path, nil
+}
+
+// createOutput creates the file an output image is written to and returns it
+// along with its name. With --resume-safe and without --force, a path that
+// already exists is numbered before its extension, path_1, path_2 and so on,
+// until a name is free. Each name is claimed with O_EXCL, so the file is never
+// overwritten, even by another run picking a name at the same moment. Outputs
+// of one run that share a name, such as difference-amplify inputs with the
+// same base name, are numbered the same way.
+func createOutput(path string) (*os.File, string, error) {
+	if !*resumeSafeFlag || *forceFlag {
+		f, err := os.Create(path)
+		return f, path, err
+	}
+	p := path
+	for n := 1; ; n++ {
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if err == nil {
+			if p != path {
+				log.Printf("--resume-safe: %v exists; writing %v instead", path, p)
+			}
+			return f, p, nil
+		}
+		if !os.IsExist(err) {
+			return nil, p, err
+		}
+		p = suffixPath(path, strconv.Itoa(n))
+	}
+}
+
+// writeImageAtomic writes img to a temporary file next to path and renames it
+// into place, so readers of path never see a partially written image.
+func writeImageAtomic(path string, img image.Image) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := encodeImage(f, path, img); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// writeDataURI writes img to w as a single line holding a base64 data URI.
+func writeDataURI(w io.Writer, img image.Image) error {
+	if _, err := fmt.Fprintf(w, "data:image/%v;base64,", *formatFlag); err != nil {
+		return err
+	}
+	enc := base64.NewEncoder(base64.StdEncoding, w)
+	if err := encodeImage(enc, dataOutput, img); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+// outputFormat returns the encoding, "gif", "png" or "jpeg", that path is
+// written in: --format for dataOutput, GIF for ".gif", PNG for ".png" and
+// JPEG otherwise.
+func outputFormat(path string) string {
+	if path == dataOutput {
+		return *formatFlag
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gif":
+		return "gif"
+	case ".png":
+		return "png"
+	}
+	return "jpeg"
+}
+
+// encodeImage writes img to w in the format outputFormat gives for path.
+// An image from withEXIF also carries its EXIF metadata into JPEG output, and
+// one from withResolution records its resolution in PNG and JPEG output.
+func encodeImage(w io.Writer, path string, img image.Image) error {
+	if e, ok := img.(exifImage); ok {
+		return encodeWithEXIF(w, outputFormat(path), e.exif, func(w io.Writer) error {
+			return encodeImage(w, path, e.Image)
+		})
+	}
+	if r, ok := img.(resolutionImage); ok {
+		return encodeWithResolution(w, outputFormat(path), r.res, func(w io.Writer) error {
+			return encodeImage(w, path, r.Image)
+		})
+	}
+	switch outputFormat(path) {
+	case "gif":
+		return encodeGIF(w, img)
+	case "png":
+		if *premultipliedFlag {
+			img = storePremultiplied(img)
+		}
+		return png.Encode(w, img)
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: 100})
+}
+
+// storePremultiplied returns a copy of img whose straight-alpha pixel values
+// are img's premultiplied values. PNG always stores straight alpha, so
+// encoding the copy writes premultiplied color to the file unchanged.
+func storePremultiplied(img image.Image) image.Image {
+	b := img.Bounds()
+	out := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := img.At(x, y).RGBA()
+			out.SetNRGBA(x, y, color.NRGBA{uint8(r >> 8), uint8(g >> 8), uint8(bl >> 8), uint8(a >> 8)})
+		}
+	}
+	return out
+}
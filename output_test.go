@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestOutputPremultiplied checks the bytes stored in a PNG for a translucent
+// pixel under both alpha conventions.
+func TestOutputPremultiplied(t *testing.T) {
+	defer func(p bool) { *premultipliedFlag = p }(*premultipliedFlag)
+
+	img := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	img.SetRGBA(0, 0, color.RGBA{100, 50, 0, 128})
+	img.SetRGBA(1, 0, color.RGBA{10, 20, 30, 255})
+
+	tests := []struct {
+		premultiplied bool
+		want          []uint8
+	}{
+		{false, []uint8{199, 99, 0, 128, 10, 20, 30, 255}},
+		{true, []uint8{100, 50, 0, 128, 10, 20, 30, 255}},
+	}
+	for _, tc := range tests {
+		*premultipliedFlag = tc.premultiplied
+		var buf bytes.Buffer
+		if err := encodeImage(&buf, "out.png", img); err != nil {
+			t.Fatalf("encodeImage failed: %v", err)
+		}
+		decoded, err := png.Decode(&buf)
+		if err != nil {
+			t.Fatalf("failed to decode the output: %v", err)
+		}
+		stored, ok := decoded.(*image.NRGBA)
+		if !ok {
+			t.Fatalf("--output-premultiplied=%v: decoded a %T; want *image.NRGBA", tc.premultiplied, decoded)
+		}
+		if !bytes.Equal(stored.Pix, tc.want) {
+			t.Errorf("--output-premultiplied=%v: stored %v; want %v", tc.premultiplied, stored.Pix, tc.want)
+		}
+	}
+}
+
+// TestResumeSafeNames writes the same output name several times in one
+// directory and checks that --resume-safe numbers all but the first and
+// leaves the earlier files untouched, and that --force overwrites instead.
+func TestResumeSafeNames(t *testing.T) {
+	defer func(r, f bool) { *resumeSafeFlag, *forceFlag = r, f }(*resumeSafeFlag, *forceFlag)
+	*resumeSafeFlag, *forceFlag = true, false
+	dir := t.TempDir()
+	path := filepath.Join(dir, "avg.png")
+
+	for i, want := range []string{"avg.png", "avg_1.png", "avg_2.png"} {
+		img := image.NewGray(image.Rect(0, 0, 1, 1))
+		img.Pix[0] = uint8(i)
+		got, err := writeImage(path, img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != filepath.Join(dir, want) {
+			t.Errorf("wrote %v; want %v", got, want)
+		}
+	}
+	for i, name := range []string{"avg.png", "avg_1.png", "avg_2.png"} {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := img.(*image.Gray).Pix[0]; got != uint8(i) {
+			t.Errorf("%v holds %v; want %v", name, got, i)
+		}
+	}
+	*forceFlag = true
+	if got, err := writeImage(path, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil || got != path {
+		t.Errorf("with --force wrote %v, %v; want %v", got, err, path)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Errorf("directory holds %v files; want 3", len(files))
+	}
+}
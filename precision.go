@@ -0,0 +1,41 @@
+package main
+
+import "fmt"
+
+// accumulator is a slice of per-channel running sums for streamAverage, stored
+// in the --precision chosen for the run.
+type accumulator interface {
+	add(k int, v float64)
+	at(k int) float64
+	set(k int, v float64)
+	len() int
+}
+
+type float64Accumulator []float64
+
+func (a float64Accumulator) add(k int, v float64) { a[k] += v }
+func (a float64Accumulator) at(k int) float64     { return a[k] }
+func (a float64Accumulator) set(k int, v float64) { a[k] = v }
+func (a float64Accumulator) len() int             { return len(a) }
+
+// float32Accumulator halves the memory of float64Accumulator. Its 24-bit
+// mantissa stops registering additions once a sum is about 2^24 times larger
+// than the value added, and the sums of squares lose most of their digits when
+// turned into a variance.
+type float32Accumulator []float32
+
+func (a float32Accumulator) add(k int, v float64) { a[k] += float32(v) }
+func (a float32Accumulator) at(k int) float64     { return float64(a[k]) }
+func (a float32Accumulator) set(k int, v float64) { a[k] = float32(v) }
+func (a float32Accumulator) len() int             { return len(a) }
+
+// newAccumulator returns n zeroed sums in the --precision of the run.
+func newAccumulator(n int) (accumulator, error) {
+	switch *precisionFlag {
+	case "float64":
+		return make(float64Accumulator, n), nil
+	case "float32":
+		return make(float32Accumulator, n), nil
+	}
+	return nil, fmt.Errorf("unknown --precision %q; must be 'float32' or 'float64'", *precisionFlag)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// noisyFrames returns n w×h frames of a smooth gradient with Gaussian noise.
+func noisyFrames(n, w, h int) []image.Image {
+	rng := rand.New(rand.NewSource(1))
+	out := make([]image.Image, n)
+	for i := range out {
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				v := func(base int) uint8 {
+					return uint8(minInt(maxInt(base+int(rng.NormFloat64()*8), 0), 255))
+				}
+				img.Set(x, y, color.RGBA{v(x * 255 / w), v(y * 255 / h), v(128), 255})
+			}
+		}
+		out[i] = img
+	}
+	return out
+}
+
+// writeFrames writes images as PNGs in dir and returns their paths in order.
+func writeFrames(t testing.TB, dir string, n, w, h int) []string {
+	var paths []string
+	for i, img := range noisyFrames(n, w, h) {
+		path := filepath.Join(dir, fmt.Sprintf("%04d.png", i))
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := png.Encode(f, img); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// TestPrecisionDifference streams a few hundred noisy frames with both
+// --precision types and checks the float32 output stays within one 8-bit
+// level of the float64 one.
+func TestPrecisionDifference(t *testing.T) {
+	defer func(p string) { *precisionFlag = p }(*precisionFlag)
+	paths := writeFrames(t, t.TempDir(), 300, 24, 24)
+
+	outputs := map[string][]uint8{}
+	for _, p := range []string{"float64", "float32"} {
+		*precisionFlag = p
+		out, _, _, err := streamAverage(paths)
+		if err != nil {
+			t.Fatalf("--precision=%v: streamAverage failed: %v", p, err)
+		}
+		outputs[p] = out.Pix
+	}
+
+	worst, differing := 0, 0
+	for k, v := range outputs["float64"] {
+		d := int(outputs["float32"][k]) - int(v)
+		if d < 0 {
+			d = -d
+		}
+		if d > 0 {
+			differing++
+		}
+		if d > worst {
+			worst = d
+		}
+	}
+	t.Logf("float32 differs from float64 in %v of %v channels, by at most %v", differing, len(outputs["float64"]), worst)
+	if worst > 1 {
+		t.Errorf("float32 differs from float64 by up to %v levels; want at most 1", worst)
+	}
+}
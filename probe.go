@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+)
+
+// probe implements --probe: it reports the format, color model and effective
+// bit depth of every file in paths to w.
+func probe(w io.Writer, paths []string) error {
+	eight := 0
+	for _, p := range paths {
+		f, err := openInput(p)
+		if err != nil {
+			return err
+		}
+		i, format, err := decodeLimited(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed decoding image %v: %v", p, err)
+		}
+
+		depth := effectiveDepth(i)
+		if depth == 8 {
+			eight++
+		}
+		b := i.Bounds()
+		fmt.Fprintf(w, "%v: %v, %v, %vx%v, %v-bit\n", p, format, modelName(i.ColorModel()), b.Dx(), b.Dy(), depth)
+	}
+	fmt.Fprintf(w, "%v of %v inputs are 8-bit, %v are 16-bit\n", eight, len(paths), len(paths)-eight)
+	return nil
+}
+
+// effectiveDepth returns the number of bits per channel that the stored
+// samples of i actually use. Images with 8-bit storage are 8-bit. Images with
+// 16-bit storage are also reported as 8-bit if every sample is an 8-bit value
+// scaled by 0x101, with equal high and low bytes, which is what upconverted
+// 8-bit data looks like.
+func effectiveDepth(i image.Image) int {
+	var pix []uint8
+	switch i := i.(type) {
+	case *image.RGBA64:
+		pix = i.Pix
+	case *image.NRGBA64:
+		pix = i.Pix
+	case *image.Gray16:
+		pix = i.Pix
+	case *image.Alpha16:
+		pix = i.Pix
+	default:
+		if m := modelName(i.ColorModel()); m == "RGBA64" || m == "NRGBA64" || m == "Gray16" || m == "Alpha16" {
+			return 16
+		}
+		return 8
+	}
+	// Samples are stored big-endian, two bytes each.
+	for k := 0; k+1 < len(pix); k += 2 {
+		if pix[k] != pix[k+1] {
+			return 16
+		}
+	}
+	return 8
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// progressInterval is how often --progress-eta logs.
+	progressInterval = 2 * time.Second
+	// progressSmoothing is the time constant of the moving average of the
+	// throughput the estimate extrapolates from. Longer smooths more and
+	// follows changes in speed more slowly.
+	progressSmoothing = 30 * time.Second
+	// progressWarmup is how long to measure before giving an estimate, since
+	// the first rows also pay for caches warming up and goroutines starting.
+	progressWarmup = 10 * time.Second
+)
+
+// progress counts the scanlines a merge has finished for --progress-eta and
+// logs the percentage done, with an estimate of the time left, from its own
+// goroutine. A nil *progress ignores every call, so callers don't have to
+// check the flag.
+type progress struct {
+	label    string
+	total    int64
+	done     int64 // updated atomically
+	reported int64 // highest value snapshot has returned, updated atomically
+	lanes    []progressLane
+	quit     chan struct{}
+}
+
+// progressLane is the share of the work one --merge-workers strip does, for
+// --strict-monotonic-progress.
+type progressLane struct {
+	done  int64 // updated atomically
+	total int64
+}
+
+// startProgress starts reporting on total scanlines of work, or returns nil
+// without --progress-eta.
+func startProgress(label string, total int) *progress {
+	if !*progressETAFlag || total <= 0 {
+		return nil
+	}
+	p := &progress{label: label, total: int64(total), quit: make(chan struct{})}
+	go p.report(time.Now())
+	return p
+}
+
+// split divides the work into lanes of the given sizes, one per worker, with
+// --strict-monotonic-progress. It must be called before any worker starts.
+func (p *progress) split(sizes []int) {
+	if p == nil || !*strictProgressFlag || len(sizes) < 2 {
+		return
+	}
+	p.lanes = make([]progressLane, len(sizes))
+	for i, n := range sizes {
+		p.lanes[i].total = int64(n)
+	}
+}
+
+// step records one more finished scanline.
+func (p *progress) step() {
+	p.add(1)
+}
+
+// stepLane records one more finished scanline in lane i, or without lanes
+// the same as step.
+func (p *progress) stepLane(i int) {
+	if p == nil {
+		return
+	}
+	if p.lanes != nil {
+		atomic.AddInt64(&p.lanes[i].done, 1)
+	}
+	atomic.AddInt64(&p.done, 1)
+}
+
+// add records n more finished scanlines, such as those of a skipped file.
+func (p *progress) add(n int) {
+	if p != nil {
+		atomic.AddInt64(&p.done, int64(n))
+	}
+}
+
+// stop ends the reports.
+func (p *progress) stop() {
+	if p != nil {
+		close(p.quit)
+	}
+}
+
+// snapshot returns the number of scanlines to report as done. With lanes
+// that is the boundary every worker has reached, the smallest fraction of
+// its own lane any worker has finished applied to the total, rather than the
+// sum, so a fast worker can't make the percentage run ahead of a slow one.
+// Either way the result never decreases from one call to the next, even
+// when several goroutines call it at once: each lane only grows, but a call
+// reads the lanes one at a time, so a call that started earlier can compute
+// a smaller value than one that already returned. The highest value returned
+// is kept in reported and raised with compare-and-swap, and a smaller value
+// returns it instead.
+func (p *progress) snapshot() int64 {
+	v := atomic.LoadInt64(&p.done)
+	if p.lanes != nil {
+		frac := 1.0
+		for i := range p.lanes {
+			l := &p.lanes[i]
+			if l.total > 0 {
+				frac = math.Min(frac, float64(atomic.LoadInt64(&l.done))/float64(l.total))
+			}
+		}
+		v = int64(frac * float64(p.total))
+	}
+	for {
+		r := atomic.LoadInt64(&p.reported)
+		if v <= r {
+			return r
+		}
+		if atomic.CompareAndSwapInt64(&p.reported, r, v) {
+			return v
+		}
+	}
+}
+
+// report logs every progressInterval until stop is called. The estimate
+// divides the remaining scanlines by an exponential moving average of the
+// measured scanlines per second, seeded with the average so far once
+// progressWarmup has passed.
+func (p *progress) report(start time.Time) {
+	t := time.NewTicker(progressInterval)
+	defer t.Stop()
+	last, lastDone := start, int64(0)
+	rate := 0.0
+	for {
+		select {
+		case <-p.quit:
+			return
+		case now := <-t.C:
+			done := p.snapshot()
+			dt := now.Sub(last).Seconds()
+			switch {
+			case now.Sub(start) < progressWarmup || done == 0:
+			case rate == 0:
+				rate = float64(done) / now.Sub(start).Seconds()
+			default:
+				alpha := 1 - math.Exp(-dt/progressSmoothing.Seconds())
+				rate += alpha * (float64(done-lastDone)/dt - rate)
+			}
+			last, lastDone = now, done
+
+			pct := 100 * float64(done) / float64(p.total)
+			if rate <= 0 {
+				log.Printf("%v: %.1f%% of %v scanlines, estimating time left", p.label, pct, p.total)
+				continue
+			}
+			left := time.Duration(float64(p.total-done) / rate * float64(time.Second))
+			log.Printf("%v: %.1f%% of %v scanlines, about %v left", p.label, pct, p.total, left.Round(time.Second))
+		}
+	}
+}
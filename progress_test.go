@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestProgressMonotonic hammers the progress counter from several workers of
+// uneven strips while other goroutines sample it, with and without
+// --strict-monotonic-progress, and checks that no sampler ever sees the
+// reported value decrease or pass the total.
+func TestProgressMonotonic(t *testing.T) {
+	defer func(s bool) { *strictProgressFlag = s }(*strictProgressFlag)
+	for _, strict := range []bool{false, true} {
+		*strictProgressFlag = strict
+		sizes := []int{1000, 3000, 500, 2500}
+		total := 0
+		for _, n := range sizes {
+			total += n
+		}
+		p := &progress{label: "test", total: int64(total)}
+		p.split(sizes)
+		if strict != (p.lanes != nil) {
+			t.Fatalf("--strict-monotonic-progress=%v: lanes = %v", strict, p.lanes)
+		}
+
+		var workers, samplers sync.WaitGroup
+		quit := make(chan struct{})
+		errs := make(chan string, 4)
+		for s := 0; s < 4; s++ {
+			samplers.Add(1)
+			go func() {
+				defer samplers.Done()
+				last := int64(0)
+				for {
+					select {
+					case <-quit:
+						return
+					default:
+					}
+					v := p.snapshot()
+					if v < last || v > p.total {
+						errs <- fmt.Sprintf("reported progress went from %v to %v", last, v)
+						return
+					}
+					last = v
+				}
+			}()
+		}
+		for i, n := range sizes {
+			workers.Add(1)
+			go func(i, n int) {
+				defer workers.Done()
+				for j := 0; j < n; j++ {
+					p.stepLane(i)
+				}
+			}(i, n)
+		}
+		workers.Wait()
+		close(quit)
+		samplers.Wait()
+		close(errs)
+		for e := range errs {
+			t.Errorf("--strict-monotonic-progress=%v: %v", strict, e)
+		}
+		if got := p.snapshot(); got != p.total {
+			t.Errorf("--strict-monotonic-progress=%v: finished at %v of %v", strict, got, p.total)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// inputRegions holds the --regions rectangle for each input in the order of
+// the paths being merged, relative to the top-left corner of the image, or is
+// nil when every input is valid everywhere.
+var inputRegions []image.Rectangle
+
+// loadRegions reads a --regions manifest. Each line names an input and the
+// rectangle it is valid within as 'path x y width height'. Blank lines and
+// lines starting with '#' are skipped. Inputs the manifest doesn't name are
+// valid everywhere. The result is indexed like paths.
+func loadRegions(manifest string, paths []string) ([]image.Rectangle, error) {
+	f, err := os.Open(manifest)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	index := map[string]int{}
+	for i, p := range paths {
+		index[filepath.Clean(p)] = i
+	}
+	regions := make([]image.Rectangle, len(paths))
+	everywhere := image.Rect(-1<<30, -1<<30, 1<<30, 1<<30)
+	for i := range regions {
+		regions[i] = everywhere
+	}
+
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("line %v: want 'path x y width height', got %q", line, text)
+		}
+		i, ok := index[filepath.Clean(fields[0])]
+		if !ok {
+			return nil, fmt.Errorf("line %v: %v is not one of the inputs", line, fields[0])
+		}
+		var v [4]int
+		for k, field := range fields[1:] {
+			v[k], err = strconv.Atoi(field)
+			if err != nil {
+				return nil, fmt.Errorf("line %v: failed to parse %q: %v", line, field, err)
+			}
+		}
+		if v[2] <= 0 || v[3] <= 0 {
+			return nil, fmt.Errorf("line %v: width and height must be positive", line)
+		}
+		regions[i] = image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3])
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return regions, nil
+}
+
+// regionColors is colors restricted to the images whose --regions rectangle
+// contains x, y.
+func regionColors(x, y int, images []image.Image) []color.Color {
+	out := []color.Color{}
+	for idx, i := range images {
+		if covers(idx, i, x, y) {
+			out = append(out, i.At(x, y))
+		}
+	}
+	return out
+}
+
+// covers reports whether image i, at index idx of the inputs, contributes a
+// sample at x, y under --regions.
+func covers(idx int, i image.Image, x, y int) bool {
+	if inputRegions == nil {
+		return true
+	}
+	origin := i.Bounds().Min
+	return image.Pt(x-origin.X, y-origin.Y).In(inputRegions[idx])
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"text/tabwriter"
+)
+
+// rejectDim is how much of the output's brightness the reject report keeps
+// underneath its heat overlay.
+const rejectDim = 0.4
+
+// rejectReport returns a dimmed copy of out with a heat color blended over
+// every pixel where samples were rejected. The color runs from blue, for a
+// few rejections, through green and yellow to red, where every sample but one
+// was rejected, and is blended more strongly the more samples were rejected.
+// kept and total are as passed to finish.
+func rejectReport(out *image.RGBA, kept []int, total int) *image.RGBA {
+	b := out.Bounds()
+	report := image.NewRGBA(b)
+	for k, n := range kept {
+		x, y := b.Min.X+k%b.Dx(), b.Min.Y+k/b.Dx()
+		c := out.RGBAAt(x, y)
+		r, g, bl := rejectDim*float64(c.R), rejectDim*float64(c.G), rejectDim*float64(c.B)
+
+		if rejected := total - n; rejected > 0 && total > 1 {
+			t := float64(rejected) / float64(total-1)
+			hr, hg, hb := heat(t)
+			w := 0.35 + 0.5*t
+			r, g, bl = (1-w)*r+w*hr, (1-w)*g+w*hg, (1-w)*bl+w*hb
+		}
+		report.SetRGBA(x, y, color.RGBA{uint8(r), uint8(g), uint8(bl), 0xff})
+	}
+	return report
+}
+
+// validMask returns a mask of bounds b that is white where kept says at least
+// one sample went into the output pixel and black where none did. kept is as
+// passed to finish.
+func validMask(b image.Rectangle, kept []int) *image.Gray {
+	mask := image.NewGray(b)
+	for k, n := range kept {
+		if n > 0 {
+			mask.SetGray(b.Min.X+k%b.Dx(), b.Min.Y+k/b.Dx(), color.Gray{0xff})
+		}
+	}
+	return mask
+}
+
+// heat maps t in [0, 1] onto a blue, green, yellow, red color ramp.
+func heat(t float64) (r, g, b float64) {
+	stops := [][3]float64{{0, 0, 255}, {0, 255, 0}, {255, 255, 0}, {255, 0, 0}}
+	if t >= 1 {
+		s := stops[len(stops)-1]
+		return s[0], s[1], s[2]
+	}
+	f := t * float64(len(stops)-1)
+	i := int(f)
+	f -= float64(i)
+	lo, hi := stops[i], stops[i+1]
+	return lo[0] + f*(hi[0]-lo[0]), lo[1] + f*(hi[1]-lo[1]), lo[2] + f*(hi[2]-lo[2])
+}
+
+// writePixelReport prints the --pixel-format-report table for mode to w. kept
+// and total are as passed to finish.
+func writePixelReport(w io.Writer, mode string, kept []int, total int) {
+	pixels := len(kept)
+	histogram := make([]int, total+1)
+	for _, n := range kept {
+		histogram[n]++
+	}
+	// The spatiotemporal filter fills pixels with no kept samples from their
+	// neighborhood. Otherwise they are pixels no --regions rectangle covers,
+	// or rows an interrupt kept from being merged, and are left transparent.
+	filled := histogram[0]
+	filledLabel := "filled from neighborhood"
+	if *filterFlag != "spatiotemporal" || mode != "sigma" {
+		filledLabel = "no samples"
+	}
+	identical, clipped := int(identicalPixels), int(clippedPixels)
+	averaged := pixels - identical - filled
+	pct := func(n int) string {
+		return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(pixels))
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "pixel format report for --mode=%v: %v pixels, %v samples each\n", mode, pixels, total)
+	fmt.Fprintf(tw, "\taveraged\t%v\t%v\t\n", averaged, pct(averaged))
+	fmt.Fprintf(tw, "\tidentical samples\t%v\t%v\t\n", identical, pct(identical))
+	fmt.Fprintf(tw, "\t%v\t%v\t%v\t\n", filledLabel, filled, pct(filled))
+	fmt.Fprintf(tw, "\tclamped\t%v\t%v\t\n", clipped, pct(clipped))
+	tw.Flush()
+	fmt.Fprintf(w, "surviving samples per pixel:\n")
+	for n, count := range histogram {
+		if count > 0 {
+			fmt.Fprintf(tw, "\t%v\t%v\t%v\t\n", n, count, pct(count))
+		}
+	}
+	tw.Flush()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidMask(t *testing.T) {
+	b := image.Rect(2, 3, 5, 5)
+	mask := validMask(b, []int{3, 0, 1, 0, 2, 0})
+	want := []uint8{0xff, 0, 0xff, 0, 0xff, 0}
+	for k, w := range want {
+		x, y := b.Min.X+k%b.Dx(), b.Min.Y+k/b.Dx()
+		if got := mask.GrayAt(x, y).Y; got != w {
+			t.Errorf("mask at x=%v y=%v = %v; want %v", x, y, got, w)
+		}
+	}
+}
+
+// TestOnEmptyLeavesRejectedEmpty checks that a pixel where the filter
+// rejects every sample fails the merge, even with --mask-output, and that
+// with --on-empty=transparent it is left transparent with nothing kept.
+func TestOnEmptyLeavesRejectedEmpty(t *testing.T) {
+	defer func(n float64, mask, empty string) { *nFlag, *maskOutputFlag, *onEmptyFlag = n, mask, empty }(*nFlag, *maskOutputFlag, *onEmptyFlag)
+	*nFlag = 0.1
+	defer func() { emptyPixels = 0 }()
+
+	var images []image.Image
+	for _, v := range []uint8{0, 255} {
+		img := image.NewGray(image.Rect(0, 0, 2, 1))
+		img.SetGray(0, 0, color.Gray{v})
+		img.SetGray(1, 0, color.Gray{100})
+		images = append(images, img)
+	}
+	reduce, err := newReducer("sigma", images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	*maskOutputFlag = "mask.jpeg"
+	if _, _, err := mergeImages(images, reduce); err == nil {
+		t.Errorf("mergeImages with --on-empty=fail and --mask-output succeeded; want it to fail")
+	}
+
+	*onEmptyFlag = "transparent"
+	out, kept, err := mergeImages(images, reduce)
+	if err != nil {
+		t.Fatalf("mergeImages failed: %v", err)
+	}
+	if emptyPixels != 1 {
+		t.Errorf("emptyPixels = %v; want 1", emptyPixels)
+	}
+	if kept[0] != 0 || kept[1] != 2 {
+		t.Errorf("kept = %v; want [0 2]", kept)
+	}
+	if got := out.RGBAAt(0, 0); got != (color.RGBA{}) {
+		t.Errorf("rejected pixel is %v; want transparent black", got)
+	}
+	if got := out.RGBAAt(1, 0); got != (color.RGBA{100, 100, 100, 255}) {
+		t.Errorf("kept pixel is %v; want the shared gray", got)
+	}
+}
+
+// TestRejectIsolatedLeavesEmpty checks that with --reject-isolated a pixel
+// where a single sample survives is handled like one where none do: it fails
+// the merge with --on-empty=fail, and with --on-empty=transparent is left
+// transparent with nothing kept and counted, for each filter that honors the
+// flag and for --streaming.
+func TestRejectIsolatedLeavesEmpty(t *testing.T) {
+	defer func(n float64, empty string, iso, dec bool, filter, perChannel string, cf []string) {
+		*nFlag, *onEmptyFlag, *rejectIsolatedFlag, *decoupleAlphaFlag = n, empty, iso, dec
+		*filterFlag, *filterPerChannelFlag, channelFilters = filter, perChannel, cf
+	}(*nFlag, *onEmptyFlag, *rejectIsolatedFlag, *decoupleAlphaFlag, *filterFlag, *filterPerChannelFlag, channelFilters)
+	*nFlag, *rejectIsolatedFlag = 0.2, true
+	defer func() { emptyPixels = 0 }()
+
+	// At x=0 only the 100 survives N=0.2; at x=1 every sample agrees.
+	var images []image.Image
+	var paths []string
+	for i, v := range []uint8{0, 100, 255} {
+		img := image.NewGray(image.Rect(0, 0, 2, 1))
+		img.SetGray(0, 0, color.Gray{v})
+		img.SetGray(1, 0, color.Gray{100})
+		images = append(images, img)
+		path := filepath.Join(t.TempDir(), fmt.Sprintf("%v.png", i))
+		if err := writeImageAtomic(path, img); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	check := func(name string, out *image.RGBA, kept []int) {
+		if kept[0] != 0 || kept[1] != 3 {
+			t.Errorf("%v: kept = %v; want [0 3]", name, kept)
+		}
+		if got := out.RGBAAt(0, 0); got != (color.RGBA{}) {
+			t.Errorf("%v: isolated pixel is %v; want transparent black", name, got)
+		}
+	}
+
+	for _, tc := range []struct {
+		name       string
+		filter     string
+		perChannel string
+		decouple   bool
+	}{
+		{"stddev", "stddev", "", false},
+		{"--filter-per-channel", "stddev", "R:stddev", false},
+		{"--decouple-alpha", "stddev", "", true},
+		{"--filter=largest-cluster", "largest-cluster", "", false},
+	} {
+		*filterFlag, *filterPerChannelFlag, *decoupleAlphaFlag = tc.filter, tc.perChannel, tc.decouple
+		channelFilters = nil
+		if tc.perChannel != "" {
+			channelFilters, _ = parseChannelFilters(tc.perChannel)
+		}
+		reduce, err := newReducer("sigma", images)
+		if err != nil {
+			t.Fatal(err)
+		}
+		*onEmptyFlag = "fail"
+		if _, _, err := mergeImages(images, reduce); err == nil {
+			t.Errorf("%v: mergeImages with --on-empty=fail succeeded; want it to fail", tc.name)
+		}
+		*onEmptyFlag = "transparent"
+		out, kept, err := mergeImages(images, reduce)
+		if err != nil {
+			t.Fatalf("%v: mergeImages failed: %v", tc.name, err)
+		}
+		check(tc.name, out, kept)
+	}
+
+	*filterFlag, *filterPerChannelFlag, *decoupleAlphaFlag, channelFilters = "stddev", "", false, nil
+	*onEmptyFlag = "fail"
+	if _, _, _, err := streamAverage(paths); err == nil {
+		t.Errorf("--streaming with --on-empty=fail succeeded; want it to fail")
+	}
+	*onEmptyFlag = "transparent"
+	out, kept, _, err := streamAverage(paths)
+	if err != nil {
+		t.Fatalf("--streaming: %v", err)
+	}
+	check("--streaming", out, kept)
+	if emptyPixels != 1 {
+		t.Errorf("--streaming: emptyPixels = %v; want 1", emptyPixels)
+	}
+}
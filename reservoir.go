@@ -0,0 +1,46 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"sort"
+)
+
+// sampleRand picks the samples --max-samples-per-pixel keeps, or is nil when
+// every sample is kept. Pixels are visited in a fixed order, so a given seed
+// keeps the same samples on every run.
+var sampleRand *rand.Rand
+
+// pixelColors returns the colors at x, y that mergeImages combines: those of
+// every image, or a sample of --max-samples-per-pixel of them.
+func pixelColors(x, y int, images []image.Image) []color.Color {
+	if sampleRand != nil {
+		return sampledColors(x, y, images, *maxSamplesFlag)
+	}
+	return colors(x, y, images)
+}
+
+// sampledColors returns the colors of at most k of images at x, y, chosen
+// uniformly at random with reservoir sampling, so only k colors are held no
+// matter how many images there are. The kept colors stay in input order.
+func sampledColors(x, y int, images []image.Image, k int) []color.Color {
+	if len(images) <= k {
+		return colors(x, y, images)
+	}
+	picked := make([]int, k)
+	for i := range picked {
+		picked[i] = i
+	}
+	for i := k; i < len(images); i++ {
+		if j := sampleRand.Intn(i + 1); j < k {
+			picked[j] = i
+		}
+	}
+	sort.Ints(picked)
+	out := make([]color.Color, k)
+	for n, i := range picked {
+		out[n] = images[i].At(x, y)
+	}
+	return out
+}
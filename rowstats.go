@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"strconv"
+)
+
+// rowSpread holds, for each row of the last merge, the sum over its pixels of
+// the mean R, G and B sample standard deviation, when --row-stats is set.
+var rowSpread []float64
+
+// sampleSpread is the mean of the R, G and B sample standard deviations of
+// colors, taken before any rejection. It is 0 for a single sample.
+func sampleSpread(colors []color.Color) float64 {
+	if len(colors) < 2 {
+		return 0
+	}
+	var chans [3][]float64
+	for _, c := range colors {
+		r, g, b, _ := c.RGBA()
+		chans[0] = append(chans[0], float64(r))
+		chans[1] = append(chans[1], float64(g))
+		chans[2] = append(chans[2], float64(b))
+	}
+	sum := 0.0
+	for _, xs := range chans {
+		s, err := sampleStddev(xs)
+		if err != nil || math.IsNaN(s) {
+			continue
+		}
+		sum += s
+	}
+	return sum / 3
+}
+
+// writeRowStats writes --row-stats for out as CSV, with one line per row
+// giving its mean brightness, mean number of surviving samples and mean spread
+// of the input samples. Brightness and spread are on the 0-255 scale. kept is
+// as passed to finish.
+func writeRowStats(path string, out *image.RGBA, kept []int) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create --row-stats %v: %v", path, err)
+	}
+	defer f.Close()
+
+	b := out.Bounds()
+	w := csv.NewWriter(f)
+	w.Write([]string{"y", "mean_brightness", "mean_kept", "mean_stddev"})
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		bright, n := 0.0, 0
+		for x := b.Min.X; x < b.Max.X; x++ {
+			bright += brightness(out, x, y)
+			n += kept[(y-b.Min.Y)*b.Dx()+(x-b.Min.X)]
+		}
+		width := float64(b.Dx())
+		w.Write([]string{
+			strconv.Itoa(y),
+			fmt.Sprintf("%.3f", bright/width/257),
+			fmt.Sprintf("%.3f", float64(n)/width),
+			fmt.Sprintf("%.3f", rowSpread[y-b.Min.Y]/width/257),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("failed to write --row-stats %v: %v", path, err)
+	}
+	if summary != nil {
+		summary.Files = append(summary.Files, path)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// safeModeSamples is how many pixels of the inputs --safe-mode runs through
+// meanColor to estimate the merge time.
+const safeModeSamples = 1000
+
+// safeModePreflight implements --safe-mode. Before any pixels are merged it
+// decodes every input once to prove it can be read, checks they share one
+// size, estimates memory and run time, and refuses to overwrite files unless
+// --force is set. It then prints the plan to out and proceeds only if the user
+// answers yes on in.
+func safeModePreflight(paths []string, in io.Reader, out io.Writer) error {
+	var bounds image.Rectangle
+	var decodeTime time.Duration
+	var inputBytes int64
+	samples := make([][]color.Color, safeModeSamples)
+	for idx, p := range paths {
+		start := time.Now()
+		i, err := decodeFile(p)
+		if err != nil {
+			return err
+		}
+		decodeTime += time.Since(start)
+		if idx == 0 {
+			bounds = i.Bounds()
+		} else if i.Bounds() != bounds {
+			return fmt.Errorf("%v is %vx%v but %v is %vx%v", p, i.Bounds().Dx(), i.Bounds().Dy(), paths[0], bounds.Dx(), bounds.Dy())
+		}
+		size, err := decodedSize(p)
+		if err != nil {
+			return err
+		}
+		inputBytes += size
+
+		// Keep a spread of pixels from every image to time the merge on.
+		pixels := bounds.Dx() * bounds.Dy()
+		for k := range samples {
+			q := k * pixels / len(samples)
+			samples[k] = append(samples[k], i.At(bounds.Min.X+q%bounds.Dx(), bounds.Min.Y+q/bounds.Dx()))
+		}
+	}
+
+	start := time.Now()
+	for _, s := range samples {
+		meanColor(nil, s, nil, *nFlag)
+	}
+	pixels := int64(bounds.Dx() * bounds.Dy())
+	mergeTime := time.Since(start) * time.Duration(pixels) / time.Duration(len(samples))
+
+	passes := time.Duration(1)
+	memory := inputBytes + 4*pixels
+	if *streamingFlag {
+		passes = 2
+		memory = inputBytes/int64(len(paths)) + 100*pixels
+	}
+	estimate := passes*decodeTime + mergeTime
+
+	outputs := plannedOutputs(paths)
+	existing := []string{}
+	for _, o := range outputs {
+		if _, err := os.Stat(o); err == nil {
+			existing = append(existing, o)
+		}
+	}
+	if len(existing) > 0 && !*forceFlag && !*resumeSafeFlag {
+		return fmt.Errorf("refusing to overwrite existing files without --force: %v", strings.Join(existing, ", "))
+	}
+
+	fmt.Fprintf(out, "safe mode plan:\n")
+	fmt.Fprintf(out, "  inputs:    %v files, all %vx%v, all decoded successfully\n", len(paths), bounds.Dx(), bounds.Dy())
+	fmt.Fprintf(out, "  memory:    about %.1f MiB\n", float64(memory)/(1<<20))
+	fmt.Fprintf(out, "  run time:  about %v\n", estimate.Round(time.Millisecond))
+	for _, o := range outputs {
+		note := ""
+		for _, e := range existing {
+			if e == o {
+				note = " (overwrites existing file)"
+				if *resumeSafeFlag && !*forceFlag {
+					note = " (exists; written under a numbered name)"
+				}
+			}
+		}
+		fmt.Fprintf(out, "  writes:    %v%v\n", o, note)
+	}
+	fmt.Fprintf(out, "Proceed? [y/N] ")
+
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return fmt.Errorf("not confirmed")
+}
+
+// plannedOutputs lists the files the run will write for the inputs at paths,
+// as far as they are known before merging, using the same functions that
+// name them when they are written.
+func plannedOutputs(paths []string) []string {
+	outputs := []string{}
+	switch {
+	case *compareModesFlag:
+		for _, m := range modeNames {
+			outputs = append(outputs, outputFiles(m, compareOutputPath(m, len(paths)))...)
+		}
+	case *modeFlag == "difference-amplify":
+		outputs = differencePaths(outputPath(*modeFlag, len(paths)), paths)
+	default:
+		outputs = outputFiles(*modeFlag, outputPath(*modeFlag, len(paths)))
+	}
+	if *madOutputFlag != "" {
+		outputs = append(outputs, *madOutputFlag)
+	}
+	if *checkpointOutFlag != "" {
+		outputs = append(outputs, *checkpointOutFlag)
+	}
+	return outputs
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestPlannedOutputs runs the tool in a child process with each flag that
+// writes a file, and checks that the files --safe-mode plans to write are
+// exactly the ones the run created.
+func TestPlannedOutputs(t *testing.T) {
+	if os.Getenv("AVERAGE_IMAGE_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	for _, tc := range []struct {
+		name string
+		args []string
+	}{
+		{"output", nil},
+		{"source-map", []string{"-source-map=source.png"}},
+		{"reject-report-image", []string{"-reject-report-image=rejects.png"}},
+		{"mask-output", []string{"-mask-output=mask.png"}},
+		{"row-stats", []string{"-row-stats=rows.csv"}},
+		{"histogram-output", []string{"-histogram-output=histogram.csv"}},
+		{"mad-output", []string{"-mad-output=mad.png"}},
+		{"preserve-gray-transparency", []string{"-preserve-gray-transparency"}},
+		{"accumulate", []string{"-accumulate=out.png"}},
+		{"checkpoint-output", []string{"-streaming", "-checkpoint-every=1", "-checkpoint-output=checkpoint.png"}},
+		{"compare-modes", []string{"-compare-modes", "-mask-output=mask.png"}},
+		{"difference-amplify", []string{"-mode=difference-amplify"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			paths := writeGrayFrames(t, dir, 3, 8, 8)
+			args := append([]string{"-path=0*.png", "-output=out.png"}, tc.args...)
+
+			cmd := exec.Command(os.Args[0], append([]string{"-test.run=^TestPlannedOutputs$"}, args...)...)
+			cmd.Dir = dir
+			cmd.Env = append(os.Environ(), "AVERAGE_IMAGE_MAIN=1")
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("run with %v failed: %v\n%s", args, err, out)
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			written := []string{}
+			for _, e := range entries {
+				if !strings.HasPrefix(e.Name(), "0") {
+					written = append(written, e.Name())
+				}
+			}
+
+			for _, a := range args {
+				kv := strings.SplitN(strings.TrimPrefix(a, "-"), "=", 2)
+				if len(kv) == 1 {
+					kv = append(kv, "true")
+				}
+				defer func(name, v string) { flag.Set(name, v) }(kv[0], flag.Lookup(kv[0]).Value.String())
+				if err := flag.Set(kv[0], kv[1]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			names := make([]string, len(paths))
+			for i, p := range paths {
+				names[i] = filepath.Base(p)
+			}
+			planned := plannedOutputs(names)
+			sort.Strings(planned)
+			if !reflect.DeepEqual(planned, written) {
+				t.Errorf("with %v, planned %v; want the files written, %v", args, planned, written)
+			}
+		})
+	}
+}
+
+// writeGrayFrames writes n noisy w×h grayscale PNGs to dir and returns their
+// paths.
+func writeGrayFrames(t *testing.T, dir string, n, w, h int) []string {
+	rng := rand.New(rand.NewSource(1))
+	var paths []string
+	for i := 0; i < n; i++ {
+		img := image.NewGray(image.Rect(0, 0, w, h))
+		for k := range img.Pix {
+			img.Pix[k] = uint8(100 + rng.Intn(50))
+		}
+		path := filepath.Join(dir, fmt.Sprintf("%04d.png", i))
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := png.Encode(f, img); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
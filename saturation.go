@@ -0,0 +1,43 @@
+package main
+
+import "image/color"
+
+// saturatedPixels counts the output pixels of the current merge where every
+// sample was near-saturated, so --reject-saturated kept them all. Each merge
+// resets it.
+var saturatedPixels int64
+
+// unsaturated drops every sample of colors with a red, green or blue channel
+// within --reject-saturated of 0 or 0xffff. Channels are compared as straight
+// color, so a dim but opaque-looking channel of a translucent sample isn't
+// mistaken for clipped shadow, and fully transparent samples are kept for the
+// reducer to weigh as usual. If every sample is near-saturated, as in a blown
+// out sky that was white in every input, they are all kept.
+func unsaturated(colors []color.Color) []color.Color {
+	t := uint32(*rejectSaturatedFlag)
+	out := []color.Color{}
+	for _, c := range colors {
+		if !saturated(c, t) {
+			out = append(out, c)
+		}
+	}
+	if len(out) == 0 {
+		count(&saturatedPixels)
+		return colors
+	}
+	return out
+}
+
+func saturated(c color.Color, t uint32) bool {
+	r, g, b, a := c.RGBA()
+	if a == 0 {
+		return false
+	}
+	for _, v := range [3]uint32{r, g, b} {
+		v = v * 0xffff / a
+		if v <= t || v >= 0xffff-t {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// lanczos is the Lanczos kernel with a support of 3. golang.org/x/image/draw
+// only ships lower-order kernels, but accepts any draw.Kernel.
+var lanczos = &draw.Kernel{Support: 3, At: func(t float64) float64 {
+	if t == 0 {
+		return 1
+	}
+	if t < -3 || t > 3 {
+		return 0
+	}
+	pt := math.Pi * t
+	return 3 * math.Sin(pt) * math.Sin(pt/3) / (pt * pt)
+}}
+
+// resampler returns the --resample-filter scaler for resizing a w by h image
+// to dw by dh. The default, "auto", uses nearest neighbor when each output
+// pixel covers a whole number of input pixels and Catmull-Rom otherwise.
+func resampler(w, h, dw, dh int) (draw.Scaler, error) {
+	switch *resampleFilterFlag {
+	case "auto":
+		if dw < w && dh < h && w%dw == 0 && h%dh == 0 {
+			return draw.NearestNeighbor, nil
+		}
+		return draw.CatmullRom, nil
+	case "nearest":
+		return draw.NearestNeighbor, nil
+	case "bilinear":
+		return draw.BiLinear, nil
+	case "catmull-rom":
+		return draw.CatmullRom, nil
+	case "lanczos":
+		return lanczos, nil
+	}
+	return nil, fmt.Errorf("unknown --resample-filter %q; must be 'auto', 'nearest', 'bilinear', 'catmull-rom' or 'lanczos'", *resampleFilterFlag)
+}
+
+// parsePixelAspect parses a --pixel-aspect ratio given as W:H, such as '4:3',
+// and returns W/H.
+func parsePixelAspect(aspect string) (float64, error) {
+	parts := strings.Split(aspect, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("%q is not of the form W:H", aspect)
+	}
+	w, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid width in %q: %v", aspect, err)
+	}
+	h, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid height in %q: %v", aspect, err)
+	}
+	if !(w > 0 && h > 0) || math.IsInf(w, 0) || math.IsInf(h, 0) {
+		return 0, fmt.Errorf("both sides of %q must be positive", aspect)
+	}
+	return w / h, nil
+}
+
+// scaleOutput resizes out as requested by --pixel-aspect, then by
+// --scale-output or --scale-output-factor, returning it unchanged if none are
+// set. --pixel-aspect stretches whichever side makes the pixels square, so no
+// detail is lost: wide pixels widen the image and tall pixels heighten it.
+func scaleOutput(out *image.RGBA) *image.RGBA {
+	b := out.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if *pixelAspectFlag != "" {
+		// Validated in main.
+		ratio, _ := parsePixelAspect(*pixelAspectFlag)
+		if ratio > 1 {
+			w = int(math.Round(float64(w) * ratio))
+		} else {
+			h = int(math.Round(float64(h) / ratio))
+		}
+	}
+	switch {
+	case *scaleOutputFlag != "":
+		// Validated in main.
+		w, h, _ = parseDimensions(*scaleOutputFlag)
+	case *scaleOutputFactorFlag != 0:
+		w = int(math.Max(1, math.Round(float64(w)**scaleOutputFactorFlag)))
+		h = int(math.Max(1, math.Round(float64(h)**scaleOutputFactorFlag)))
+	}
+	if w == b.Dx() && h == b.Dy() {
+		return out
+	}
+
+	// Validated in main.
+	s, _ := resampler(b.Dx(), b.Dy(), w, h)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	s.Scale(dst, dst.Bounds(), out, b, draw.Src, nil)
+	return dst
+}
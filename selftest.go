@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+)
+
+// selfTestSize is the width and height of the synthetic --self-test inputs.
+const selfTestSize = 16
+
+// selfTestCase is one --self-test check: inputs whose merge with mode has a
+// known exact answer.
+type selfTestCase struct {
+	name   string
+	mode   string
+	inputs []*image.RGBA
+	want   *image.RGBA
+	// slowPath turns off --preserve-exact-when-identical for the case.
+	slowPath bool
+}
+
+// selfTest implements --self-test. It resets every flag to its default, merges
+// synthetic inputs with known answers through the in-memory and streaming
+// paths and a PNG round trip, and writes one line per check to w. It returns
+// an error if any check fails.
+func selfTest(w io.Writer) error {
+	flag.VisitAll(func(f *flag.Flag) {
+		f.Value.Set(f.DefValue)
+	})
+
+	failed := 0
+	for _, c := range selfTestCases() {
+		err := runSelfTestCase(c)
+		if err == nil {
+			fmt.Fprintf(w, "ok      %v\n", c.name)
+			continue
+		}
+		fmt.Fprintf(w, "FAILED  %v: %v\n", c.name, err)
+		failed++
+	}
+	if failed > 0 {
+		return fmt.Errorf("%v checks failed", failed)
+	}
+	return nil
+}
+
+func selfTestCases() []selfTestCase {
+	rng := rand.New(rand.NewSource(1))
+	noise := solid(color.RGBA{})
+	for k := range noise.Pix {
+		noise.Pix[k] = uint8(rng.Intn(256))
+	}
+	for k := 3; k < len(noise.Pix); k += 4 {
+		noise.Pix[k] = 0xff
+	}
+	copies := []*image.RGBA{noise, noise, noise, noise}
+
+	// 10, 20, 30 and 40 average to exactly 25, and lie within 1.3 standard
+	// deviations of it, so sigma keeps them all.
+	var ramp []*image.RGBA
+	for _, v := range []uint8{10, 20, 30, 40} {
+		ramp = append(ramp, solid(color.RGBA{v, v, v, 0xff}))
+	}
+
+	// Nine agreeing inputs and one far outlier, which sigma rejects.
+	var outlier []*image.RGBA
+	for k := 0; k < 9; k++ {
+		outlier = append(outlier, solid(color.RGBA{100, 150, 200, 0xff}))
+	}
+	outlier = append(outlier, solid(color.RGBA{250, 0, 0, 0xff}))
+
+	return []selfTestCase{
+		{"identical inputs keep their exact value (sigma)", "sigma", copies, noise, false},
+		{"identical inputs keep their exact value without the fast path (sigma)", "sigma", copies, noise, true},
+		{"identical inputs keep their exact value (mean)", "mean", copies, noise, false},
+		{"identical inputs keep their exact value (median)", "median", copies, noise, false},
+		{"values with a round mean average exactly (sigma)", "sigma", ramp, solid(color.RGBA{25, 25, 25, 0xff}), false},
+		{"values with a round mean average exactly (mean)", "mean", ramp, solid(color.RGBA{25, 25, 25, 0xff}), false},
+		{"an outlier is rejected (sigma)", "sigma", outlier, solid(color.RGBA{100, 150, 200, 0xff}), false},
+		{"the median ignores an outlier", "median", outlier, solid(color.RGBA{100, 150, 200, 0xff}), false},
+	}
+}
+
+func solid(c color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, selfTestSize, selfTestSize))
+	for k := 0; k < len(img.Pix); k += 4 {
+		img.Pix[k], img.Pix[k+1], img.Pix[k+2], img.Pix[k+3] = c.R, c.G, c.B, c.A
+	}
+	return img
+}
+
+// runSelfTestCase merges c in memory, and also by streaming for sigma, and
+// checks that each result survives a PNG round trip as c.want.
+func runSelfTestCase(c selfTestCase) error {
+	*identicalFastPathFlag = !c.slowPath
+	defer func() { *identicalFastPathFlag = true }()
+	images := make([]image.Image, len(c.inputs))
+	for k, i := range c.inputs {
+		images[k] = i
+	}
+	reduce, err := newReducer(c.mode, images)
+	if err != nil {
+		return err
+	}
+	out, _, err := mergeImages(images, reduce)
+	if err != nil {
+		return err
+	}
+	if err := checkRoundTrip(out, c.want); err != nil {
+		return fmt.Errorf("in memory: %v", err)
+	}
+	if c.mode != "sigma" {
+		return nil
+	}
+
+	dir, err := os.MkdirTemp("", "average-image-self-test")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	paths := make([]string, len(c.inputs))
+	for k, i := range c.inputs {
+		paths[k] = filepath.Join(dir, fmt.Sprintf("%v.png", k))
+		f, err := os.Create(paths[k])
+		if err != nil {
+			return err
+		}
+		err = png.Encode(f, i)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	out, _, _, err = streamAverage(paths)
+	if err != nil {
+		return err
+	}
+	if err := checkRoundTrip(out, c.want); err != nil {
+		return fmt.Errorf("streaming: %v", err)
+	}
+	return nil
+}
+
+// checkRoundTrip encodes got as PNG, decodes it again and compares every pixel
+// with want.
+func checkRoundTrip(got, want *image.RGBA) error {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, got); err != nil {
+		return err
+	}
+	decoded, err := png.Decode(&buf)
+	if err != nil {
+		return err
+	}
+	b := want.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			g := color.RGBAModel.Convert(decoded.At(x, y)).(color.RGBA)
+			if w := want.RGBAAt(x, y); g != w {
+				return fmt.Errorf("pixel at x=%v y=%v is %v, want %v", x, y, g, w)
+			}
+		}
+	}
+	return nil
+}
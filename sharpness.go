@@ -0,0 +1,51 @@
+package main
+
+import (
+	"image"
+	"math"
+)
+
+// sharpnessRadius is the half-width of the neighborhood over which
+// --weighted-by-sharpness averages each image's edge strength.
+const sharpnessRadius = 2
+
+// sharpnessFloor keeps every weight positive, so flat areas where no image has
+// any edges still average all survivors equally.
+const sharpnessFloor = 1.0
+
+// sharpnessWeights returns, for each pixel, one weight per image for
+// --weighted-by-sharpness.
+//
+// An image's sharpness at a pixel is the magnitude of the Laplacian of its
+// brightness, averaged over the surrounding neighborhood. Crisp frames have
+// strong, narrow edges and so a larger Laplacian than slightly soft ones.
+func sharpnessWeights(images []image.Image) func(x, y int) []float64 {
+	bounds := images[0].Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	maps := make([][]float64, len(images))
+	for idx, i := range images {
+		v := make([]float64, w*h)
+		for k := range v {
+			v[k] = brightness(i, bounds.Min.X+k%w, bounds.Min.Y+k/w)
+		}
+		lap := make([]float64, w*h)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				// Edge pixels reuse themselves for missing neighbors.
+				up, down := v[maxInt(y-1, 0)*w+x], v[minInt(y+1, h-1)*w+x]
+				left, right := v[y*w+maxInt(x-1, 0)], v[y*w+minInt(x+1, w-1)]
+				lap[y*w+x] = math.Abs(up + down + left + right - 4*v[y*w+x])
+			}
+		}
+		maps[idx] = boxMean(lap, w, h, sharpnessRadius)
+	}
+
+	return func(x, y int) []float64 {
+		k := (y-bounds.Min.Y)*w + (x - bounds.Min.X)
+		weights := make([]float64, len(maps))
+		for idx, m := range maps {
+			weights[idx] = sharpnessFloor + m[k]
+		}
+		return weights
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"log"
+	"math"
+)
+
+// sourceIndex holds, for each pixel of the last merge in row-major order, the
+// index of the input that dominated it, or -1 where no input contributed. It
+// is only filled when --source-map is set.
+var sourceIndex []int
+
+// dominantSource returns the index of the image whose sample at x, y is
+// closest to the merged color c, which for median output is the image that
+// supplied the value and for weighted means is the image that pulled the
+// result the most. Ties go to the earliest image.
+func dominantSource(x, y int, images []image.Image, c color.Color) int {
+	cr, cg, cb, ca := c.RGBA()
+	best, bestDist := -1, math.Inf(1)
+	for idx, i := range images {
+		if !covers(idx, i, x, y) {
+			continue
+		}
+		r, g, b, a := i.At(x, y).RGBA()
+		d := sq(float64(r)-float64(cr)) + sq(float64(g)-float64(cg)) + sq(float64(b)-float64(cb)) + sq(float64(a)-float64(ca))
+		if d < bestDist {
+			best, bestDist = idx, d
+		}
+	}
+	return best
+}
+
+func sq(v float64) float64 { return v * v }
+
+// sourceColor returns the false color for input idx. Hues are spread by the
+// golden ratio so neighboring indices get clearly different colors.
+func sourceColor(idx int) color.RGBA {
+	h := math.Mod(float64(idx)*0.618033988749895, 1) * 6
+	x := 1 - math.Abs(math.Mod(h, 2)-1)
+	var r, g, b float64
+	switch int(h) {
+	case 0:
+		r, g = 1, x
+	case 1:
+		r, g = x, 1
+	case 2:
+		g, b = 1, x
+	case 3:
+		g, b = x, 1
+	case 4:
+		r, b = x, 1
+	default:
+		r, b = 1, x
+	}
+	return color.RGBA{uint8(r * 255), uint8(g * 255), uint8(b * 255), 0xff}
+}
+
+// sourceMap draws --source-map for the last merge, with bounds b, coloring
+// each pixel by its dominant input and leaving pixels with none black.
+func sourceMap(b image.Rectangle) *image.RGBA {
+	out := image.NewRGBA(b)
+	for k, idx := range sourceIndex {
+		c := color.RGBA{0, 0, 0, 0xff}
+		if idx >= 0 {
+			c = sourceColor(idx)
+		}
+		out.SetRGBA(b.Min.X+k%b.Dx(), b.Min.Y+k/b.Dx(), c)
+	}
+	return out
+}
+
+// logSourceColors logs which --source-map color stands for which of paths.
+func logSourceColors(paths []string) {
+	for idx, p := range paths {
+		c := sourceColor(idx)
+		log.Printf("--source-map: #%02x%02x%02x is %v", c.R, c.G, c.B, p)
+	}
+}
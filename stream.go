@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"math"
+)
+
+// streamAverage produces the same result as mergeImages with the sigma
+// reducer while holding only one decoded image in memory at a time.
+//
+// The first pass streams every file to accumulate per-pixel, per-channel sums
+// and sums of squares, from which the mean and sample standard deviation are
+// derived. The second pass streams every file again, rejects samples with
+// outlier, and accumulates the mean of the survivors. Memory use is a handful
+// of per-pixel accumulators regardless of how many files are read. Like
+// mergeImages, it also returns the number of samples behind each output pixel,
+// along with the number of files merged, which --on-size-change=skip can make
+// fewer than len(paths).
+func streamAverage(paths []string) (*image.RGBA, []int, int, error) {
+	bounds, err := inputBounds(paths[0])
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	pixels := bounds.Dx() * bounds.Dy()
+
+	total := len(paths)
+	p := startProgress("streaming", 2*total*bounds.Dy())
+	defer p.stop()
+
+	// Both passes store channels interleaved as R,G,B,A per pixel, in the
+	// --precision of the run.
+	sums, err := newAccumulator(4 * pixels)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	sumSqs, _ := newAccumulator(4 * pixels)
+	// A float32 sum of squares keeps too few digits to subtract the squared
+	// mean from, so in float32 the two accumulators instead hold the running
+	// mean and sum of squared deviations from it, updated as in Welford's
+	// algorithm.
+	running := *precisionFlag == "float32"
+	seen := 1.0
+	// Pass 2 reads only the files pass 1 merged, so both see the same
+	// inputs when --on-size-change=skip drops some.
+	paths, err = streamPass(paths, bounds, func(idx int, r, g, b, a uint32) {
+		for ch, v := range [4]uint32{r, g, b, a} {
+			x := float64(v)
+			if running {
+				d := x - sums.at(idx+ch)
+				sums.add(idx+ch, d/seen)
+				sumSqs.add(idx+ch, d*(x-sums.at(idx+ch)))
+				continue
+			}
+			sums.add(idx+ch, x)
+			sumSqs.add(idx+ch, x*x)
+		}
+	}, func(done int) {
+		seen = float64(done + 1)
+	}, p)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	p.add((total - len(paths)) * bounds.Dy())
+
+	// Turn the accumulators into means and sample standard deviations in
+	// place so the second pass needs no extra per-pixel storage for them.
+	n := float64(len(paths))
+	means, stddevs := sums, sumSqs
+	for k := 0; k < sums.len(); k++ {
+		m := sums.at(k) / n
+		variance := (sumSqs.at(k) - sums.at(k)*m) / (n - 1)
+		if running {
+			m, variance = sums.at(k), sumSqs.at(k)/(n-1)
+		}
+		// Rounding can leave a tiny negative variance for constant samples.
+		means.set(k, m)
+		stddevs.set(k, math.Sqrt(math.Max(variance, 0)))
+	}
+
+	filtered, _ := newAccumulator(4 * pixels)
+	counts := make([]int, pixels)
+	countRejections(paths)
+	current := 0
+	_, err = streamPass(paths, bounds, func(idx int, r, g, b, a uint32) {
+		n := *nFlag
+		if nMapScale != nil {
+			n *= nMapScale[idx/4]
+		}
+		for ch, v := range [4]uint32{r, g, b, a} {
+			if outlier(float64(v), means.at(idx+ch), stddevs.at(idx+ch), n) {
+				rejected(nil, current)
+				return
+			}
+		}
+		for ch, v := range [4]uint32{r, g, b, a} {
+			filtered.add(idx+ch, float64(v))
+		}
+		counts[idx/4]++
+	}, func(done int) {
+		current = done
+		if *checkpointOutFlag == "" || done%*checkpointEveryFlag != 0 || done == len(paths) {
+			return
+		}
+		if err := writeImageAtomic(*checkpointOutFlag, partialAverage(bounds, filtered, counts)); err != nil {
+			log.Printf("failed to write checkpoint after %v images: %v", done, err)
+			return
+		}
+		log.Printf("wrote checkpoint of %v/%v images to %v", done, len(paths), *checkpointOutFlag)
+	}, p)
+	if err == errInterrupted {
+		return partialAverage(bounds, filtered, counts), counts, len(paths), err
+	}
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	out := image.NewRGBA(bounds)
+	clippedPixels, identicalPixels, emptyPixels = 0, 0, 0
+	clippedChannels = [4]int64{}
+	if *rowStatsFlag != "" {
+		rowSpread = make([]float64, bounds.Dy())
+		for k := 0; k < pixels; k++ {
+			rowSpread[k/bounds.Dx()] += (stddevs.at(4*k) + stddevs.at(4*k+1) + stddevs.at(4*k+2)) / 3
+		}
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			p := (y-bounds.Min.Y)*bounds.Dx() + (x - bounds.Min.X)
+			c := float64(counts[p])
+			if *rejectIsolatedFlag && counts[p] == 1 {
+				// A lone survivor is treated as if nothing survived.
+				counts[p] = 0
+			}
+			if counts[p] == 0 && *onEmptyFlag == "transparent" {
+				count(&emptyPixels)
+				continue
+			}
+			if counts[p] == 0 {
+				return nil, nil, 0, fmt.Errorf("failed to get mean pixel color at x=%v y=%v: %v", x, y, errAllRejected)
+			}
+			out.Set(x, y, toRGBA64(nil, filtered.at(4*p)/c, filtered.at(4*p+1)/c, filtered.at(4*p+2)/c, filtered.at(4*p+3)/c))
+		}
+	}
+	return out, counts, len(paths), nil
+}
+
+// inputBounds returns the bounds of the input at path from its header alone.
+func inputBounds(path string) (image.Rectangle, error) {
+	h, err := readHeader(path)
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	return image.Rect(0, 0, h.width, h.height), nil
+}
+
+// partialAverage turns the second pass's running sums into an image. Pixels
+// with no surviving samples yet are left transparent black.
+func partialAverage(bounds image.Rectangle, filtered accumulator, counts []int) *image.RGBA {
+	out := image.NewRGBA(bounds)
+	for p, n := range counts {
+		if n == 0 {
+			continue
+		}
+		c := float64(n)
+		x, y := bounds.Min.X+p%bounds.Dx(), bounds.Min.Y+p/bounds.Dx()
+		r, _ := clampChannel(filtered.at(4*p) / c)
+		g, _ := clampChannel(filtered.at(4*p+1) / c)
+		b, _ := clampChannel(filtered.at(4*p+2) / c)
+		a, _ := clampChannel(filtered.at(4*p+3) / c)
+		out.Set(x, y, color.RGBA64{r, g, b, a})
+	}
+	return out
+}
+
+// streamPass decodes each file in paths in turn and calls fn with every pixel's
+// RGBA value, along with the index of that pixel's red channel in an
+// interleaved per-pixel buffer. Only one decoded image is alive at a time.
+// If after is non-nil, it is called with the number of files merged so far
+// once each file is done. It returns the files it merged, and errInterrupted
+// at the end of the row where an interrupt is noticed. Each finished row is
+// counted on prog.
+//
+// A file whose size differs from bounds would scramble the accumulators, so
+// it stops the pass with an error, or with --on-size-change=skip is logged
+// and left out.
+func streamPass(paths []string, bounds image.Rectangle, fn func(idx int, r, g, b, a uint32), after func(done int), prog *progress) ([]string, error) {
+	merged := []string{}
+	for _, p := range paths {
+		i, err := decodeFile(p)
+		if err != nil {
+			return nil, err
+		}
+		if *grayTransparencyFlag {
+			if err := checkGray(i); err != nil {
+				return nil, fmt.Errorf("unsupported operation; --preserve-gray-transparency needs grayscale inputs, but in %v the %v", p, err)
+			}
+		}
+		if i.Bounds() != bounds {
+			if *onSizeChangeFlag != "skip" {
+				return nil, fmt.Errorf("unsupported operation; cannot merge images of different sizes: %v is %vx%v but the accumulators are %vx%v; use --on-size-change=skip to leave such files out", p, i.Bounds().Dx(), i.Bounds().Dy(), bounds.Dx(), bounds.Dy())
+			}
+			log.Printf("skipping %v: it is %vx%v but the accumulators are %vx%v", p, i.Bounds().Dx(), i.Bounds().Dy(), bounds.Dx(), bounds.Dy())
+			prog.add(bounds.Dy())
+			continue
+		}
+		idx := 0
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				r, g, b, a := i.At(x, y).RGBA()
+				fn(idx, r, g, b, a)
+				idx += 4
+			}
+			prog.step()
+			if interrupted() {
+				return nil, errInterrupted
+			}
+		}
+		if err := imagesErr(i); err != nil {
+			return nil, err
+		}
+		merged = append(merged, p)
+		if after != nil {
+			after(len(merged))
+		}
+	}
+	return merged, nil
+}
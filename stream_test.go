@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestOnSizeChangeSkip streams three frames and one smaller file. It checks
+// that the default aborts, and that --on-size-change=skip reports three files
+// merged and gives the same output as streaming the three alone.
+func TestOnSizeChangeSkip(t *testing.T) {
+	defer func(s string) { *onSizeChangeFlag = s }(*onSizeChangeFlag)
+	dir := t.TempDir()
+	frames := writeFrames(t, dir, 3, 8, 8)
+	small := filepath.Join(dir, "small.png")
+	f, err := os.Create(small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(f, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	paths := append([]string{frames[0], small}, frames[1:]...)
+
+	*onSizeChangeFlag = "abort"
+	if _, _, _, err := streamAverage(paths); err == nil {
+		t.Errorf("--on-size-change=abort merged a mis-sized file")
+	}
+
+	*onSizeChangeFlag = "skip"
+	out, kept, merged, err := streamAverage(paths)
+	if err != nil {
+		t.Fatalf("--on-size-change=skip: %v", err)
+	}
+	if merged != 3 {
+		t.Errorf("--on-size-change=skip merged %v files; want 3", merged)
+	}
+	for p, n := range kept {
+		if n > merged {
+			t.Fatalf("pixel %v kept %v samples of %v merged", p, n, merged)
+		}
+	}
+	want, _, _, err := streamAverage(frames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Pix, want.Pix) {
+		t.Errorf("--on-size-change=skip output differs from streaming the matching files alone")
+	}
+}
+
+// BenchmarkStreamingMemory merges the same frames with --streaming and in
+// memory, reporting the bytes allocated by each. Streaming should allocate
+// about one decoded frame per read plus its accumulators, where the in-memory
+// path holds every frame at once.
+func BenchmarkStreamingMemory(b *testing.B) {
+	paths := writeFrames(b, b.TempDir(), 16, 320, 240)
+	b.Run("streaming", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, _, _, err := streamAverage(paths); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("in-memory", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			images, err := loadImages(paths)
+			if err != nil {
+				b.Fatal(err)
+			}
+			reduce, err := newReducer("sigma", images)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, _, err := mergeImages(images, reduce); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"image"
+	"sync/atomic"
+	"unsafe"
+)
+
+// cacheLine is the size in bytes of a CPU cache line. Two cores writing to
+// the same line slow each other down even when they write different bytes of
+// it, since the line has to move between their caches on every write.
+const cacheLine = 64
+
+// count adds one to the counter at p. The counters the reducers update per
+// pixel, such as identicalPixels and rejectedByInput, are updated atomically,
+// since --merge-workers runs the reducers on several goroutines at once and a
+// lock shared by every pixel would make the workers take turns. They are read
+// once the merge's goroutines have finished.
+func count(p *int64) {
+	atomic.AddInt64(p, 1)
+}
+
+// newOutputRGBA returns the image mergeImages writes its result into. With
+// --strip-cache-line-aligned, Pix starts on a cache line and every row is
+// padded to a whole number of lines, so the last row of one strip and the
+// first row of the next never share a line.
+func newOutputRGBA(r image.Rectangle) *image.RGBA {
+	if !*stripAlignedFlag {
+		return image.NewRGBA(r)
+	}
+	stride := (4*r.Dx() + cacheLine - 1) / cacheLine * cacheLine
+	size := stride * r.Dy()
+	buf := make([]uint8, size+cacheLine)
+	off := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) % cacheLine); rem != 0 {
+		off = cacheLine - rem
+	}
+	return &image.RGBA{Pix: buf[off : off+size : off+size], Stride: stride, Rect: r}
+}
+
+// strips splits the rows from y0 up to y1 into at most n contiguous ranges of
+// nearly equal height, one per --merge-workers goroutine.
+func strips(y0, y1, n int) [][2]int {
+	h := y1 - y0
+	if n > h {
+		n = h
+	}
+	var out [][2]int
+	for i := 0; i < n; i++ {
+		out = append(out, [2]int{y0 + h*i/n, y0 + h*(i+1)/n})
+	}
+	return out
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"reflect"
+	"testing"
+	"unsafe"
+)
+
+// TestMergeWorkers checks that merging in parallel strips, with and without
+// --strip-cache-line-aligned, gives the same pixels and kept counts as one
+// worker, on a width whose rows don't fill whole cache lines.
+func TestMergeWorkers(t *testing.T) {
+	defer func(w int, a bool) { *mergeWorkersFlag, *stripAlignedFlag = w, a }(*mergeWorkersFlag, *stripAlignedFlag)
+	images := noisyFrames(5, 37, 23)
+	merge := func(workers int, aligned bool) (*image.RGBA, []int) {
+		*mergeWorkersFlag, *stripAlignedFlag = workers, aligned
+		reduce, err := newReducer("sigma", images)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, kept, err := mergeImages(images, reduce)
+		if err != nil {
+			t.Fatalf("--merge-workers=%v: %v", workers, err)
+		}
+		return out, kept
+	}
+
+	want, wantKept := merge(1, false)
+	for _, tc := range []struct {
+		workers int
+		aligned bool
+	}{{4, false}, {4, true}, {100, true}} {
+		out, kept := merge(tc.workers, tc.aligned)
+		if tc.aligned {
+			if out.Stride%cacheLine != 0 || uintptr(unsafe.Pointer(&out.Pix[0]))%cacheLine != 0 {
+				t.Errorf("--strip-cache-line-aligned: stride %v and Pix at %p are not cache-line aligned", out.Stride, &out.Pix[0])
+			}
+		}
+		for y := 0; y < 23; y++ {
+			for x := 0; x < 37; x++ {
+				if got := out.RGBAAt(x, y); got != want.RGBAAt(x, y) {
+					t.Fatalf("--merge-workers=%v aligned=%v: pixel %v,%v is %v; want %v", tc.workers, tc.aligned, x, y, got, want.RGBAAt(x, y))
+				}
+			}
+		}
+		if !reflect.DeepEqual(kept, wantKept) {
+			t.Errorf("--merge-workers=%v aligned=%v: kept counts differ from one worker", tc.workers, tc.aligned)
+		}
+	}
+}
+
+// BenchmarkMergeWorkers merges with eight workers, with and without aligned
+// rows, against one worker. The mean mode does so little work per pixel that
+// the writes to the output are a large part of the cost. The sigma mode runs
+// with the identical-samples fast path on, over frames whose top half is the
+// same in every frame, so half the pixels update the shared counters.
+func BenchmarkMergeWorkers(b *testing.B) {
+	defer func(w int, a, fast bool) {
+		*mergeWorkersFlag, *stripAlignedFlag, *identicalFastPathFlag = w, a, fast
+	}(*mergeWorkersFlag, *stripAlignedFlag, *identicalFastPathFlag)
+	*identicalFastPathFlag = true
+	images := noisyFrames(4, 1001, 600)
+	first := images[0].(*image.RGBA)
+	for _, img := range images[1:] {
+		rgba := img.(*image.RGBA)
+		copy(rgba.Pix[:len(rgba.Pix)/2], first.Pix[:len(first.Pix)/2])
+	}
+	for _, mode := range []string{"mean", "sigma"} {
+		reduce, err := newReducer(mode, images)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, bc := range []struct {
+			workers int
+			aligned bool
+		}{{1, false}, {8, false}, {8, true}} {
+			b.Run(fmt.Sprintf("mode=%v/workers=%v/aligned=%v", mode, bc.workers, bc.aligned), func(b *testing.B) {
+				*mergeWorkersFlag, *stripAlignedFlag = bc.workers, bc.aligned
+				for i := 0; i < b.N; i++ {
+					if _, _, err := mergeImages(images, reduce); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"time"
+)
+
+// summarySchemaVersion is the schema_version of the --json-summary report.
+// Adding fields keeps the version; renaming, removing or changing the meaning
+// of one increments it.
+const summarySchemaVersion = 1
+
+// runSummary is the --json-summary report, filled in as the run progresses.
+type runSummary struct {
+	SchemaVersion  int               `json:"schema_version"`
+	Inputs         []string          `json:"inputs"`
+	Options        map[string]string `json:"options"`
+	Results        []modeSummary     `json:"results"`
+	Files          []string          `json:"files"`
+	Interrupted    bool              `json:"interrupted,omitempty"`
+	ElapsedSeconds float64           `json:"elapsed_seconds"`
+}
+
+// modeSummary describes the merge behind one output.
+type modeSummary struct {
+	Mode            string  `json:"mode"`
+	Output          string  `json:"output"`
+	Width           int     `json:"width"`
+	Height          int     `json:"height"`
+	SamplesPerPixel int     `json:"samples_per_pixel"`
+	MinKept         int     `json:"min_kept"`
+	MaxKept         int     `json:"max_kept"`
+	MeanKept        float64 `json:"mean_kept"`
+	ClippedPixels   int     `json:"clipped_pixels"`
+	ClippedChannels struct {
+		R int `json:"r"`
+		G int `json:"g"`
+		B int `json:"b"`
+		A int `json:"a"`
+	} `json:"clipped_channels"`
+}
+
+// summary collects the --json-summary report, or is nil when it isn't wanted.
+var summary *runSummary
+
+func newRunSummary(paths []string) *runSummary {
+	s := &runSummary{SchemaVersion: summarySchemaVersion, Inputs: paths, Options: map[string]string{}, Results: []modeSummary{}, Files: []string{}}
+	flag.VisitAll(func(f *flag.Flag) {
+		s.Options[f.Name] = f.Value.String()
+	})
+	return s
+}
+
+// addResult records the merge for mode, with kept and total as passed to
+// finish.
+func (s *runSummary) addResult(mode, path string, width, height int, kept []int, total int) {
+	r := modeSummary{Mode: mode, Output: path, Width: width, Height: height, SamplesPerPixel: total, ClippedPixels: int(clippedPixels)}
+	r.ClippedChannels.R, r.ClippedChannels.G, r.ClippedChannels.B, r.ClippedChannels.A = int(clippedChannels[0]), int(clippedChannels[1]), int(clippedChannels[2]), int(clippedChannels[3])
+	sum := 0
+	for k, n := range kept {
+		if k == 0 || n < r.MinKept {
+			r.MinKept = n
+		}
+		if n > r.MaxKept {
+			r.MaxKept = n
+		}
+		sum += n
+	}
+	if len(kept) > 0 {
+		r.MeanKept = float64(sum) / float64(len(kept))
+	}
+	s.Results = append(s.Results, r)
+}
+
+// write prints the summary to w as a single JSON object.
+func (s *runSummary) write(w io.Writer, start time.Time) error {
+	s.ElapsedSeconds = time.Since(start).Seconds()
+	return json.NewEncoder(w).Encode(s)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestSummarySchema checks that the --json-summary report carries its
+// schema_version and every field the README documents for version 1.
+func TestSummarySchema(t *testing.T) {
+	s := newRunSummary([]string{"a.png", "b.png"})
+	s.addResult("sigma", "out.png", 2, 1, []int{2, 1}, 2)
+	s.Files = append(s.Files, "out.png")
+	var buf bytes.Buffer
+	if err := s.write(&buf, time.Now()); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("the summary is not JSON: %v\n%s", err, buf.Bytes())
+	}
+	if v, ok := got["schema_version"].(float64); !ok || v != summarySchemaVersion {
+		t.Errorf("schema_version = %v; want %v", got["schema_version"], summarySchemaVersion)
+	}
+	for _, field := range []string{"schema_version", "inputs", "options", "results", "files", "elapsed_seconds"} {
+		if _, ok := got[field]; !ok {
+			t.Errorf("the summary has no %q field", field)
+		}
+	}
+	if _, ok := got["interrupted"]; ok {
+		t.Errorf("the summary of a complete run has an \"interrupted\" field")
+	}
+
+	results, ok := got["results"].([]interface{})
+	if !ok || len(results) != 1 {
+		t.Fatalf("results = %v; want one entry", got["results"])
+	}
+	result := results[0].(map[string]interface{})
+	for _, field := range []string{"mode", "output", "width", "height", "samples_per_pixel", "min_kept", "max_kept", "mean_kept", "clipped_pixels", "clipped_channels"} {
+		if _, ok := result[field]; !ok {
+			t.Errorf("the result has no %q field", field)
+		}
+	}
+}
+
+// TestSummaryRecordsWrittenImage checks that a result names the file finish
+// actually wrote and has the size it was written at, here renamed by
+// --resume-safe and resized by --scale-output-factor.
+func TestSummaryRecordsWrittenImage(t *testing.T) {
+	defer func(r bool, f float64, s *runSummary) {
+		*resumeSafeFlag, *scaleOutputFactorFlag, summary = r, f, s
+	}(*resumeSafeFlag, *scaleOutputFactorFlag, summary)
+	*resumeSafeFlag, *scaleOutputFactorFlag = true, 2
+	summary = newRunSummary([]string{"a.png"})
+
+	path := filepath.Join(t.TempDir(), "out.png")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	finish("sigma", out, []int{1, 1, 1, 1, 1, 1}, 1, path)
+
+	if len(summary.Results) != 1 {
+		t.Fatalf("got %v results; want 1", len(summary.Results))
+	}
+	r := summary.Results[0]
+	if want := suffixPath(path, "1"); r.Output != want {
+		t.Errorf("output = %v; want %v", r.Output, want)
+	}
+	if r.Width != 6 || r.Height != 4 {
+		t.Errorf("size = %vx%v; want 6x4", r.Width, r.Height)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// tarInput is the --tar archive the inputs are read from, or nil when they are
+// files on disk.
+var tarInput *tarArchive
+
+// tarArchive reads members of a tar or gzipped tar archive by name. Each
+// member's path is the archive path, a colon and the member name.
+//
+// A tar archive can only be read front to back, so tarArchive keeps a cursor
+// after the last member it read. Reading members in archive order, as each
+// pass over the inputs does when the archive was created in sorted order,
+// costs one sequential read of the archive. Going back restarts from the top.
+type tarArchive struct {
+	path string
+
+	mu       sync.Mutex
+	f        *os.File
+	tr       *tar.Reader
+	next     int              // position of the entry tr.Next returns next
+	position map[string]int   // of each image member in the archive
+	sizes    map[string]int64 // estimated decoded size of each image member
+}
+
+// openTar lists the image members of the archive at path and returns the
+// archive along with their paths, sorted like resolvePaths sorts files.
+// Members that aren't regular files are ignored. Members that don't decode as
+// images are an error unless skipErrors is set, in which case they are logged
+// and skipped.
+func openTar(path string, skipErrors bool) (*tarArchive, []string, error) {
+	a := &tarArchive{path: path, position: map[string]int{}, sizes: map[string]int64{}}
+	if err := a.rewind(); err != nil {
+		return nil, nil, err
+	}
+	var paths []string
+	for pos := 0; ; pos++ {
+		hdr, err := a.tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed reading %v: %v", path, err)
+		}
+		a.next++
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		cfg, _, err := decodeInputConfig(a.tr)
+		if err != nil {
+			if !skipErrors {
+				return nil, nil, fmt.Errorf("member %v of %v is not a supported image: %v; use --skip-errors to ignore it", hdr.Name, path, err)
+			}
+			log.Printf("skipping member %v of %v: %v", hdr.Name, path, err)
+			continue
+		}
+		a.position[hdr.Name] = pos
+		a.sizes[hdr.Name] = int64(cfg.Width) * int64(cfg.Height) * bytesPerPixel(cfg.ColorModel)
+		paths = append(paths, a.memberPath(hdr.Name))
+	}
+	sort.Strings(paths)
+	return a, paths, nil
+}
+
+func (a *tarArchive) memberPath(name string) string {
+	return a.path + ":" + name
+}
+
+// member returns the member name of path, or false if path isn't one of a's
+// members.
+func (a *tarArchive) member(path string) (string, bool) {
+	name := strings.TrimPrefix(path, a.path+":")
+	_, ok := a.position[name]
+	return name, ok && name != path
+}
+
+// rewind reopens the archive at its first entry, undoing gzip compression
+// when the file starts with the gzip magic number.
+func (a *tarArchive) rewind() error {
+	if a.f != nil {
+		a.f.Close()
+	}
+	f, err := os.Open(a.path)
+	if err != nil {
+		return fmt.Errorf("failed opening %v: %v", a.path, err)
+	}
+	a.f = f
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("failed reading %v: %v", a.path, err)
+		}
+		r = zr
+	}
+	a.tr = tar.NewReader(r)
+	a.next = 0
+	return nil
+}
+
+// open returns the contents of member name. The member is read into memory so
+// callers can decode it while the cursor moves on for other callers.
+func (a *tarArchive) open(name string) (io.ReadCloser, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	want := a.position[name]
+	if want < a.next {
+		if err := a.rewind(); err != nil {
+			return nil, err
+		}
+	}
+	for {
+		_, err := a.tr.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed reading member %v of %v: %v", name, a.path, err)
+		}
+		pos := a.next
+		a.next++
+		if pos == want {
+			data, err := io.ReadAll(a.tr)
+			if err != nil {
+				return nil, fmt.Errorf("failed reading member %v of %v: %v", name, a.path, err)
+			}
+			return io.NopCloser(bytes.NewReader(data)), nil
+		}
+	}
+}
+
+// openInput opens the input at path, which is either a file or, with --tar, a
+// member of the archive.
+func openInput(path string) (io.ReadCloser, error) {
+	if tarInput != nil {
+		if name, ok := tarInput.member(path); ok {
+			return tarInput.open(name)
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening %v: %v", path, err)
+	}
+	return f, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeTestTar writes an archive, gzipped if gz is set, holding members with
+// the given names and contents, in that order.
+func writeTestTar(t *testing.T, path string, gz bool, names []string, contents [][]byte) {
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var zw *gzip.Writer
+	if gz {
+		zw = gzip.NewWriter(&buf)
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+	if err := tw.WriteHeader(&tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range names {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents[i]))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(contents[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestTarMembers archives frames out of name order along with a directory
+// and a text file. It checks that the image members are listed in sorted
+// order, that the text file fails the listing unless skipped, and that
+// members read in any order, including backwards, which rewinds the
+// archive, decode to the frames they came from.
+func TestTarMembers(t *testing.T) {
+	defer func(a *tarArchive) { tarInput = a }(tarInput)
+	dir := t.TempDir()
+	frames := noisyFrames(3, 8, 8)
+	var encoded [][]byte
+	for _, f := range frames {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, f); err != nil {
+			t.Fatal(err)
+		}
+		encoded = append(encoded, buf.Bytes())
+	}
+	names := []string{"dir/c.png", "a.png", "notes.txt", "dir/b.png"}
+	contents := [][]byte{encoded[2], encoded[0], []byte("not an image"), encoded[1]}
+
+	for _, gz := range []bool{false, true} {
+		path := filepath.Join(dir, "frames.tar")
+		writeTestTar(t, path, gz, names, contents)
+
+		if _, _, err := openTar(path, false); err == nil || !strings.Contains(err.Error(), "notes.txt") {
+			t.Errorf("gzip=%v: openTar without skipErrors returned %v; want an error naming notes.txt", gz, err)
+		}
+		a, paths, err := openTar(path, true)
+		if err != nil {
+			t.Fatalf("gzip=%v: %v", gz, err)
+		}
+		want := []string{path + ":a.png", path + ":dir/b.png", path + ":dir/c.png"}
+		if !reflect.DeepEqual(paths, want) {
+			t.Errorf("gzip=%v: members are %v; want %v", gz, paths, want)
+		}
+
+		tarInput = a
+		for _, i := range []int{2, 0, 1, 1, 0} {
+			img, err := decodeFile(paths[i])
+			if err != nil {
+				t.Fatalf("gzip=%v: %v", gz, err)
+			}
+			if !reflect.DeepEqual(img.(*image.RGBA).Pix, frames[i].(*image.RGBA).Pix) {
+				t.Errorf("gzip=%v: %v does not decode to frame %v", gz, paths[i], i)
+			}
+		}
+		if _, err := openInput(path + ":notes.txt"); err == nil {
+			t.Errorf("gzip=%v: opened the skipped member as a file", gz)
+		}
+		a.f.Close()
+	}
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/image/tiff/lzw"
+)
+
+// TIFF tags read by parseTIFF.
+const (
+	tiffImageWidth      = 256
+	tiffImageLength     = 257
+	tiffBitsPerSample   = 258
+	tiffCompression     = 259
+	tiffPhotometric     = 262
+	tiffStripOffsets    = 273
+	tiffSamplesPerPixel = 277
+	tiffPlanarConfig    = 284
+	tiffPredictor       = 317
+	tiffTileWidth       = 322
+	tiffTileLength      = 323
+	tiffTileOffsets     = 324
+	tiffTileByteCounts  = 325
+	tiffExtraSamples    = 338
+)
+
+// TIFF compression schemes tiledTIFF can read.
+const (
+	tiffNone         = 1
+	tiffLZW          = 5
+	tiffDeflate      = 8
+	tiffOldDeflate   = 32946
+	tiffHorizontal   = 2 // Predictor value for horizontal differencing.
+	tiffAssociated   = 1 // ExtraSamples value for premultiplied alpha.
+	tiffUnassociated = 2 // ExtraSamples value for straight alpha.
+)
+
+func init() {
+	image.RegisterFormat("tiff", "II*\x00", decodeTIFF, decodeTIFFConfig)
+	image.RegisterFormat("tiff", "MM\x00*", decodeTIFF, decodeTIFFConfig)
+}
+
+// tiledTIFF is a tiled TIFF whose tiles are read when At first needs them,
+// so only the tiles around the pixels being merged are ever in memory.
+//
+// Files opened with openTiledTIFF are memory-mapped where the platform
+// allows it. Uncompressed tiles are then read straight from the mapping,
+// which the operating system pages in and out as needed. Compressed tiles
+// are decompressed into a cache that holds two rows of tiles for each
+// --merge-workers strip, enough for merges that walk their strips row by row.
+// Reading a cached tile takes no lock. Each tile has its own lock, held only
+// while it is decompressed, so workers needing different tiles don't wait
+// for each other.
+type tiledTIFF struct {
+	name  string
+	src   io.ReaderAt
+	data  []byte // The whole file, if it is mapped or in memory.
+	close func() error
+
+	order          binary.ByteOrder
+	width, height  int
+	tileW, tileH   int
+	across         int // Tiles per row of tiles.
+	samples, depth int // Samples per pixel, and bits per sample.
+	alpha          int // 0 for no alpha, else the ExtraSamples value.
+	compression    int
+	predictor      int
+	offsets        []uint64
+	counts         []uint64
+
+	slots    []atomic.Value // The []byte of each cached tile, or nil.
+	decoding []sync.Mutex   // Held while the tile of the same index is decompressed.
+	failed   int32          // Set once err is, so At can check it without locking.
+
+	mu    sync.Mutex
+	queue []int // The cached tiles, in the order they were decompressed.
+	err   error
+}
+
+// openTiledTIFF opens the TIFF at path for reading a tile at a time.
+func openTiledTIFF(path string) (*tiledTIFF, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening %v: %v", path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed opening %v: %v", path, err)
+	}
+	data, unmap, err := mapFile(f, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to map %v: %v", path, err)
+	}
+	t := &tiledTIFF{name: path, src: f, data: data}
+	if data != nil {
+		t.src = bytes.NewReader(data)
+	}
+	var once sync.Once
+	t.close = func() (err error) {
+		once.Do(func() {
+			if unmap != nil {
+				unmap()
+			}
+			err = f.Close()
+		})
+		return err
+	}
+	if err := t.parse(info.Size()); err != nil {
+		t.close()
+		return nil, fmt.Errorf("failed decoding image %v: %v", path, err)
+	}
+	// Streaming drops each input after reading it, so release the mapping
+	// and file with the image rather than keeping them for the whole run.
+	runtime.SetFinalizer(t, func(t *tiledTIFF) { t.close() })
+	return t, nil
+}
+
+// decodeTIFF decodes a TIFF that is not a file on disk, such as a tar member,
+// by reading it into memory. Its tiles are still decompressed on demand.
+func decodeTIFF(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	t := &tiledTIFF{name: "tiff", src: bytes.NewReader(data), data: data}
+	if err := t.parse(int64(len(data))); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// decodeTIFFConfig reads the header of a TIFF that is not a file on disk,
+// such as a tar member. Only as much of the stream is read as the image file
+// directory needs, which for a file whose directory comes last is still
+// almost all of it; files on disk are opened with openTiledTIFF instead.
+func decodeTIFFConfig(r io.Reader) (image.Config, error) {
+	t := &tiledTIFF{src: &streamReaderAt{r: r}}
+	if err := t.parse(maxDecodeBytes); err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: t.ColorModel(), Width: t.width, Height: t.height}, nil
+}
+
+// streamReaderAt reads r forward only as far as calls to ReadAt reach,
+// keeping what it has read for later calls.
+type streamReaderAt struct {
+	r   io.Reader
+	buf []byte
+}
+
+func (s *streamReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if end := off + int64(len(p)); end > int64(len(s.buf)) {
+		more := make([]byte, end-int64(len(s.buf)))
+		n, err := io.ReadFull(s.r, more)
+		s.buf = append(s.buf, more[:n]...)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return 0, err
+		}
+	}
+	if off >= int64(len(s.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// parse reads the first image file directory, which describes the image,
+// and checks that its layout is one tiledTIFF supports. size is the length
+// of the file.
+func (t *tiledTIFF) parse(size int64) error {
+	header := make([]byte, 8)
+	if _, err := t.src.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("failed to read the TIFF header: %v", err)
+	}
+	switch string(header[:4]) {
+	case "II*\x00":
+		t.order = binary.LittleEndian
+	case "MM\x00*":
+		t.order = binary.BigEndian
+	default:
+		return fmt.Errorf("not a TIFF file")
+	}
+	ifd := int64(t.order.Uint32(header[4:]))
+	n := make([]byte, 2)
+	if _, err := t.src.ReadAt(n, ifd); err != nil {
+		return fmt.Errorf("failed to read the image file directory: %v", err)
+	}
+	entries := make([]byte, 12*int(t.order.Uint16(n)))
+	if _, err := t.src.ReadAt(entries, ifd+2); err != nil {
+		return fmt.Errorf("failed to read the image file directory: %v", err)
+	}
+
+	fields := map[uint16][]uint64{}
+	for e := 0; e < len(entries); e += 12 {
+		tag := t.order.Uint16(entries[e:])
+		v, err := t.values(entries[e:e+12], size)
+		if err != nil {
+			return fmt.Errorf("tag %v: %v", tag, err)
+		}
+		fields[tag] = v
+	}
+	one := func(tag uint16, def uint64) uint64 {
+		if v := fields[tag]; len(v) > 0 {
+			return v[0]
+		}
+		return def
+	}
+
+	if _, ok := fields[tiffStripOffsets]; ok {
+		return fmt.Errorf("the image is stored in strips; only tiled TIFFs can be read, so convert it first, e.g. with 'tiffcp -t'")
+	}
+	t.width, t.height = int(one(tiffImageWidth, 0)), int(one(tiffImageLength, 0))
+	t.tileW, t.tileH = int(one(tiffTileWidth, 0)), int(one(tiffTileLength, 0))
+	if t.width <= 0 || t.height <= 0 || t.tileW <= 0 || t.tileH <= 0 {
+		return fmt.Errorf("missing or zero image or tile size")
+	}
+	t.samples = int(one(tiffSamplesPerPixel, 1))
+	t.depth = int(one(tiffBitsPerSample, 1))
+	for _, d := range fields[tiffBitsPerSample] {
+		if int(d) != t.depth {
+			return fmt.Errorf("samples of different bit depths are not supported")
+		}
+	}
+	if t.depth != 8 && t.depth != 16 {
+		return fmt.Errorf("%v-bit samples are not supported; only 8 and 16 are", t.depth)
+	}
+	if one(tiffPlanarConfig, 1) != 1 {
+		return fmt.Errorf("planar (separate) sample layout is not supported")
+	}
+	channels := 3
+	switch one(tiffPhotometric, 2) {
+	case 1:
+		channels = 1
+	case 2:
+	default:
+		return fmt.Errorf("photometric interpretation %v is not supported; only black-is-zero gray and RGB are", one(tiffPhotometric, 2))
+	}
+	switch extra := fields[tiffExtraSamples]; {
+	case t.samples == channels && len(extra) == 0:
+	case t.samples == channels+1 && len(extra) == 1 && (extra[0] == tiffAssociated || extra[0] == tiffUnassociated):
+		t.alpha = int(extra[0])
+	default:
+		return fmt.Errorf("%v samples per pixel with extra samples %v are not supported", t.samples, extra)
+	}
+	t.compression = int(one(tiffCompression, tiffNone))
+	switch t.compression {
+	case tiffNone, tiffLZW, tiffDeflate, tiffOldDeflate:
+	default:
+		return fmt.Errorf("compression %v is not supported; only none, LZW and Deflate are", t.compression)
+	}
+	t.predictor = int(one(tiffPredictor, 1))
+	if t.predictor != 1 && t.predictor != tiffHorizontal {
+		return fmt.Errorf("predictor %v is not supported", t.predictor)
+	}
+
+	t.across = (t.width + t.tileW - 1) / t.tileW
+	tiles := t.across * ((t.height + t.tileH - 1) / t.tileH)
+	t.offsets, t.counts = fields[tiffTileOffsets], fields[tiffTileByteCounts]
+	if len(t.offsets) != tiles || len(t.counts) != tiles {
+		return fmt.Errorf("found %v tile offsets and %v byte counts for %v tiles", len(t.offsets), len(t.counts), tiles)
+	}
+	for i := range t.offsets {
+		if t.offsets[i]+t.counts[i] > uint64(size) {
+			return fmt.Errorf("tile %v lies past the end of the file", i)
+		}
+	}
+	if !t.direct() {
+		t.slots = make([]atomic.Value, tiles)
+		t.decoding = make([]sync.Mutex, tiles)
+	}
+	return nil
+}
+
+// values returns the values of the 12-byte directory entry e, which must be
+// unsigned 8, 16 or 32-bit integers.
+func (t *tiledTIFF) values(e []byte, size int64) ([]uint64, error) {
+	typ, count := t.order.Uint16(e[2:]), int64(t.order.Uint32(e[4:]))
+	width := map[uint16]int64{1: 1, 3: 2, 4: 4}[typ]
+	if width == 0 {
+		// Text, rationals and the like describe the image but aren't needed
+		// to read it.
+		return nil, nil
+	}
+	if count*width > size {
+		return nil, fmt.Errorf("%v values do not fit in the file", count)
+	}
+	raw := e[8:12]
+	if count*width > 4 {
+		raw = make([]byte, count*width)
+		if _, err := t.src.ReadAt(raw, int64(t.order.Uint32(e[8:]))); err != nil {
+			return nil, err
+		}
+	}
+	out := make([]uint64, count)
+	for i := range out {
+		switch width {
+		case 1:
+			out[i] = uint64(raw[i])
+		case 2:
+			out[i] = uint64(t.order.Uint16(raw[2*i:]))
+		case 4:
+			out[i] = uint64(t.order.Uint32(raw[4*i:]))
+		}
+	}
+	return out, nil
+}
+
+// tileBytes is the size of one decoded tile.
+func (t *tiledTIFF) tileBytes() int {
+	return t.tileW * t.tileH * t.samples * t.depth / 8
+}
+
+// direct reports whether tiles are read straight from the file's mapping,
+// without the cache.
+func (t *tiledTIFF) direct() bool {
+	return t.compression == tiffNone && t.predictor == 1 && t.data != nil
+}
+
+// cacheTiles is the most tiles the cache holds: two rows of tiles for each
+// --merge-workers strip.
+func (t *tiledTIFF) cacheTiles() int {
+	return 2 * t.across * maxInt(*mergeWorkersFlag, 1)
+}
+
+// cacheBytes is the most memory the tile cache holds.
+func (t *tiledTIFF) cacheBytes() int64 {
+	return int64(t.cacheTiles()) * int64(t.tileBytes())
+}
+
+// tile returns the decoded samples of tile i, decompressing it into the cache
+// if it isn't there.
+func (t *tiledTIFF) tile(i int) ([]byte, error) {
+	size := t.tileBytes()
+	if t.direct() {
+		if int(t.counts[i]) < size {
+			return nil, fmt.Errorf("tile %v holds %v bytes; want %v", i, t.counts[i], size)
+		}
+		return t.data[t.offsets[i] : t.offsets[i]+uint64(size)], nil
+	}
+	if pix, _ := t.slots[i].Load().([]byte); pix != nil {
+		return pix, nil
+	}
+	t.decoding[i].Lock()
+	defer t.decoding[i].Unlock()
+	// Another worker may have decompressed it while this one waited.
+	if pix, _ := t.slots[i].Load().([]byte); pix != nil {
+		return pix, nil
+	}
+	pix, err := t.decompress(i)
+	if err != nil {
+		return nil, err
+	}
+	t.slots[i].Store(pix)
+
+	// Evict the oldest tile once the cache is full. A worker still reading
+	// it keeps its samples until it moves on.
+	t.mu.Lock()
+	t.queue = append(t.queue, i)
+	if len(t.queue) > t.cacheTiles() {
+		t.slots[t.queue[0]].Store([]byte(nil))
+		t.queue = t.queue[1:]
+	}
+	t.mu.Unlock()
+	return pix, nil
+}
+
+// decompress reads and decodes tile i from the file.
+func (t *tiledTIFF) decompress(i int) ([]byte, error) {
+	size := t.tileBytes()
+	raw := make([]byte, t.counts[i])
+	if _, err := t.src.ReadAt(raw, int64(t.offsets[i])); err != nil {
+		return nil, fmt.Errorf("failed to read tile %v: %v", i, err)
+	}
+	pix := raw
+	if t.compression != tiffNone {
+		var r io.ReadCloser
+		if t.compression == tiffLZW {
+			r = lzw.NewReader(bytes.NewReader(raw), lzw.MSB, 8)
+		} else {
+			var err error
+			if r, err = zlib.NewReader(bytes.NewReader(raw)); err != nil {
+				return nil, fmt.Errorf("failed to decompress tile %v: %v", i, err)
+			}
+		}
+		pix = make([]byte, size)
+		_, err := io.ReadFull(r, pix)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress tile %v: %v", i, err)
+		}
+	}
+	if len(pix) < size {
+		return nil, fmt.Errorf("tile %v holds %v bytes; want %v", i, len(pix), size)
+	}
+	if t.predictor == tiffHorizontal {
+		t.undoPredictor(pix)
+	}
+	return pix, nil
+}
+
+// undoPredictor reverses horizontal differencing, where each sample is
+// stored as its difference from the same sample of the pixel to its left.
+func (t *tiledTIFF) undoPredictor(pix []byte) {
+	row := t.tileW * t.samples
+	for y := 0; y < t.tileH; y++ {
+		if t.depth == 8 {
+			r := pix[y*row : (y+1)*row]
+			for k := t.samples; k < len(r); k++ {
+				r[k] += r[k-t.samples]
+			}
+			continue
+		}
+		r := pix[2*y*row : 2*(y+1)*row]
+		for k := t.samples; k < row; k++ {
+			v := t.order.Uint16(r[2*k:]) + t.order.Uint16(r[2*(k-t.samples):])
+			t.order.PutUint16(r[2*k:], v)
+		}
+	}
+}
+
+// Err returns the first error hit while reading a tile. At returns
+// transparent black from then on.
+func (t *tiledTIFF) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+func (t *tiledTIFF) ColorModel() color.Model {
+	switch {
+	case t.samples == 1 && t.depth == 8:
+		return color.GrayModel
+	case t.samples == 1:
+		return color.Gray16Model
+	case t.alpha == tiffUnassociated && t.depth == 8:
+		return color.NRGBAModel
+	case t.alpha == tiffUnassociated:
+		return color.NRGBA64Model
+	case t.depth == 8:
+		return color.RGBAModel
+	}
+	return color.RGBA64Model
+}
+
+func (t *tiledTIFF) Bounds() image.Rectangle {
+	return image.Rect(0, 0, t.width, t.height)
+}
+
+func (t *tiledTIFF) At(x, y int) color.Color {
+	if !(image.Point{x, y}.In(t.Bounds())) {
+		return color.RGBA64{}
+	}
+	if atomic.LoadInt32(&t.failed) != 0 {
+		return color.RGBA64{}
+	}
+	pix, err := t.tile(y/t.tileH*t.across + x/t.tileW)
+	if err != nil {
+		t.mu.Lock()
+		if t.err == nil {
+			t.err = fmt.Errorf("failed decoding image %v: %v", t.name, err)
+		}
+		t.mu.Unlock()
+		atomic.StoreInt32(&t.failed, 1)
+		return color.RGBA64{}
+	}
+	k := ((y%t.tileH)*t.tileW + x%t.tileW) * t.samples
+	var s [4]uint16
+	for i := 0; i < t.samples; i++ {
+		if t.depth == 8 {
+			s[i] = uint16(pix[k+i]) * 0x101
+		} else {
+			s[i] = t.order.Uint16(pix[2*(k+i):])
+		}
+	}
+
+	switch {
+	case t.samples == 1 && t.depth == 8:
+		return color.Gray{uint8(s[0] >> 8)}
+	case t.samples == 1:
+		return color.Gray16{s[0]}
+	case t.samples == 2:
+		// Gray with alpha.
+		s[1], s[2], s[3] = s[0], s[0], s[1]
+	case t.samples == 3:
+		s[3] = 0xffff
+	}
+	switch {
+	case t.alpha == tiffUnassociated && t.depth == 8:
+		return color.NRGBA{uint8(s[0] >> 8), uint8(s[1] >> 8), uint8(s[2] >> 8), uint8(s[3] >> 8)}
+	case t.alpha == tiffUnassociated:
+		return color.NRGBA64{s[0], s[1], s[2], s[3]}
+	case t.depth == 8:
+		return color.RGBA{uint8(s[0] >> 8), uint8(s[1] >> 8), uint8(s[2] >> 8), uint8(s[3] >> 8)}
+	}
+	return color.RGBA64{s[0], s[1], s[2], s[3]}
+}
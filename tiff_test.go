@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// writeTestTIFF writes a little-endian 8-bit RGB TIFF of w×h pixels in tiles
+// of tw×th, where pixel (x, y) is {x, y, x+y}. With deflate the tiles are
+// zlib-compressed using horizontal differencing. With strips the tile tags
+// are replaced by a strip offset, which openTiledTIFF must refuse.
+func writeTestTIFF(t *testing.T, path string, w, h, tw, th int, deflate, strips bool) {
+	t.Helper()
+	var tiles [][]byte
+	for ty := 0; ty < h; ty += th {
+		for tx := 0; tx < w; tx += tw {
+			pix := make([]byte, tw*th*3)
+			for y := 0; y < th; y++ {
+				for x := 0; x < tw; x++ {
+					k := (y*tw + x) * 3
+					pix[k], pix[k+1], pix[k+2] = byte(tx+x), byte(ty+y), byte(tx+x+ty+y)
+				}
+			}
+			if deflate {
+				for y := 0; y < th; y++ {
+					row := pix[y*tw*3 : (y+1)*tw*3]
+					for k := len(row) - 1; k >= 3; k-- {
+						row[k] -= row[k-3]
+					}
+				}
+				var b bytes.Buffer
+				z := zlib.NewWriter(&b)
+				z.Write(pix)
+				z.Close()
+				pix = b.Bytes()
+			}
+			tiles = append(tiles, pix)
+		}
+	}
+
+	type entry struct {
+		tag    uint16
+		values []uint32
+	}
+	compression, predictor := uint32(tiffNone), uint32(1)
+	if deflate {
+		compression, predictor = tiffDeflate, tiffHorizontal
+	}
+	offsets, counts := make([]uint32, len(tiles)), make([]uint32, len(tiles))
+	entries := []entry{
+		{tiffImageWidth, []uint32{uint32(w)}},
+		{tiffImageLength, []uint32{uint32(h)}},
+		{tiffBitsPerSample, []uint32{8, 8, 8}},
+		{tiffCompression, []uint32{compression}},
+		{tiffPhotometric, []uint32{2}},
+		{tiffSamplesPerPixel, []uint32{3}},
+		{tiffPredictor, []uint32{predictor}},
+		{tiffTileWidth, []uint32{uint32(tw)}},
+		{tiffTileLength, []uint32{uint32(th)}},
+		{tiffTileOffsets, offsets},
+		{tiffTileByteCounts, counts},
+	}
+	if strips {
+		entries = append(entries, entry{tiffStripOffsets, []uint32{8}})
+	}
+
+	// Lay out the header, then the tiles, then the out-of-line values, then
+	// the directory.
+	buf := []byte("II*\x00\x00\x00\x00\x00")
+	for i, tile := range tiles {
+		offsets[i], counts[i] = uint32(len(buf)), uint32(len(tile))
+		buf = append(buf, tile...)
+	}
+	extern := map[int]uint32{}
+	for i, e := range entries {
+		if len(e.values) > 1 {
+			extern[i] = uint32(len(buf))
+			for _, v := range e.values {
+				buf = appendLE(buf, 4, v)
+			}
+		}
+	}
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(buf)))
+	buf = appendLE(buf, 2, uint32(len(entries)))
+	for i, e := range entries {
+		buf = appendLE(buf, 2, uint32(e.tag))
+		buf = appendLE(buf, 2, 4)
+		buf = appendLE(buf, 4, uint32(len(e.values)))
+		if off, ok := extern[i]; ok {
+			buf = appendLE(buf, 4, off)
+		} else {
+			buf = appendLE(buf, 4, e.values[0])
+		}
+	}
+	buf = appendLE(buf, 4, 0)
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// appendLE appends the low n bytes of v to buf in little-endian order.
+func appendLE(buf []byte, n int, v uint32) []byte {
+	for i := 0; i < n; i++ {
+		buf = append(buf, byte(v>>(8*i)))
+	}
+	return buf
+}
+
+func TestTiledTIFF(t *testing.T) {
+	dir := t.TempDir()
+	for _, deflate := range []bool{false, true} {
+		path := filepath.Join(dir, "in.tiff")
+		// 10×7 pixels in 4×4 tiles leaves partial tiles on the right and
+		// bottom edges.
+		writeTestTIFF(t, path, 10, 7, 4, 4, deflate, false)
+		img, err := decodeFile(path)
+		if err != nil {
+			t.Fatalf("deflate=%v: %v", deflate, err)
+		}
+		if b := img.Bounds(); b.Dx() != 10 || b.Dy() != 7 {
+			t.Fatalf("deflate=%v: bounds %v; want 10×7", deflate, b)
+		}
+		for y := 0; y < 7; y++ {
+			for x := 0; x < 10; x++ {
+				want := color.RGBA{uint8(x), uint8(y), uint8(x + y), 0xff}
+				if got := img.At(x, y); got != want {
+					t.Errorf("deflate=%v: At(%v, %v) = %v; want %v", deflate, x, y, got, want)
+				}
+			}
+		}
+		if err := imagesErr(img); err != nil {
+			t.Errorf("deflate=%v: %v", deflate, err)
+		}
+	}
+}
+
+func TestTiledTIFFRejectsStrips(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "in.tiff")
+	writeTestTIFF(t, path, 4, 4, 4, 4, false, true)
+	_, err := decodeFile(path)
+	if err == nil || !strings.Contains(err.Error(), "strips") {
+		t.Errorf("decodeFile of a stripped TIFF returned %v; want an error about strips", err)
+	}
+}
+
+// TestTiledTIFFHeader checks that readHeader describes a TIFF on disk, and
+// that decodeTIFFConfig reads the same header from a stream.
+func TestTiledTIFFHeader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "in.tiff")
+	writeTestTIFF(t, path, 10, 7, 4, 4, true, false)
+	h, err := readHeader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (imageHeader{"tiff", 10, 7, "RGBA"}); h != want {
+		t.Errorf("readHeader = %+v; want %+v", h, want)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := decodeTIFFConfig(bytes.NewBuffer(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != 10 || cfg.Height != 7 || cfg.ColorModel != color.RGBAModel {
+		t.Errorf("decodeTIFFConfig = %vx%v %v; want 10x7 RGBA", cfg.Width, cfg.Height, modelName(cfg.ColorModel))
+	}
+}
+
+// TestTiledTIFFWorkers reads a compressed TIFF from several --merge-workers
+// strips at once, as a merge does, and checks every pixel and that the tile
+// cache stays within two rows of tiles per strip.
+func TestTiledTIFFWorkers(t *testing.T) {
+	defer func(w int) { *mergeWorkersFlag = w }(*mergeWorkersFlag)
+	*mergeWorkersFlag = 4
+	path := filepath.Join(t.TempDir(), "in.tiff")
+	const w, h = 40, 64
+	writeTestTIFF(t, path, w, h, 4, 4, true, false)
+	img, err := decodeFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt := img.(*tiledTIFF)
+
+	var wg sync.WaitGroup
+	for _, s := range strips(0, h, *mergeWorkersFlag) {
+		wg.Add(1)
+		go func(y0, y1 int) {
+			defer wg.Done()
+			for y := y0; y < y1; y++ {
+				for x := 0; x < w; x++ {
+					want := color.RGBA{uint8(x), uint8(y), uint8(x + y), 0xff}
+					if got := img.At(x, y); got != want {
+						t.Errorf("At(%v, %v) = %v; want %v", x, y, got, want)
+						return
+					}
+				}
+			}
+		}(s[0], s[1])
+	}
+	wg.Wait()
+	if err := imagesErr(img); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(tt.queue); n > tt.cacheTiles() || tt.cacheTiles() != 2*tt.across*4 {
+		t.Errorf("cache holds %v tiles, with room for %v; want at most 2 rows of %v tiles for each of 4 strips", n, tt.cacheTiles(), tt.across)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"image/color"
+	"time"
+)
+
+// errPixelTimeout is returned by a reducer wrapped with withTimeout when the
+// pixel takes longer than the timeout.
+var errPixelTimeout = errors.New("reducer timed out")
+
+// timedOutPixels counts the pixels of the last merge that were left empty by
+// --pixel-reducer-timeout.
+var timedOutPixels int64
+
+// tally collects the counter updates made while reducing one pixel, such as
+// identicalPixels or rejectedByInput, so that they can be applied once the
+// pixel's result is known to be used. A nil tally applies them at once.
+type tally struct {
+	counts []*int64
+}
+
+// count adds one to the counter at p, or records that it should be.
+func (t *tally) count(p *int64) {
+	if t == nil {
+		count(p)
+		return
+	}
+	t.counts = append(t.counts, p)
+}
+
+// withTimeout runs reduce for each pixel on its own goroutine and gives up on
+// the pixel with errPixelTimeout if it hasn't finished within d.
+//
+// Go cannot stop a goroutine from the outside, so a reducer that times out
+// keeps running in the background until it returns, and its result is
+// discarded. It counts into a tally of its own, which is only committed for a
+// pixel that finishes in time, so an abandoned reducer never changes the
+// counters the reports read, even if it outlives the merge. The goroutine and
+// timer per pixel cost a few microseconds, which about doubles the time of a
+// plain --mode=sigma merge.
+func withTimeout(reduce reducer, d time.Duration) reducer {
+	type result struct {
+		c   color.Color
+		n   int
+		err error
+	}
+	return func(x, y int, colors []color.Color, t *tally) (color.Color, int, error) {
+		done := make(chan result, 1)
+		pixel := &tally{}
+		go func() {
+			c, n, err := reduce(x, y, colors, pixel)
+			done <- result{c, n, err}
+		}()
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case r := <-done:
+			for _, p := range pixel.counts {
+				t.count(p)
+			}
+			return r.c, r.n, r.err
+		case <-timer.C:
+			return nil, 0, errPixelTimeout
+		}
+	}
+}
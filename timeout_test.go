@@ -0,0 +1,37 @@
+package main
+
+import (
+	"image/color"
+	"testing"
+	"time"
+)
+
+// TestTimeoutDropsAbandonedCounts checks that a reducer abandoned by
+// withTimeout leaves the counters alone even when it finishes later, while a
+// pixel that finishes in time has its counts applied.
+func TestTimeoutDropsAbandonedCounts(t *testing.T) {
+	defer func() { identicalPixels = 0 }()
+	identicalPixels = 0
+
+	finished := make(chan struct{})
+	reduce := withTimeout(func(x, y int, colors []color.Color, t *tally) (color.Color, int, error) {
+		if x == 1 {
+			defer close(finished)
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.count(&identicalPixels)
+		return colors[0], len(colors), nil
+	}, 10*time.Millisecond)
+	samples := []color.Color{color.RGBA{1, 2, 3, 255}}
+
+	if _, _, err := reduce(0, 0, samples, nil); err != nil {
+		t.Fatalf("reducing x=0 failed: %v", err)
+	}
+	if _, _, err := reduce(1, 0, samples, nil); err != errPixelTimeout {
+		t.Fatalf("reducing x=1 = %v; want errPixelTimeout", err)
+	}
+	<-finished
+	if identicalPixels != 1 {
+		t.Errorf("identicalPixels = %v after the abandoned reducer finished; want 1", identicalPixels)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"log"
+)
+
+// trimBounds crops uniform borders from out. The border color is taken from
+// the top-left pixel. Fully transparent pixels all count as the same color,
+// whatever their RGB values. If the whole image is uniform, it is returned
+// unchanged.
+func trimBounds(out *image.RGBA) *image.RGBA {
+	b := out.Bounds()
+	border := out.RGBAAt(b.Min.X, b.Min.Y)
+	uniform := func(c color.RGBA) bool {
+		return c == border || (c.A == 0 && border.A == 0)
+	}
+
+	tight := image.Rectangle{}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if !uniform(out.RGBAAt(x, y)) {
+				tight = tight.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	if tight.Empty() {
+		log.Printf("--trim-bounds: output is uniform, keeping %vx%v", b.Dx(), b.Dy())
+		return out
+	}
+	log.Printf("--trim-bounds: cropped %vx%v to %vx%v at (%v, %v)", b.Dx(), b.Dy(), tight.Dx(), tight.Dy(), tight.Min.X, tight.Min.Y)
+	return out.SubImage(tight).(*image.RGBA)
+}
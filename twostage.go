@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// twoStageFallbacks counts the pixels where --two-stage fell back to full
+// statistics.
+var twoStageFallbacks int64
+
+// twoStageReducer implements --two-stage. The first stage takes every
+// --two-stage-factor'th pixel of each input in both directions and computes
+// each channel's mean and sample standard deviation there, which costs about
+// 1/factor² of computing them everywhere. The second stage rejects each
+// full-resolution sample against those statistics, interpolated bilinearly
+// from the four surrounding coarse pixels, and averages the survivors. The
+// coarse pixels are subsampled rather than averaged so that their spread
+// keeps the per-pixel noise that the threshold is measured in.
+//
+// Interpolated statistics are only an estimate where the image changes
+// faster than the coarse grid, such as across sharp edges. There the four
+// surrounding means disagree, so half their range is added in quadrature to
+// the standard deviation to widen the threshold. A pixel where the estimate
+// still rejects every sample falls back to its own full statistics.
+func twoStageReducer(images []image.Image, n func(x, y int) float64, weights func(x, y int) []float64) (reducer, error) {
+	f := *twoStageFactorFlag
+	if f < 2 {
+		return nil, fmt.Errorf("--two-stage-factor must be at least 2, not %v", f)
+	}
+	b := images[0].Bounds()
+	xs, ys := coarseGrid(b.Min.X, b.Max.X, f), coarseGrid(b.Min.Y, b.Max.Y, f)
+	means := make([]float64, 4*len(xs)*len(ys))
+	stddevs := make([]float64, len(means))
+	for j, y := range ys {
+		for i, x := range xs {
+			k := 4 * (j*len(xs) + i)
+			if err := channelStats(colors(x, y, images), means[k:k+4], stddevs[k:k+4]); err != nil {
+				return nil, fmt.Errorf("failed to compute coarse statistics at x=%v y=%v: %v", x, y, err)
+			}
+		}
+	}
+
+	return func(x, y int, colors []color.Color, t *tally) (color.Color, int, error) {
+		if *identicalFastPathFlag && len(colors) > 1 {
+			if c, ok := identicalColor(colors); ok {
+				t.count(&identicalPixels)
+				return c, len(colors), nil
+			}
+		}
+		i, tx := coarseCell(xs, x, f, b.Min.X)
+		j, ty := coarseCell(ys, y, f, b.Min.Y)
+		// The offsets of the four surrounding coarse pixels' statistics.
+		k00, k10 := 4*(j*len(xs)+i), 4*(j*len(xs)+i+1)
+		k01, k11 := k00+4*len(xs), k10+4*len(xs)
+		var m, s [4]float64
+		for ch := 0; ch < 4; ch++ {
+			m[ch] = bilinear(means[k00+ch], means[k10+ch], means[k01+ch], means[k11+ch], tx, ty)
+			s[ch] = bilinear(stddevs[k00+ch], stddevs[k10+ch], stddevs[k01+ch], stddevs[k11+ch], tx, ty)
+			lo := math.Min(math.Min(means[k00+ch], means[k10+ch]), math.Min(means[k01+ch], means[k11+ch]))
+			hi := math.Max(math.Max(means[k00+ch], means[k10+ch]), math.Max(means[k01+ch], means[k11+ch]))
+			s[ch] = math.Hypot(s[ch], (hi-lo)/2)
+		}
+		c, kept, err := filterMean(t, colors, weights(x, y), m[:], s[:], n(x, y))
+		if err == errAllRejected {
+			t.count(&twoStageFallbacks)
+			return meanColor(t, colors, weights(x, y), n(x, y))
+		}
+		return c, kept, err
+	}, nil
+}
+
+// bilinear interpolates between the values at the top left, top right, bottom
+// left and bottom right corners of a cell, at tx across and ty down it.
+func bilinear(v00, v10, v01, v11, tx, ty float64) float64 {
+	top := v00 + (v10-v00)*tx
+	bottom := v01 + (v11-v01)*tx
+	return top + (bottom-top)*ty
+}
+
+// coarseGrid returns the coordinates from min to max, exclusive, that the
+// first stage of --two-stage samples: every f'th one, plus the last so that
+// every coordinate lies between two of them. An image one pixel across gets
+// that pixel twice.
+func coarseGrid(min, max, f int) []int {
+	var grid []int
+	for v := min; v < max; v += f {
+		grid = append(grid, v)
+	}
+	if len(grid) == 1 || grid[len(grid)-1] != max-1 {
+		grid = append(grid, max-1)
+	}
+	return grid
+}
+
+// coarseCell returns the index in grid of the coarse coordinate at or before
+// v, and how far v lies towards the next one, from 0 to 1. The index is never
+// the last one, so the next one always exists.
+func coarseCell(grid []int, v, f, min int) (int, float64) {
+	i := minInt((v-min)/f, len(grid)-2)
+	if grid[i+1] == grid[i] {
+		return i, 0
+	}
+	return i, float64(v-grid[i]) / float64(grid[i+1]-grid[i])
+}
+
+// channelStats stores the mean and sample standard deviation of each channel
+// of colors in means and stddevs, in R, G, B, A order.
+func channelStats(colors []color.Color, means, stddevs []float64) error {
+	channels := make([][]float64, 4)
+	for _, c := range colors {
+		r, g, b, a := c.RGBA()
+		for ch, v := range [4]uint32{r, g, b, a} {
+			channels[ch] = append(channels[ch], float64(v))
+		}
+	}
+	for ch, xs := range channels {
+		m, err := sampleMean(xs)
+		if err != nil {
+			return err
+		}
+		s, err := sampleStddev(xs)
+		if err != nil {
+			return err
+		}
+		means[ch], stddevs[ch] = m, s
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// inputWeights holds the --weights value for each input in the order of the
+// paths being merged, or is nil when every input is weighted equally.
+var inputWeights []float64
+
+// parseWeights reads --weights, a comma separated list with one weight per
+// file in all, the resolved paths before any were dropped. It returns the
+// weights of the files in kept, which must be a subset of all.
+func parseWeights(list string, all, kept []string) ([]float64, error) {
+	fields := strings.Split(list, ",")
+	if len(fields) != len(all) {
+		return nil, fmt.Errorf("got %v weights for %v input files", len(fields), len(all))
+	}
+	byPath := map[string]float64{}
+	for i, f := range fields {
+		w, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse weight %q for %v: %v", f, all[i], err)
+		}
+		if math.IsNaN(w) || math.IsInf(w, 0) {
+			return nil, fmt.Errorf("weight %q for %v is not a finite number", f, all[i])
+		}
+		byPath[all[i]] = w
+	}
+	weights := make([]float64, len(kept))
+	for i, p := range kept {
+		weights[i] = byPath[p]
+	}
+	return weights, nil
+}
+
+// verifyWeightsSum implements --verify-weights-sum. Negative weights are an
+// error, as is a list with nothing to normalize. Weights that don't sum to 1
+// are scaled so they do, with a warning.
+func verifyWeightsSum(weights []float64) ([]float64, error) {
+	sum := 0.0
+	for i, w := range weights {
+		if w < 0 {
+			return nil, fmt.Errorf("weight %v for input %v is negative", w, i+1)
+		}
+		sum += w
+	}
+	if sum == 0 {
+		return nil, fmt.Errorf("weights sum to 0")
+	}
+	if math.Abs(sum-1) <= 1e-9 {
+		return weights, nil
+	}
+	log.Printf("warning: --weights sum to %v rather than 1; normalizing them", sum)
+	out := make([]float64, len(weights))
+	for i, w := range weights {
+		out[i] = w / sum
+	}
+	return out, nil
+}